@@ -20,6 +20,7 @@ func setupCommands() {
 	CMD_FUNCS["index"] = cmd.RunIndexCmdLine
 	CMD_FUNCS["rebuild"] = cmd.RunRebuildCmdLine
 	CMD_FUNCS["inspect"] = cmd.RunInspectCmdLine
+	CMD_FUNCS["migrate"] = cmd.RunMigrateCmdLine
 	CMD_FUNCS["version"] = cmd.RunVersionCmdLine
 
 	for k, _ := range CMD_FUNCS {
@@ -29,7 +30,7 @@ func setupCommands() {
 
 var USAGE = `sybil: a fast and simple NoSQL column store
 
-Commands: ingest, digest, trim, query, session, rebuild, inspect
+Commands: ingest, digest, trim, query, session, rebuild, inspect, migrate
 
 Storage Commands:
 
@@ -73,6 +74,12 @@ Emergency Maintenance Commands:
     example: sybil inspect -file ./db/TABLE/info.db
     example: sybil inspect -file ./db/TABLE/BLOCK/info.db
     example: sybil inspect -file ./db/TABLE/BLOCK/str_COL.db
+    example: sybil inspect -file ./db/TABLE/BLOCK/manifest.db
+
+  migrate: rewrite blocks from older versions in the current block format
+
+    example: sybil migrate -table TABLE -dry-run
+    example: sybil migrate -table TABLE
 
 `
 
@@ -4,6 +4,7 @@ import sybil "github.com/logv/sybil/src/lib"
 
 import "flag"
 
+import "path"
 import "strconv"
 
 func decodeTableInfo(digest_file *string) bool {
@@ -79,6 +80,24 @@ func decodeStrCol(digest_file *string) bool {
 
 }
 
+func decodeManifest(digest_file *string) bool {
+	manifest := sybil.LoadBlockManifest(path.Dir(*digest_file))
+	if manifest == nil {
+		return false
+	}
+
+	sybil.Print("BLOCK MANIFEST VERSION", manifest.Version, "RECORDS", manifest.NumRecords)
+	for _, col := range manifest.Columns {
+		sybil.Print("COLUMN", col.Name, col.Type, col.Encoding, col.File, col.Size, "BYTES", "CHECKSUM", col.Checksum)
+	}
+
+	if err := sybil.VerifyBlock(path.Dir(*digest_file)); err != nil {
+		sybil.Print("ERROR", err)
+	}
+
+	return true
+}
+
 // TODO: make a list of potential types that can be decoded into
 func RunInspectCmdLine() {
 	digest_file := flag.String("file", "", "Name of file to inspect")
@@ -89,6 +108,12 @@ func RunInspectCmdLine() {
 		return
 	}
 
+	// manifests share fields with block infos, so we go by the file name
+	if path.Base(*digest_file) == sybil.MANIFEST_FILE {
+		decodeManifest(digest_file)
+		return
+	}
+
 	if decodeTableInfo(digest_file) {
 		return
 	}
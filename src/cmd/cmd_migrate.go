@@ -0,0 +1,39 @@
+package sybil_cmd
+
+import "flag"
+
+import sybil "github.com/logv/sybil/src/lib"
+
+func RunMigrateCmdLine() {
+	DRY_RUN := flag.Bool("dry-run", false, "list the blocks that would be migrated without rewriting them")
+	flag.Parse()
+
+	if *sybil.FLAGS.TABLE == "" {
+		flag.PrintDefaults()
+		return
+	}
+
+	if *sybil.FLAGS.PROFILE {
+		profile := sybil.RUN_PROFILER()
+		defer profile.Start().Stop()
+	}
+
+	sybil.DELETE_BLOCKS_AFTER_QUERY = false
+
+	t := sybil.GetTable(*sybil.FLAGS.TABLE)
+	if t.LoadTableInfo() == false {
+		sybil.Warn("Couldn't read table info, exiting early")
+		return
+	}
+
+	blocks := t.MigrateBlocks(*DRY_RUN)
+	for _, name := range blocks {
+		sybil.Print(name)
+	}
+
+	if *DRY_RUN {
+		sybil.Print(len(blocks), "BLOCKS OLDER THAN VERSION", sybil.BLOCK_VERSION)
+	} else {
+		sybil.Print("MIGRATED", len(blocks), "BLOCKS TO VERSION", sybil.BLOCK_VERSION)
+	}
+}
@@ -5,6 +5,7 @@ import sybil "github.com/logv/sybil/src/lib"
 import "fmt"
 import "flag"
 import "strings"
+import "strconv"
 import "time"
 import "path"
 import "runtime/debug"
@@ -14,20 +15,63 @@ var MAX_RECORDS_NO_GC = 4 * 1000 * 1000 // 4 million
 var LIST_TABLES *bool
 var TIME_FORMAT *string
 var NO_RECYCLE_MEM *bool
+var TIME_BUCKET *string
+var COMPARE *string
+var TOP_N *int
+var TOP_BY *string
+var ANOMALIES *bool
+var ANOMALY_WINDOW *int
+var ANOMALY_THRESHOLD *float64
+var ANOMALY_SEASON *int
+var VIRTUALS stringList
+var JOIN_LIMIT *int
+
+// a flag that can be given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(val string) error {
+	*l = append(*l, val)
+	return nil
+}
+
+// shared by query, session and trim
+func addTimeRangeFlags() {
+	sybil.FLAGS.SINCE = flag.String("since", "", "only use records since, format: 6h, 7d, epoch seconds or 2026-10-01T00:00:00Z")
+	sybil.FLAGS.UNTIL = flag.String("until", "", "only use records before, same format as -since")
+	sybil.FLAGS.TIME_RANGE = flag.String("range", "", "time range, format: last-7d, today, yesterday or start..end")
+}
 
 func addQueryFlags() {
+	addTimeRangeFlags()
 
 	sybil.FLAGS.PRINT_INFO = flag.Bool("info", false, "Print table info")
 	sybil.FLAGS.SORT = flag.String("sort", sybil.OPTS.SORT_COUNT, "Int Column to sort by")
+	sybil.FLAGS.ORDER_BY = flag.String("order-by", "", "Sort keys, format: 'latency.p95 desc, $COUNT asc'. Overrides -sort")
+	sybil.FLAGS.HAVING = flag.String("having", "", "Filter aggregated results, format: 'count > 100 AND latency.avg > 500'")
+	sybil.FLAGS.SERIES_FN = flag.String("series-fn", "", "Time series functions, format: metric:fn[:arg], fn is one of movavg:N, cumsum, rate, deriv or ewma:alpha")
 	sybil.FLAGS.LIMIT = flag.Int("limit", 100, "Number of results to return")
 
 	sybil.FLAGS.TIME = flag.Bool("time", false, "make a time rollup")
 	sybil.FLAGS.TIME_COL = flag.String("time-col", "time", "which column to treat as a timestamp (use with -time flag)")
-	sybil.FLAGS.TIME_BUCKET = flag.Int("time-bucket", 60*60, "time bucket (in seconds)")
+	TIME_BUCKET = flag.String("time-bucket", "3600", "time bucket, in seconds or as a duration like 15m, 1h, 1d, 1w or 1mo")
+	sybil.FLAGS.TIME_ZONE = flag.String("tz", "", "time zone for time buckets, hour(), dow(), date() and month() groups and output, like America/New_York")
+	sybil.FLAGS.FILL = flag.String("fill", "", "fill missing time buckets with zero, null or previous")
+	TOP_N = flag.Int("top", 0, "keep the top N groups and fold the rest into an __other__ group")
+	TOP_BY = flag.String("top-by", "", "metric to pick the -top groups by, like $COUNT or latency.p95 (defaults to the sort order)")
+	ANOMALIES = flag.Bool("anomalies", false, "print the time buckets that deviate from the preceding buckets (use with -time)")
+	ANOMALY_WINDOW = flag.Int("anomaly-window", 24, "number of preceding buckets to use as the baseline for -anomalies")
+	ANOMALY_THRESHOLD = flag.Float64("anomaly-threshold", 3.5, "robust z-score above which a bucket is anomalous")
+	ANOMALY_SEASON = flag.Int("anomaly-season", 0, "compare buckets against the buckets this many buckets apart, e.g. 24 for daily seasons of hourly buckets")
+	COMPARE = flag.String("compare", "", "compare against the same time range shifted back by this duration, like 1h, 1d or 7d")
 	sybil.FLAGS.WEIGHT_COL = flag.String("weight-col", "", "Which column to treat as an optional weighting column")
 
 	sybil.FLAGS.OP = flag.String("op", "avg", "metric to calculate, either 'avg' or 'hist'")
 	sybil.FLAGS.LOG_HIST = flag.Bool("loghist", false, "Use nested logarithmic histograms")
+	sybil.FLAGS.TDIGEST_HIST = flag.Bool("tdigest", false, "Use t-digest histograms (mergeable, no outlier clipping)")
 	if sybil.ENABLE_HDR {
 		sybil.FLAGS.HDR_HIST = flag.Bool("hdr", false, "Use HDR Histograms (can be slow)")
 	}
@@ -37,6 +81,7 @@ func addQueryFlags() {
 	sybil.FLAGS.INT_FILTERS = flag.String("int-filter", "", "Int filters, format: col:op:val")
 
 	sybil.FLAGS.HIST_BUCKET = flag.Int("int-bucket", 0, "Int hist bucket size")
+	sybil.FLAGS.PERCENTILES = flag.String("percentiles", "", "Percentiles to output with -op hist, format: 50,90,99,99.9")
 
 	sybil.FLAGS.STR_REPLACE = flag.String("str-replace", "", "Str replacement, format: col:find:replace")
 	sybil.FLAGS.STR_FILTERS = flag.String("str-filter", "", "Str filters, format: col:op:val")
@@ -45,7 +90,11 @@ func addQueryFlags() {
 
 	sybil.FLAGS.INTS = flag.String("int", "", "Integer values to aggregate")
 	sybil.FLAGS.STRS = flag.String("str", "", "String values to load")
-	sybil.FLAGS.GROUPS = flag.String("group", "", "values group by")
+	flag.Var(&VIRTUALS, "virtual", "Virtual column computed per record, format: name=expr, like 'bucket=floor(latency/100)*100'. Can be repeated")
+	sybil.FLAGS.JOIN_TABLE = flag.String("join-table", "", "Lookup table to join against, its columns are used as table.col in groups, filters and aggregations")
+	sybil.FLAGS.JOIN_KEY = flag.String("join-key", "", "Column to join on, in both tables")
+	JOIN_LIMIT = flag.Int("join-limit", 1000*1000, "Max number of rows to load from the -join-table")
+	sybil.FLAGS.GROUPS = flag.String("group", "", "values group by, or hour(col), dow(col), date(col) and month(col) of a time column, or int buckets like col:bucket=100, col:log2 or col:buckets=10;100;1000")
 
 	sybil.FLAGS.EXPORT = flag.Bool("export", false, "export data to TSV")
 
@@ -67,6 +116,45 @@ func addQueryFlags() {
 
 }
 
+func contains(cols []string, col string) bool {
+	for _, c := range cols {
+		if c == col {
+			return true
+		}
+	}
+
+	return false
+}
+
+// the columns of the query that come from the join table, like users.plan
+func joinedColumns(prefix string, col_lists ...[]string) []string {
+	cols := make([]string, 0)
+	add := func(col string) {
+		if strings.HasPrefix(col, prefix) && !contains(cols, col) {
+			cols = append(cols, col)
+		}
+	}
+
+	for _, list := range col_lists {
+		for _, col := range list {
+			_, col = sybil.ParseGroupingFunc(col)
+			add(col)
+		}
+	}
+
+	for _, filters := range []string{*sybil.FLAGS.INT_FILTERS, *sybil.FLAGS.STR_FILTERS} {
+		if filters == "" {
+			continue
+		}
+
+		for _, filter := range strings.Split(filters, *sybil.FLAGS.FIELD_SEPARATOR) {
+			add(strings.Split(filter, *sybil.FLAGS.FILTER_SEPARATOR)[0])
+		}
+	}
+
+	return cols
+}
+
 func RunQueryCmdLine() {
 	addQueryFlags()
 	flag.Parse()
@@ -80,17 +168,41 @@ func RunQueryCmdLine() {
 		sybil.OPTS.TIME_FORMAT = sybil.GetTimeFormat(*TIME_FORMAT)
 	}
 
+	if *sybil.FLAGS.PERCENTILES != "" {
+		for _, p := range strings.Split(*sybil.FLAGS.PERCENTILES, *sybil.FLAGS.FIELD_SEPARATOR) {
+			val, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil || val < 0 || val > 100 {
+				sybil.Error("Invalid percentile:", p)
+			}
+
+			sybil.OPTS.PERCENTILES = append(sybil.OPTS.PERCENTILES, val)
+		}
+	}
+
 	table := *sybil.FLAGS.TABLE
 	if table == "" {
 		flag.PrintDefaults()
 		return
 	}
 
-	t := sybil.GetTable(table)
-	if t.IsNotExist() {
-		sybil.Error(t.Name, "table can not be loaded or does not exist in", *sybil.FLAGS.DIR)
+	// A LIST OR GLOB OF TABLES RUNS THE SAME QUERY OVER EACH OF THEM. THE
+	// QUERY IS BUILT AGAINST THE FIRST TABLE
+	tables := []*sybil.Table{}
+	for _, name := range sybil.ResolveTables(table) {
+		t := sybil.GetTable(name)
+		if t.IsNotExist() {
+			sybil.Error(t.Name, "table can not be loaded or does not exist in", *sybil.FLAGS.DIR)
+		}
+		tables = append(tables, t)
+	}
+
+	if len(tables) == 0 {
+		sybil.Error("No tables match", table, "in", *sybil.FLAGS.DIR)
 	}
 
+	t := tables[0]
+	table = t.Name
+
 	ints := make([]string, 0)
 	groups := make([]string, 0)
 	strs := make([]string, 0)
@@ -116,6 +228,66 @@ func RunQueryCmdLine() {
 	if *sybil.FLAGS.INTS != "" {
 		ints = strings.Split(*sybil.FLAGS.INTS, *sybil.FLAGS.FIELD_SEPARATOR)
 	}
+
+	order_by := *sybil.FLAGS.SORT
+	if *sybil.FLAGS.ORDER_BY != "" {
+		order_by = *sybil.FLAGS.ORDER_BY
+	}
+
+	// SORT KEYS AND HAVING COLUMNS THAT AREN'T AGGREGATED YET GET ADDED TO THE INTS
+	metric_cols := make([]sybil.OrderKey, 0)
+	for _, spec := range []string{order_by, *TOP_BY} {
+		keys, err := sybil.ParseOrderBy(spec)
+		if err != nil {
+			sybil.Error(err)
+		}
+		metric_cols = append(metric_cols, keys...)
+	}
+	having_keys, err := sybil.HavingKeys(*sybil.FLAGS.HAVING)
+	if err != nil {
+		sybil.Error(err)
+	}
+	metric_cols = append(metric_cols, having_keys...)
+
+	series_fns, err := sybil.ParseSeriesFns(*sybil.FLAGS.SERIES_FN)
+	if err != nil {
+		sybil.Error(err)
+	}
+	for _, fn := range series_fns {
+		metric_cols = append(metric_cols, sybil.OrderKey{Col: fn.Col, Metric: fn.Metric})
+	}
+
+	for _, key := range metric_cols {
+		if key.Col == sybil.OPTS.SORT_COUNT || key.Col == sybil.ORDER_BY_GROUP || contains(groups, key.Col) {
+			continue
+		}
+
+		if _, ok := sybil.ParsePercentileName(key.Metric); ok && *sybil.FLAGS.OP != "hist" {
+			sybil.Error("Sorting or filtering by a percentile requires -op hist")
+		}
+
+		if !contains(ints, key.Col) {
+			ints = append(ints, key.Col)
+		}
+	}
+
+	time_bucket, time_bucket_unit, err := sybil.ParseTimeBucket(*TIME_BUCKET)
+	if err != nil {
+		sybil.Error(err)
+	}
+	sybil.FLAGS.TIME_BUCKET = &time_bucket
+	sybil.OPTS.TIME_BUCKET_UNIT = time_bucket_unit
+
+	if _, err := sybil.LoadTimeZone(*sybil.FLAGS.TIME_ZONE); err != nil {
+		sybil.Error("Invalid time zone:", *sybil.FLAGS.TIME_ZONE)
+	}
+
+	switch *sybil.FLAGS.FILL {
+	case "", "zero", "null", "previous":
+	default:
+		sybil.Error("Invalid fill, expected zero, null or previous:", *sybil.FLAGS.FILL)
+	}
+
 	if *sybil.FLAGS.PROFILE && sybil.PROFILER_ENABLED {
 		profile := sybil.RUN_PROFILER()
 		defer profile.Start().Stop()
@@ -141,6 +313,47 @@ func RunQueryCmdLine() {
 
 	sybil.Debug("WILL INSPECT", count, "RECORDS")
 
+	// VIRTUAL COLUMNS NEED THEIR KEY IDS BEFORE THE GROUPS, AGGREGATIONS AND
+	// FILTERS LOOK THEM UP
+	virtuals := []sybil.VirtualColumn{}
+	for _, v := range VIRTUALS {
+		name, expr, err := sybil.ParseVirtualFlag(v)
+		if err != nil {
+			sybil.Error(err)
+		}
+
+		virtual, err := t.VirtualColumn(name, expr)
+		if err != nil {
+			sybil.Error("Invalid virtual column", name, err)
+		}
+		virtuals = append(virtuals, virtual)
+	}
+
+	// COLUMNS LIKE users.plan ARE LOOKED UP IN THE JOIN TABLE'S RECORD WITH THE
+	// SAME JOIN KEY, AS VIRTUAL COLUMNS
+	if *sybil.FLAGS.JOIN_TABLE != "" {
+		if *sybil.FLAGS.JOIN_KEY == "" {
+			sybil.Error("-join-table needs a -join-key")
+		}
+
+		jt, err := sybil.LoadJoinTable(*sybil.FLAGS.JOIN_TABLE, *sybil.FLAGS.JOIN_KEY, *JOIN_LIMIT)
+		if err != nil {
+			sybil.Error(err)
+		}
+
+		for _, col := range joinedColumns(jt.Name+".", groups, ints, strs) {
+			expr := fmt.Sprintf("lookup(\"%s\", %s, \"%s\")", jt.Name, *sybil.FLAGS.JOIN_KEY, col[len(jt.Name)+1:])
+			virtual, err := t.VirtualColumn(col, expr)
+			if err != nil {
+				sybil.Error("Invalid join column", col, err)
+			}
+			virtuals = append(virtuals, virtual)
+		}
+
+		// CACHED RESULTS DON'T KNOW ABOUT CHANGES TO THE JOIN TABLE
+		sybil.FLAGS.CACHED_QUERIES = &FALSE
+	}
+
 	groupings := []sybil.Grouping{}
 	for _, g := range groups {
 		groupings = append(groupings, t.Grouping(g))
@@ -151,6 +364,11 @@ func RunQueryCmdLine() {
 		aggs = append(aggs, t.Aggregation(agg, *sybil.FLAGS.OP))
 	}
 
+	having, err := sybil.ParseHaving(*sybil.FLAGS.HAVING, aggs)
+	if err != nil {
+		sybil.Error(err)
+	}
+
 	// VERIFY THE KEY TABLE IS IN ORDER, OTHERWISE WE NEED TO EXIT
 	sybil.Debug("KEY TABLE", t.KeyTable)
 	sybil.Debug("KEY TYPES", t.KeyTypes)
@@ -164,19 +382,66 @@ func RunQueryCmdLine() {
 		}
 	}
 
+	// A COMPARISON READS BOTH WINDOWS, SO ITS TIME FILTERS START AT THE
+	// SHIFTED WINDOW
+	time_range, err := sybil.ParseTimeRangeFlags()
+	if err != nil {
+		sybil.Error(err)
+	}
+
+	compare_offset := int64(0)
+	if *COMPARE != "" {
+		compare_offset, err = sybil.ParseRelativeDuration(*COMPARE)
+		if err != nil || compare_offset <= 0 {
+			sybil.Error("Invalid -compare duration:", *COMPARE)
+		}
+
+		if !time_range.HasStart {
+			sybil.Error("-compare needs a time range, use -since or -range")
+		}
+
+		if !time_range.HasEnd {
+			time_range.End = time.Now().Unix() + 1
+			time_range.HasEnd = true
+		}
+	}
+
+	filter_range := time_range
+	filter_range.Start -= compare_offset
+	if err := filter_range.AddIntFilters(); err != nil {
+		sybil.Error(err)
+	}
+
 	loadSpec := t.NewLoadSpec()
 	filterSpec := sybil.FilterSpec{Int: *sybil.FLAGS.INT_FILTERS, Str: *sybil.FLAGS.STR_FILTERS, Set: *sybil.FLAGS.SET_FILTERS}
 	filters := sybil.BuildFilters(t, &loadSpec, filterSpec)
 
-	query_params := sybil.QueryParams{Groups: groupings, Filters: filters, Aggregations: aggs}
+	query_params := sybil.QueryParams{Groups: groupings, Filters: filters, Aggregations: aggs, Virtuals: virtuals}
 	querySpec := sybil.QuerySpec{QueryParams: query_params}
 
 	for _, v := range groups {
+		// GROUPS LIKE hour(time) OR latency:bucket=100 ARE COMPUTED FROM AN
+		// INT COLUMN
+		fn, col := sybil.ParseGroupingFunc(v)
+		if fn != "" {
+			if _, _, err := sybil.ParseGroupingArgs(fn); err != nil {
+				sybil.Error("Invalid group", v, err)
+			}
+
+			if t.GetColumnType(col) != sybil.INT_VAL {
+				sybil.Error(v, "needs an int column, but", col, "is not one")
+			}
+			loadSpec.Int(col)
+			continue
+		}
+
 		switch t.GetColumnType(v) {
 		case sybil.STR_VAL:
 			loadSpec.Str(v)
 		case sybil.INT_VAL:
 			loadSpec.Int(v)
+		case sybil.SET_VAL:
+			loadSpec.Set(v)
 		default:
 			t.PrintColInfo()
 			fmt.Println("")
@@ -187,22 +452,52 @@ func RunQueryCmdLine() {
 	for _, v := range strs {
 		loadSpec.Str(v)
 	}
+	for _, virtual := range virtuals {
+		for _, v := range virtual.Columns() {
+			switch t.GetColumnType(v) {
+			case sybil.STR_VAL:
+				loadSpec.Str(v)
+			case sybil.INT_VAL:
+				loadSpec.Int(v)
+			}
+		}
+	}
 	for _, v := range ints {
 		loadSpec.Int(v)
 	}
 
-	if *sybil.FLAGS.SORT != "" {
-		if *sybil.FLAGS.SORT != sybil.OPTS.SORT_COUNT {
-			loadSpec.Int(*sybil.FLAGS.SORT)
+	querySpec.OrderBy = order_by
+	querySpec.TimeZone = *sybil.FLAGS.TIME_ZONE
+	querySpec.Having = having
+	querySpec.SeriesFns = series_fns
+
+	if *TOP_N > 0 {
+		querySpec.TopN = *TOP_N
+		querySpec.TopBy = *TOP_BY
+
+		// make room for the __other__ group
+		if *sybil.FLAGS.LIMIT <= *TOP_N {
+			limit := *TOP_N + 1
+			sybil.FLAGS.LIMIT = &limit
+		}
+	}
+
+	if *ANOMALIES {
+		if !*sybil.FLAGS.TIME {
+			sybil.Error("-anomalies requires -time")
+		}
+
+		if *ANOMALY_WINDOW < 1 || *ANOMALY_SEASON < 0 || *ANOMALY_THRESHOLD <= 0 {
+			sybil.Error("Invalid anomaly window, season or threshold")
 		}
-		querySpec.OrderBy = *sybil.FLAGS.SORT
-	} else {
-		querySpec.OrderBy = ""
+
+		querySpec.Anomalies = &sybil.AnomalySpec{Window: *ANOMALY_WINDOW, Threshold: *ANOMALY_THRESHOLD, Season: *ANOMALY_SEASON}
 	}
 
 	if *sybil.FLAGS.TIME {
 		// TODO: infer the TimeBucket size
 		querySpec.TimeBucket = *sybil.FLAGS.TIME_BUCKET
+		querySpec.TimeBucketUnit = sybil.OPTS.TIME_BUCKET_UNIT
 		sybil.Debug("USING TIME BUCKET", querySpec.TimeBucket, "SECONDS")
 		loadSpec.Int(*sybil.FLAGS.TIME_COL)
 		time_col_id, ok := t.KeyTable[*sybil.FLAGS.TIME_COL]
@@ -211,6 +506,18 @@ func RunQueryCmdLine() {
 		}
 	}
 
+	if compare_offset > 0 {
+		querySpec.CompareOffset = int(compare_offset)
+		querySpec.CompareStart = time_range.Start
+		querySpec.CompareEnd = time_range.End
+
+		loadSpec.Int(*sybil.FLAGS.TIME_COL)
+		time_col_id, ok := t.KeyTable[*sybil.FLAGS.TIME_COL]
+		if ok {
+			sybil.OPTS.TIME_COL_ID = time_col_id
+		}
+	}
+
 	if *sybil.FLAGS.WEIGHT_COL != "" {
 		sybil.OPTS.WEIGHT_COL = true
 		loadSpec.Int(*sybil.FLAGS.WEIGHT_COL)
@@ -249,7 +556,11 @@ func RunQueryCmdLine() {
 		start := time.Now()
 		// We can load and query at the same time
 		if *sybil.FLAGS.LOAD_AND_QUERY {
-			count = t.LoadAndQueryRecords(&loadSpec, &querySpec)
+			if len(tables) > 1 {
+				count = sybil.LoadAndQueryTables(tables, &loadSpec, &querySpec)
+			} else {
+				count = t.LoadAndQueryRecords(&loadSpec, &querySpec)
+			}
 
 			end := time.Now()
 			sybil.Debug("LOAD AND QUERY RECORDS TOOK", end.Sub(start))
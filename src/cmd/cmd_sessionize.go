@@ -7,25 +7,53 @@ import "time"
 import "runtime/debug"
 import "strings"
 
+var FUNNEL *string
+var FUNNEL_WITHIN *string
+var SESSION_FILTERS stringList
+var COHORT *string
+var COHORT_PERIODS *int
+var SESSION_AGGS *string
+var OUTPUT_TABLE *string
+var PATH_FLOW *bool
+var PATH_ANCHOR *string
+var SESSION_MEMORY *int
+
 func addSessionFlags() {
 	sybil.FLAGS.PRINT = flag.Bool("print", false, "Print some records")
 	sybil.FLAGS.TIME_COL = flag.String("time-col", "time", "which column to treat as a timestamp (use with -time flag)")
 	sybil.FLAGS.SESSION_COL = flag.String("session", "", "Column to use for sessionizing")
 	sybil.FLAGS.SESSION_CUTOFF = flag.Int("cutoff", 60, "distance between consecutive events before generating a new session")
+	sybil.FLAGS.SESSION_MAX_EVENTS = flag.Int("max-session-events", 0, "close sessions once they have this many events (0 for no limit)")
+	sybil.FLAGS.SESSION_MAX_LENGTH = flag.Int("max-session-length", 0, "close sessions once they are this many minutes long (0 for no limit)")
+	SESSION_MEMORY = flag.Int("session-mem", 0, "MB of active session records to keep in memory before spilling the oldest sessions to disk (0 for no limit)")
 	sybil.FLAGS.JOIN_TABLE = flag.String("join-table", "", "dataset to join against for session summaries")
 	sybil.FLAGS.JOIN_KEY = flag.String("join-key", "", "Field to join sessionid against in join-table")
 	sybil.FLAGS.JOIN_GROUP = flag.String("join-group", "", "Group by columns to pull from join record")
 	sybil.FLAGS.PATH_KEY = flag.String("path-key", "", "Field to use for pathing")
 	sybil.FLAGS.PATH_LENGTH = flag.Int("path-length", 3, "Size of paths to histogram")
+	PATH_FLOW = flag.Bool("path-flow", false, "count step by step transitions of the -path-key values for -path-length steps, for Sankey diagrams with -json")
+	PATH_ANCHOR = flag.String("path-anchor", "", "start path flows at the first event like col=val instead of the session start")
 	sybil.FLAGS.RETENTION = flag.Bool("calendar", false, "calculate retention calendars")
+	COHORT = flag.String("cohort", "", "print a cohort retention table by the day, week or month entities were first seen (implies -calendar)")
+	COHORT_PERIODS = flag.Int("cohort-periods", 8, "number of periods after the first to show in the -cohort table")
+	SESSION_AGGS = flag.String("session-agg", "", "Values to compute per session and histogram across sessions, format: sum:col, min:col, max:col, avg:col or count:col=val, comma separated")
+	FUNNEL = flag.String("funnel", "", "Funnel steps to count sessions through, in order, format: col=val,col=val,...")
+	FUNNEL_WITHIN = flag.String("within", "", "Time from the first funnel step to the last, like 30m, 1h or 7d")
 	sybil.FLAGS.JSON = flag.Bool("json", false, "print results in JSON form")
+	sybil.FLAGS.READ_ROWSTORE = flag.Bool("read-log", false, "include the records in the ingestion log, which aren't digested into blocks yet")
+	OUTPUT_TABLE = flag.String("output-table", "", "table to save a record per session into (session columns, time, end, duration, events and -session-agg values)")
 
 	sybil.FLAGS.INT_FILTERS = flag.String("int-filter", "", "Int filters, format: col:op:val")
 	sybil.FLAGS.STR_FILTERS = flag.String("str-filter", "", "Str filters, format: col:op:val")
 	sybil.FLAGS.SET_FILTERS = flag.String("set-filter", "", "Set filters, format: col:op:val")
 
+	flag.Var(&SESSION_FILTERS, "session-filter", "Keep sessions by their events, format: contains:col=val, not-contains:col=val, followed-by:col=val:col=val or not-followed-by:col=val:col=val. Can be repeated")
+
 	sybil.FLAGS.STR_REPLACE = flag.String("str-replace", "", "Str replacement, format: col:find:replace")
 	sybil.FLAGS.LIMIT = flag.Int("limit", 100, "Number of results to return")
+
+	addTimeRangeFlags()
+	sybil.FLAGS.TIME_ZONE = flag.String("tz", "", "time zone for -since and -range dates, like America/New_York")
 }
 
 func RunSessionizeCmdLine() {
@@ -39,6 +67,14 @@ func RunSessionizeCmdLine() {
 		return
 	}
 
+	if err := sybil.AddTimeRangeFilters(); err != nil {
+		sybil.Error(err)
+	}
+
+	if *sybil.FLAGS.READ_ROWSTORE {
+		sybil.FLAGS.READ_INGESTION_LOG = &sybil.TRUE
+	}
+
 	table_names := strings.Split(table, *sybil.FLAGS.FIELD_SEPARATOR)
 	sybil.Debug("LOADING TABLES", table_names)
 
@@ -91,7 +127,68 @@ func RunSessionizeCmdLine() {
 
 	if *sybil.FLAGS.SESSION_COL != "" {
 		sessionSpec := sybil.NewSessionSpec()
-		sybil.LoadAndSessionize(tables, &querySpec, &sessionSpec)
+		if *FUNNEL != "" {
+			funnel, err := sybil.ParseFunnel(*FUNNEL, *FUNNEL_WITHIN)
+			if err != nil {
+				sybil.Error(err)
+			}
+			sessionSpec.Funnel = funnel
+		}
+
+		if *COHORT != "" {
+			cohorts, err := sybil.ParseCohortSpec(*COHORT, *COHORT_PERIODS)
+			if err != nil {
+				sybil.Error(err)
+			}
+			sessionSpec.Cohorts = cohorts
+			sybil.FLAGS.RETENTION = &sybil.TRUE
+		}
+
+		if *SESSION_AGGS != "" {
+			aggs, err := sybil.ParseSessionAggs(*SESSION_AGGS)
+			if err != nil {
+				sybil.Error(err)
+			}
+			sessionSpec.Aggs = aggs
+		}
+
+		if *PATH_FLOW {
+			if *sybil.FLAGS.PATH_KEY == "" {
+				sybil.Error("-path-flow needs a -path-key")
+			}
+
+			flow, err := sybil.NewPathFlow(*sybil.FLAGS.PATH_LENGTH, *PATH_ANCHOR)
+			if err != nil {
+				sybil.Error(err)
+			}
+			sessionSpec.Flow = flow
+		}
+
+		if *OUTPUT_TABLE != "" {
+			for _, tablename := range table_names {
+				if tablename == *OUTPUT_TABLE {
+					sybil.Error("Can't write sessions into", tablename, "while reading it")
+				}
+			}
+
+			output := sybil.GetTable(*OUTPUT_TABLE)
+			output.LoadTableInfo()
+			sessionSpec.Output = output
+		}
+
+		sessionSpec.MemoryBudget = int64(*SESSION_MEMORY) * 1024 * 1024
+
+		for _, f := range SESSION_FILTERS {
+			sf, err := sybil.ParseSessionFilter(f)
+			if err != nil {
+				sybil.Error("Invalid session filter", f, err)
+			}
+			sessionSpec.Filters = append(sessionSpec.Filters, sf)
+		}
+
+		if _, err := sybil.LoadAndSessionize(tables, &querySpec, &sessionSpec); err != nil {
+			sybil.Error(err)
+		}
 	}
 
 	end := time.Now()
@@ -35,6 +35,8 @@ func RunTrimCmdLine() {
 	REALLY := flag.Bool("really", false, "don't prompt before deletion")
 
 	sybil.FLAGS.TIME_COL = flag.String("time-col", "", "which column to treat as a timestamp [REQUIRED]")
+	addTimeRangeFlags()
+	sybil.FLAGS.TIME_ZONE = flag.String("tz", "", "time zone for -since and -range dates, like America/New_York")
 	flag.Parse()
 
 	if *sybil.FLAGS.TABLE == "" || *sybil.FLAGS.TIME_COL == "" {
@@ -60,6 +62,21 @@ func RunTrimCmdLine() {
 
 	trimSpec := sybil.TrimSpec{}
 	trimSpec.DeleteBefore = int64(*DELETE_BEFORE)
+
+	// -since and -range keep the data from their start time onwards
+	time_range, err := sybil.ParseTimeRangeFlags()
+	if err != nil {
+		sybil.Error(err)
+	}
+	if time_range.HasEnd {
+		sybil.Error("trim only supports -since or a -range start")
+	}
+	if time_range.HasStart && *DELETE_BEFORE != 0 {
+		sybil.Error("-before can't be combined with -since or -range")
+	}
+	if time_range.HasStart {
+		trimSpec.DeleteBefore = time_range.Start
+	}
 	trimSpec.MBLimit = int64(*MB_LIMIT)
 
 	to_trim := t.TrimTable(&trimSpec)
@@ -2,8 +2,10 @@ package sybil
 
 import "time"
 import "bytes"
+import "fmt"
 import "sort"
 import "strconv"
+import "strings"
 import "sync"
 import "math"
 
@@ -24,35 +26,351 @@ var GROUP_DELIMITER = "\t"
 type SortResultsByCol struct {
 	Results []*Result
 
-	Col string
+	Keys   []OrderKey
+	Groups []Grouping
+}
+
+// An OrderKey is one term of an -order-by clause, like "latency.p95 asc"
+type OrderKey struct {
+	Col    string
+	Metric string
+	Desc   bool
+}
+
+var ORDER_BY_GROUP = "$GROUP"
+
+var ORDER_METRICS = map[string]bool{
+	"avg":   true,
+	"sum":   true,
+	"count": true,
+	"min":   true,
+	"max":   true,
 }
 
 func (a SortResultsByCol) Len() int      { return len(a.Results) }
 func (a SortResultsByCol) Swap(i, j int) { a.Results[i], a.Results[j] = a.Results[j], a.Results[i] }
 
-// This sorts the records in descending order
+// Keys are compared in order, the first key that differs decides
 func (a SortResultsByCol) Less(i, j int) bool {
-	if a.Col == OPTS.SORT_COUNT {
-		t1 := a.Results[i].Count
-		t2 := a.Results[j].Count
+	for _, key := range a.Keys {
+		cmp := a.compare(a.Results[i], a.Results[j], key)
+		if cmp == 0 {
+			continue
+		}
+
+		if key.Desc {
+			return cmp > 0
+		}
+
+		return cmp < 0
+	}
+
+	return false
+}
+
+func (a SortResultsByCol) compare(r1, r2 *Result, key OrderKey) int {
+	if key.Col == OPTS.SORT_COUNT {
+		return compareFloats(float64(r1.Count), float64(r2.Count))
+	}
+
+	if key.Col == ORDER_BY_GROUP {
+		for i := range a.Groups {
+			cmp := compareGroupVals(groupKeyPart(r1.GroupByKey, i), groupKeyPart(r2.GroupByKey, i))
+			if cmp != 0 {
+				return cmp
+			}
+		}
 
-		return t1 > t2
+		return 0
+	}
+
+	for i, g := range a.Groups {
+		if g.Name == key.Col {
+			return compareGroupVals(groupKeyPart(r1.GroupByKey, i), groupKeyPart(r2.GroupByKey, i))
+		}
 	}
 
-	if *FLAGS.OP == "hist" {
-		t1 := a.Results[i].Hists[a.Col].Mean()
-		t2 := a.Results[j].Hists[a.Col].Mean()
-		return t1 > t2
+	return compareFloats(r1.metricValue(key.Col, key.Metric), r2.metricValue(key.Col, key.Metric))
+}
 
+func compareFloats(t1, t2 float64) int {
+	switch {
+	case t1 < t2:
+		return -1
+	case t1 > t2:
+		return 1
 	}
 
-	t1 := a.Results[i].Hists[a.Col].Mean()
-	t2 := a.Results[j].Hists[a.Col].Mean()
-	return t1 > t2
+	return 0
 }
 
-func FilterAndAggRecords(querySpec *QuerySpec, recordsPtr *RecordList) int {
+// group values are compared numerically when they are both ints or bucket
+// ranges, otherwise alphabetically
+func compareGroupVals(v1, v2 string) int {
+	i1, err1 := strconv.ParseInt(v1, 10, 64)
+	i2, err2 := strconv.ParseInt(v2, 10, 64)
+	if err1 == nil && err2 == nil {
+		return compareFloats(float64(i1), float64(i2))
+	}
+
+	f1, ok1 := rangeLowerBound(v1)
+	f2, ok2 := rangeLowerBound(v2)
+	if ok1 && ok2 {
+		return compareFloats(f1, f2)
+	}
+
+	return strings.Compare(v1, v2)
+}
+
+func groupKeyPart(group_key string, i int) string {
+	parts := strings.Split(group_key, GROUP_DELIMITER)
+	if i < len(parts) {
+		return parts[i]
+	}
+
+	return ""
+}
+
+// sort columns can name a metric of an aggregated column, like latency.p99
+// or latency.max. if the suffix isn't a metric, the dot belongs to the column
+// name
+func ParseSortCol(col string) (string, string) {
+	dot := strings.LastIndex(col, ".")
+	if dot <= 0 {
+		return col, ""
+	}
+
+	metric := col[dot+1:]
+	if _, ok := ParsePercentileName(metric); ok || ORDER_METRICS[metric] {
+		return col[:dot], metric
+	}
+
+	return col, ""
+}
+
+// distinct values aren't tracked per aggregated column, only their histogram
+// is, so there is nothing to order or filter by
+func isDistinctMetric(col string) bool {
+	return strings.HasSuffix(col, ".distinct")
+}
+
+// parses an order by clause like "latency.p95 asc, $COUNT desc". keys sort
+// in descending order unless asc is given
+func ParseOrderBy(order_by string) ([]OrderKey, error) {
+	keys := make([]OrderKey, 0)
+	if order_by == "" {
+		return keys, nil
+	}
+
+	separator := ","
+	if FLAGS.FIELD_SEPARATOR != nil {
+		separator = *FLAGS.FIELD_SEPARATOR
+	}
+
+	for _, term := range strings.Split(order_by, separator) {
+		tokens := strings.Fields(term)
+		if len(tokens) == 0 {
+			continue
+		}
+
+		if isDistinctMetric(tokens[0]) {
+			return nil, fmt.Errorf("can't order by distinct values: %s", tokens[0])
+		}
+
+		col, metric := ParseSortCol(tokens[0])
+		key := OrderKey{Col: col, Metric: metric, Desc: true}
+		if len(tokens) > 1 {
+			switch strings.ToLower(tokens[1]) {
+			case "asc":
+				key.Desc = false
+			case "desc":
+				key.Desc = true
+			default:
+				return nil, fmt.Errorf("unknown sort direction %s for %s", tokens[1], tokens[0])
+			}
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// results that are missing the histogram sort as the lowest value
+func (r *Result) metricValue(col string, metric string) float64 {
+	h, ok := r.Hists[col]
+	if !ok {
+		return math.Inf(-1)
+	}
+
+	if p, ok := ParsePercentileName(metric); ok {
+		return float64(h.GetPercentile(p))
+	}
+
+	switch metric {
+	case "sum":
+		return h.Mean() * float64(h.TotalCount())
+	case "count":
+		return float64(h.TotalCount())
+	case "min":
+		return float64(h.Min())
+	case "max":
+		return float64(h.Max())
+	}
+
+	return h.Mean()
+}
+
+// adds the record to the results under the group key in binarybuffer. for
+// time series, the record's timestamp is moved by ts_offset before bucketing
+func aggregateRecord(querySpec *QuerySpec, results ResultMap, time_results map[int]ResultMap, bucketer *TimeBucketer, r *Record, binarybuffer []byte, weight int64, ts_offset int64) {
 	var ok bool
+	result_map := results
+
+	// IF WE ARE DOING A TIME SERIES AGGREGATION (WHICH CAN BE SLOWER)
+	if querySpec.TimeBucket > 0 {
+		if OPTS.TIME_COL_ID < 0 || len(r.Populated) <= int(OPTS.TIME_COL_ID) {
+			return
+		}
+
+		if r.Populated[OPTS.TIME_COL_ID] != INT_VAL {
+			return
+		}
+		val := int64(r.Ints[OPTS.TIME_COL_ID]) + ts_offset
+
+		big_record, b_ok := results[string(binarybuffer)]
+		if !b_ok {
+			if len(results) < INTERNAL_RESULT_LIMIT {
+				big_record = NewResult()
+				big_record.BinaryByKey = string(binarybuffer)
+				results[string(binarybuffer)] = big_record
+				b_ok = true
+			} else {
+				querySpec.Truncated = true
+			}
+		}
+
+		if b_ok {
+			big_record.Samples++
+			big_record.Count += weight
+		}
+
+		val = bucketer.Bucket(val)
+		result_map, ok = time_results[int(val)]
+
+		if !ok {
+			// TODO: this make call is kind of slow...
+			result_map = make(ResultMap)
+			time_results[int(val)] = result_map
+		}
+
+	}
+
+	added_record, ok := result_map[string(binarybuffer)]
+
+	// BUILD GROUPING RECORD
+	if !ok {
+		// TODO: take into account whether we are doint time series or not...
+		if len(result_map) >= INTERNAL_RESULT_LIMIT {
+			querySpec.Truncated = true
+			return
+		}
+
+		added_record = NewResult()
+		added_record.BinaryByKey = string(binarybuffer)
+
+		result_map[string(binarybuffer)] = added_record
+	}
+
+	added_record.addRecord(querySpec, r, weight)
+}
+
+func (rs *Result) addRecord(querySpec *QuerySpec, r *Record, weight int64) {
+	rs.Samples++
+	rs.Count += weight
+
+	// GO THROUGH AGGREGATIONS AND REALIZE THEM
+	for _, a := range querySpec.Aggregations {
+		switch r.Populated[a.name_id] {
+		case INT_VAL:
+			val := int64(r.Ints[a.name_id])
+
+			hist, ok := rs.Hists[a.Name]
+
+			if !ok {
+				hist = r.block.table.NewAggHist(a, r.block.table.get_int_info(a.name_id))
+				rs.Hists[a.Name] = hist
+			}
+
+			hist.RecordValues(val, weight)
+		}
+
+	}
+}
+
+// routes the record into the current and/or previous window of a comparison
+// query, or just into the results
+func routeRecord(querySpec *QuerySpec, bucketer *TimeBucketer, r *Record, binarybuffer []byte, weight int64) {
+	if querySpec.CompareOffset == 0 {
+		aggregateRecord(querySpec, querySpec.Results, querySpec.TimeResults, bucketer, r, binarybuffer, weight, 0)
+		return
+	}
+
+	// COMPARISON QUERIES ROUTE EACH RECORD INTO THE CURRENT AND/OR THE
+	// PREVIOUS WINDOW. THE PREVIOUS WINDOW IS SHIFTED FORWARD TO LINE UP
+	// ITS TIME BUCKETS WITH THE CURRENT ONE
+	if OPTS.TIME_COL_ID < 0 || len(r.Populated) <= int(OPTS.TIME_COL_ID) || r.Populated[OPTS.TIME_COL_ID] != INT_VAL {
+		return
+	}
+
+	ts := int64(r.Ints[OPTS.TIME_COL_ID])
+	if ts >= querySpec.CompareStart && ts < querySpec.CompareEnd {
+		aggregateRecord(querySpec, querySpec.Results, querySpec.TimeResults, bucketer, r, binarybuffer, weight, 0)
+	}
+
+	offset := int64(querySpec.CompareOffset)
+	if ts >= querySpec.CompareStart-offset && ts < querySpec.CompareEnd-offset {
+		aggregateRecord(querySpec, querySpec.CompareResults, querySpec.CompareTimeResults, bucketer, r, binarybuffer, weight, offset)
+	}
+}
+
+// a record that is in the current results counts towards the total once, no
+// matter how many groups it is in
+func inTotal(querySpec *QuerySpec, r *Record) bool {
+	if querySpec.TimeBucket <= 0 && querySpec.CompareOffset == 0 {
+		return true
+	}
+
+	if OPTS.TIME_COL_ID < 0 || len(r.Populated) <= int(OPTS.TIME_COL_ID) || r.Populated[OPTS.TIME_COL_ID] != INT_VAL {
+		return false
+	}
+
+	ts := int64(r.Ints[OPTS.TIME_COL_ID])
+	return querySpec.CompareOffset == 0 || (ts >= querySpec.CompareStart && ts < querySpec.CompareEnd)
+}
+
+// groups on set columns put the record in one group for each member of the
+// set, or each combination of members for several sets
+func explodeSetGroups(querySpec *QuerySpec, bucketer *TimeBucketer, r *Record, binarybuffer []byte, weight int64, i int) {
+	for ; i < len(querySpec.Groups); i++ {
+		g := querySpec.Groups[i]
+		if !g.absent && r.Populated[g.name_id] == SET_VAL && len(r.SetMap[g.name_id]) > 0 {
+			break
+		}
+	}
+
+	if i == len(querySpec.Groups) {
+		routeRecord(querySpec, bucketer, r, binarybuffer, weight)
+		return
+	}
+
+	for _, member := range r.SetMap[querySpec.Groups[i].name_id] {
+		binary.LittleEndian.PutUint64(binarybuffer[i*GROUP_BY_WIDTH:], uint64(member))
+		explodeSetGroups(querySpec, bucketer, r, binarybuffer, weight, i+1)
+	}
+}
+
+func FilterAndAggRecords(querySpec *QuerySpec, recordsPtr *RecordList) int {
 	var binarybuffer []byte = make([]byte, GROUP_BY_WIDTH*len(querySpec.Groups))
 
 	bs := make([]byte, GROUP_BY_WIDTH)
@@ -66,18 +384,40 @@ func FilterAndAggRecords(querySpec *QuerySpec, recordsPtr *RecordList) int {
 		querySpec.Matched = make(RecordList, 0)
 	}
 
-	var result_map ResultMap
 	length := len(querySpec.Table.KeyTable)
 	columns := make([]*TableColumn, length)
 
-	if querySpec.TimeBucket <= 0 {
-		result_map = querySpec.Results
+	var bucketer *TimeBucketer
+	if querySpec.TimeBucket > 0 {
+		bucketer = querySpec.TimeBucketer()
+	}
+
+	// the time zone of hour(), dow(), date() and month() groups
+	loc, _ := LoadTimeZone(querySpec.TimeZone)
+
+	// WHEN GROUPING BY A SET, THE SUM OF THE GROUPS ISN'T THE TOTAL, SO WE
+	// KEEP TRACK OF IT SEPARATELY
+	has_sets := false
+	for _, g := range querySpec.Groups {
+		if !g.absent && querySpec.Table.KeyTypes[g.name_id] == SET_VAL {
+			has_sets = true
+		}
+	}
+
+	if has_sets {
+		querySpec.Cumulative = NewResult()
 	}
 
+	querySpec.growVirtualFields(records)
+
 	for i := 0; i < len(records); i++ {
 		add := true
 		r := records[i]
 
+		for v := range querySpec.Virtuals {
+			querySpec.Virtuals[v].materialize(r)
+		}
+
 		if OPTS.WEIGHT_COL && r.Populated[OPTS.WEIGHT_COL_ID] == INT_VAL {
 			weight = int64(r.Ints[OPTS.WEIGHT_COL_ID])
 		}
@@ -108,6 +448,12 @@ func FilterAndAggRecords(querySpec *QuerySpec, recordsPtr *RecordList) int {
 		for i, g := range querySpec.Groups {
 			copy(bs, zero)
 
+			if g.absent {
+				binary.LittleEndian.PutUint64(bs, math.MaxUint64)
+				copy(binarybuffer[i*GROUP_BY_WIDTH:], bs)
+				continue
+			}
+
 			if columns[g.name_id] == nil && r.Populated[g.name_id] != _NO_VAL {
 				columns[g.name_id] = r.block.GetColumnInfo(g.name_id)
 				columns[g.name_id].Type = r.Populated[g.name_id]
@@ -115,89 +461,32 @@ func FilterAndAggRecords(querySpec *QuerySpec, recordsPtr *RecordList) int {
 
 			switch r.Populated[g.name_id] {
 			case INT_VAL:
-				binary.LittleEndian.PutUint64(bs, uint64(r.Ints[g.name_id]))
+				val := int64(r.Ints[g.name_id])
+				if g.Func != "" {
+					val = g.apply(val, loc)
+				}
+				binary.LittleEndian.PutUint64(bs, uint64(val))
 			case STR_VAL:
 				binary.LittleEndian.PutUint64(bs, uint64(r.Strs[g.name_id]))
-			case _NO_VAL:
+			case _NO_VAL, SET_VAL:
+				// set members are filled in by explodeSetGroups, empty sets
+				// are missing values
 				binary.LittleEndian.PutUint64(bs, math.MaxUint64)
 			}
 
 			copy(binarybuffer[i*GROUP_BY_WIDTH:], bs)
 		}
 
-		// IF WE ARE DOING A TIME SERIES AGGREGATION (WHICH CAN BE SLOWER)
-		if querySpec.TimeBucket > 0 {
-			if len(r.Populated) <= int(OPTS.TIME_COL_ID) {
-				continue
-			}
-
-			if r.Populated[OPTS.TIME_COL_ID] != INT_VAL {
-				continue
-			}
-			val := int64(r.Ints[OPTS.TIME_COL_ID])
-
-			big_record, b_ok := querySpec.Results[string(binarybuffer)]
-			if !b_ok {
-				if len(querySpec.Results) < INTERNAL_RESULT_LIMIT {
-					big_record = NewResult()
-					big_record.BinaryByKey = string(binarybuffer)
-					querySpec.Results[string(binarybuffer)] = big_record
-					b_ok = true
-				}
-			}
-
-			if b_ok {
-				big_record.Samples++
-				big_record.Count += weight
-			}
-
-			val = int64(int(val) / querySpec.TimeBucket * querySpec.TimeBucket)
-			result_map, ok = querySpec.TimeResults[int(val)]
-
-			if !ok {
-				// TODO: this make call is kind of slow...
-				result_map = make(ResultMap)
-				querySpec.TimeResults[int(val)] = result_map
-			}
-
+		if !has_sets {
+			routeRecord(querySpec, bucketer, r, binarybuffer, weight)
+			continue
 		}
 
-		added_record, ok := result_map[string(binarybuffer)]
-
-		// BUILD GROUPING RECORD
-		if !ok {
-			// TODO: take into account whether we are doint time series or not...
-			if len(result_map) >= INTERNAL_RESULT_LIMIT {
-				continue
-			}
-
-			added_record = NewResult()
-			added_record.BinaryByKey = string(binarybuffer)
-
-			result_map[string(binarybuffer)] = added_record
-		}
-
-		added_record.Samples++
-		added_record.Count += weight
-
-		// GO THROUGH AGGREGATIONS AND REALIZE THEM
-		for _, a := range querySpec.Aggregations {
-			switch r.Populated[a.name_id] {
-			case INT_VAL:
-				val := int64(r.Ints[a.name_id])
-
-				hist, ok := added_record.Hists[a.Name]
-
-				if !ok {
-					hist = r.block.table.NewHist(r.block.table.get_int_info(a.name_id))
-					added_record.Hists[a.Name] = hist
-				}
-
-				hist.RecordValues(val, weight)
-			}
-
+		if inTotal(querySpec, r) {
+			querySpec.Cumulative.addRecord(querySpec, r, weight)
 		}
 
+		explodeSetGroups(querySpec, bucketer, r, binarybuffer, weight, 0)
 	}
 
 	// Now to unpack the byte buffers we oh so stupidly used in the group by...
@@ -213,6 +502,14 @@ func FilterAndAggRecords(querySpec *QuerySpec, recordsPtr *RecordList) int {
 		querySpec.Results = *translate_group_by(querySpec.Results, querySpec.Groups, columns)
 	}
 
+	if querySpec.CompareOffset > 0 {
+		for k, result_map := range querySpec.CompareTimeResults {
+			querySpec.CompareTimeResults[k] = *translate_group_by(result_map, querySpec.Groups, columns)
+		}
+
+		querySpec.CompareResults = *translate_group_by(querySpec.CompareResults, querySpec.Groups, columns)
+	}
+
 	if *FLAGS.LUA {
 		querySpec.luaInit()
 		querySpec.luaMap(&querySpec.Matched)
@@ -237,7 +534,10 @@ func translate_group_by(Results ResultMap, Groups []Grouping, columns []*TableCo
 		for i, g := range Groups {
 			bs = []byte(r.BinaryByKey[i*GROUP_BY_WIDTH : (i+1)*GROUP_BY_WIDTH])
 
-			col := columns[g.name_id]
+			var col *TableColumn
+			if !g.absent {
+				col = columns[g.name_id]
+			}
 
 			if col == nil {
 				buffer.WriteString(GROUP_DELIMITER)
@@ -247,8 +547,15 @@ func translate_group_by(Results ResultMap, Groups []Grouping, columns []*TableCo
 			val := binary.LittleEndian.Uint64(bs)
 			switch col.Type {
 			case INT_VAL:
+				if g.Func != "" && val != math.MaxUint64 {
+					buffer.WriteString(g.format(int64(val)))
+					break
+				}
 				buffer.WriteString(strconv.FormatInt(int64(val), 10))
-			case STR_VAL:
+			case STR_VAL, SET_VAL:
+				if val == math.MaxUint64 {
+					break
+				}
 				buffer.WriteString(col.get_string_for_val(int32(val)))
 
 			}
@@ -269,9 +576,15 @@ func CopyQuerySpec(querySpec *QuerySpec) *QuerySpec {
 	blockQuery.Table = querySpec.Table
 	blockQuery.Punctuate()
 	blockQuery.TimeBucket = querySpec.TimeBucket
+	blockQuery.TimeBucketUnit = querySpec.TimeBucketUnit
+	blockQuery.TimeZone = querySpec.TimeZone
+	blockQuery.CompareOffset = querySpec.CompareOffset
+	blockQuery.CompareStart = querySpec.CompareStart
+	blockQuery.CompareEnd = querySpec.CompareEnd
 	blockQuery.Filters = querySpec.Filters
 	blockQuery.Aggregations = querySpec.Aggregations
 	blockQuery.Groups = querySpec.Groups
+	blockQuery.Virtuals = querySpec.Virtuals
 
 	return &blockQuery
 }
@@ -289,6 +602,25 @@ func CombineMatches(block_specs map[string]*QuerySpec) RecordList {
 
 }
 
+func combineTimeResults(master_time_result map[int]ResultMap, time_results map[int]ResultMap) {
+	for i, v := range time_results {
+		mval, ok := master_time_result[i]
+
+		if !ok {
+			master_time_result[i] = v
+		} else {
+			for k, r := range v {
+				mh, ok := mval[k]
+				if ok {
+					mh.Combine(r)
+				} else {
+					mval[k] = r
+				}
+			}
+		}
+	}
+}
+
 func CombineResults(querySpec *QuerySpec, block_specs map[string]*QuerySpec) *QuerySpec {
 
 	astart := time.Now()
@@ -302,6 +634,8 @@ func CombineResults(querySpec *QuerySpec, block_specs map[string]*QuerySpec) *Qu
 
 	master_result := make(ResultMap)
 	master_time_result := make(map[int]ResultMap)
+	master_compare_result := make(ResultMap)
+	master_compare_time_result := make(map[int]ResultMap)
 
 	cumulative_result := NewResult()
 	cumulative_result.GroupByKey = "TOTAL"
@@ -318,32 +652,32 @@ func CombineResults(querySpec *QuerySpec, block_specs map[string]*QuerySpec) *Qu
 			resultSpec.luaCombine(spec)
 		}
 
-		for _, result := range spec.Results {
-			cumulative_result.Combine(result)
+		if spec.Cumulative != nil {
+			cumulative_result.Combine(spec.Cumulative)
+		} else {
+			for _, result := range spec.Results {
+				cumulative_result.Combine(result)
+			}
 		}
 
-		for i, v := range spec.TimeResults {
-			mval, ok := master_time_result[i]
+		combineTimeResults(master_time_result, spec.TimeResults)
+		resultSpec.Truncated = resultSpec.Truncated || spec.Truncated
 
-			if !ok {
-				master_time_result[i] = v
-			} else {
-				for k, r := range v {
-					mh, ok := mval[k]
-					if ok {
-						mh.Combine(r)
-					} else {
-						mval[k] = r
-					}
-				}
-			}
+		if querySpec.CompareOffset > 0 {
+			master_compare_result.Combine(&spec.CompareResults)
+			combineTimeResults(master_compare_time_result, spec.CompareTimeResults)
 		}
 	}
 
 	resultSpec.Cumulative = cumulative_result
 	resultSpec.TimeBucket = querySpec.TimeBucket
+	resultSpec.TimeBucketUnit = querySpec.TimeBucketUnit
+	resultSpec.TimeZone = querySpec.TimeZone
 	resultSpec.TimeResults = master_time_result
 	resultSpec.Results = master_result
+	resultSpec.CompareOffset = querySpec.CompareOffset
+	resultSpec.CompareResults = master_compare_result
+	resultSpec.CompareTimeResults = master_compare_time_result
 
 	if *FLAGS.LUA {
 		resultSpec.luaFinalize()
@@ -355,6 +689,33 @@ func CombineResults(querySpec *QuerySpec, block_specs map[string]*QuerySpec) *Qu
 	return &resultSpec
 }
 
+// time series queries only count records in their overall results, so we
+// combine the per bucket histograms into them before sorting or filtering on
+// a metric
+func (querySpec *QuerySpec) rollupTimeHists() {
+	if querySpec.TimeBucket <= 0 || len(querySpec.Aggregations) == 0 {
+		return
+	}
+
+	for _, results := range querySpec.TimeResults {
+		for k, r := range results {
+			total, ok := querySpec.Results[k]
+			if !ok {
+				continue
+			}
+
+			for name, h := range r.Hists {
+				th, ok := total.Hists[name]
+				if !ok {
+					th = h.NewHist()
+					total.Hists[name] = th
+				}
+				th.Combine(h)
+			}
+		}
+	}
+}
+
 func SortResults(querySpec *QuerySpec) {
 	// SORT THE RESULTS
 	if querySpec.OrderBy != "" {
@@ -366,7 +727,8 @@ func SortResults(querySpec *QuerySpec) {
 		}
 		querySpec.Sorted = sorter.Results
 
-		sorter.Col = querySpec.OrderBy
+		sorter.Keys, _ = ParseOrderBy(querySpec.OrderBy)
+		sorter.Groups = querySpec.Groups
 		sort.Sort(sorter)
 
 		end := time.Now()
@@ -383,6 +745,39 @@ func SortResults(querySpec *QuerySpec) {
 
 }
 
+// FinalizeResults runs the post aggregation steps on combined results: the
+// having conditions, the top N rollup, the series functions (so that the
+// __other__ group gets them too) and then the sort + limit
+func FinalizeResults(querySpec *QuerySpec) {
+	if querySpec.Truncated {
+		Warn("Some groups were dropped after reaching the limit of", INTERNAL_RESULT_LIMIT, "results")
+	}
+
+	querySpec.rollupTimeHists()
+	querySpec.alignCompareResults()
+	querySpec.ApplyHaving()
+	querySpec.ApplyTopN()
+	querySpec.ApplySeriesFns()
+	SortResults(querySpec)
+}
+
+// returns the results of a single time bucket in the query's sort order
+func (querySpec *QuerySpec) SortResultMap(results ResultMap) []*Result {
+	sorter := SortResultsByCol{}
+	sorter.Results = make([]*Result, 0, len(results))
+	for _, v := range results {
+		sorter.Results = append(sorter.Results, v)
+	}
+
+	if querySpec.OrderBy != "" {
+		sorter.Keys, _ = ParseOrderBy(querySpec.OrderBy)
+		sorter.Groups = querySpec.Groups
+		sort.Sort(sorter)
+	}
+
+	return sorter.Results
+}
+
 // OLD SEARCHING FUNCTIONS BELOW HERE
 func SearchBlocks(querySpec *QuerySpec, block_list map[string]*TableBlock) map[string]*QuerySpec {
 	var wg sync.WaitGroup
@@ -431,6 +826,9 @@ func (t *Table) MatchAndAggregate(querySpec *QuerySpec) {
 
 	querySpec.Results = resultSpec.Results
 	querySpec.TimeResults = resultSpec.TimeResults
+	querySpec.CompareResults = resultSpec.CompareResults
+	querySpec.CompareTimeResults = resultSpec.CompareTimeResults
+	querySpec.Truncated = resultSpec.Truncated
 
 	// Aggregating Matched Records
 	matched := CombineMatches(block_specs)
@@ -440,7 +838,7 @@ func (t *Table) MatchAndAggregate(querySpec *QuerySpec) {
 
 	end := time.Now()
 
-	SortResults(querySpec)
+	FinalizeResults(querySpec)
 
 	Debug(string(len(matched)), "RECORDS FILTERED AND AGGREGATED INTO", len(querySpec.Results), "RESULTS, TOOK", end.Sub(start))
 
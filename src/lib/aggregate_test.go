@@ -207,6 +207,120 @@ func TestHistograms(test *testing.T) {
 
 }
 
+// Tests that the t-digest histogram gives reasonable percentiles and keeps
+// outliers that the basic histogram would discard
+func TestTDigestHistograms(test *testing.T) {
+	delete_test_db()
+
+	if testing.Short() {
+		test.Skip("Skipping test in short mode")
+		return
+	}
+
+	block_count := 3
+	outlier := int64(1000 * 1000)
+	ages := make([]int, 0)
+
+	add_records(func(r *sybil.Record, index int) {
+		r.AddIntField("id", int64(index))
+		age := int64(rand.Intn(20)) + 10
+		if index == 0 {
+			age = outlier
+		}
+		ages = append(ages, int(age))
+		r.AddIntField("age", age)
+	}, block_count)
+
+	nt := save_and_reload_table(test, block_count)
+
+	hist := "hist"
+	sybil.FLAGS.OP = &hist
+	sybil.FLAGS.TDIGEST_HIST = &sybil.TRUE
+
+	querySpec := new_query_spec()
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("age", "hist"))
+
+	nt.MatchAndAggregate(querySpec)
+	sybil.FLAGS.TDIGEST_HIST = &sybil.FALSE
+
+	sort.Ints(ages)
+
+	if len(querySpec.Results) == 0 {
+		test.Error("NO RESULTS RETURNED FOR QUERY!")
+	}
+
+	for _, v := range querySpec.Results {
+		h := v.Hists["age"]
+		if _, ok := h.(*sybil.TDigestHist); !ok {
+			test.Error("EXPECTED A TDIGEST HISTOGRAM, GOT", h)
+		}
+
+		if h.Max() != outlier {
+			test.Error("TDIGEST DROPPED OUTLIER", h.Max(), "EXPECTED", outlier)
+		}
+
+		if h.TotalCount() != int64(len(ages)) {
+			test.Error("TDIGEST COUNT", h.TotalCount(), "EXPECTED", len(ages))
+		}
+
+		percentiles := h.GetPercentiles()
+		for _, p := range []int{5, 25, 50, 75, 95} {
+			index := int(float64(p) / 100 * float64(len(ages)))
+			val := ages[index]
+
+			if math.Abs(float64(percentiles[p]-int64(val))) > 1 {
+				test.Error("P", p, "VAL", percentiles[p], "EXPECTED", val)
+			}
+		}
+	}
+
+	delete_test_db()
+}
+
+// Tests that a column without any IntInfo gets a t-digest in every block, so
+// the block results can be combined
+func TestHistTypeWithoutIntInfo(test *testing.T) {
+	delete_test_db()
+
+	block_count := 3
+	add_records(func(r *sybil.Record, index int) {
+		r.AddIntField("id", int64(index))
+		r.AddIntField("age", int64(rand.Intn(20))+10)
+	}, block_count)
+
+	nt := save_and_reload_table(test, block_count)
+	delete(nt.IntInfo, nt.KeyTable["age"])
+
+	hist := "hist"
+	sybil.FLAGS.OP = &hist
+
+	agg := nt.Aggregation("age", "hist")
+	if agg.HistType != "tdigest" {
+		test.Error("EXPECTED A TDIGEST FOR A COLUMN WITHOUT INFO, GOT", agg.HistType)
+	}
+
+	querySpec := new_query_spec()
+	querySpec.Aggregations = append(querySpec.Aggregations, agg)
+	nt.MatchAndAggregate(querySpec)
+
+	if len(querySpec.Results) == 0 {
+		test.Error("NO RESULTS RETURNED FOR QUERY!")
+	}
+
+	for _, v := range querySpec.Results {
+		h := v.Hists["age"]
+		if _, ok := h.(*sybil.TDigestHist); !ok {
+			test.Error("EXPECTED A TDIGEST HISTOGRAM, GOT", h)
+		}
+
+		if h.TotalCount() != int64(block_count*sybil.CHUNK_SIZE) {
+			test.Error("TDIGEST COUNT", h.TotalCount(), "EXPECTED", block_count*sybil.CHUNK_SIZE)
+		}
+	}
+
+	delete_test_db()
+}
+
 // Tests that the histogram works
 func TestTimeSeries(test *testing.T) {
 	delete_test_db()
@@ -339,3 +453,622 @@ func TestOrderBy(test *testing.T) {
 	delete_test_db()
 
 }
+
+func TestOrderByPercentile(test *testing.T) {
+	delete_test_db()
+
+	if testing.Short() {
+		test.Skip("Skipping test in short mode")
+		return
+	}
+
+	block_count := 3
+
+	add_records(func(r *sybil.Record, index int) {
+		r.AddIntField("id", int64(index))
+		age := int64(rand.Intn(20)) + 10
+		r.AddIntField("age", age)
+		r.AddStrField("age_str", strconv.FormatInt(int64(age), 10))
+	}, block_count)
+
+	nt := save_and_reload_table(test, block_count)
+
+	hist := "hist"
+	sybil.FLAGS.OP = &hist
+
+	querySpec := new_query_spec()
+	querySpec.Groups = append(querySpec.Groups, nt.Grouping("age_str"))
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("age", "hist"))
+	querySpec.OrderBy = "age.p50"
+
+	nt.MatchAndAggregate(querySpec)
+
+	if len(querySpec.Sorted) <= 0 {
+		test.Error("NO RESULTS RETURNED FOR QUERY!")
+	}
+
+	prev_p50 := int64(math.MaxInt64)
+	for _, v := range querySpec.Sorted {
+		p50 := v.Hists["age"].GetPercentile(50)
+		if p50 > prev_p50 {
+			test.Error("RESULTS CAME BACK OUT OF P50 ORDER", p50, prev_p50)
+		}
+
+		key := strings.Replace(v.GroupByKey, sybil.GROUP_DELIMITER, "", 1)
+		kval, _ := strconv.ParseInt(key, 10, 64)
+		if p50 != kval {
+			test.Error("UNEXPECTED P50 FOR GROUP", key, p50)
+		}
+
+		prev_p50 = p50
+	}
+
+	delete_test_db()
+}
+
+func TestOrderByMultipleKeys(test *testing.T) {
+	delete_test_db()
+
+	if testing.Short() {
+		test.Skip("Skipping test in short mode")
+		return
+	}
+
+	block_count := 3
+
+	add_records(func(r *sybil.Record, index int) {
+		r.AddIntField("id", int64(index))
+		age := int64(rand.Intn(20)) + 10
+		r.AddIntField("age", age)
+		r.AddStrField("age_str", strconv.FormatInt(int64(age), 10))
+		r.AddStrField("parity", strconv.FormatInt(age%2, 10))
+	}, block_count)
+
+	nt := save_and_reload_table(test, block_count)
+
+	querySpec := new_query_spec()
+	querySpec.Groups = append(querySpec.Groups, nt.Grouping("parity"))
+	querySpec.Groups = append(querySpec.Groups, nt.Grouping("age_str"))
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("age", "avg"))
+	querySpec.OrderBy = "parity asc, age.max desc"
+
+	nt.MatchAndAggregate(querySpec)
+
+	if len(querySpec.Sorted) <= 0 {
+		test.Error("NO RESULTS RETURNED FOR QUERY!")
+	}
+
+	prev_parity := int64(-1)
+	prev_max := int64(math.MaxInt64)
+	for _, v := range querySpec.Sorted {
+		parts := strings.Split(v.GroupByKey, sybil.GROUP_DELIMITER)
+		parity, _ := strconv.ParseInt(parts[0], 10, 64)
+		max := v.Hists["age"].Max()
+
+		if parity < prev_parity {
+			test.Error("RESULTS CAME BACK OUT OF PARITY ORDER", parity, prev_parity)
+		}
+
+		if parity != prev_parity {
+			prev_max = int64(math.MaxInt64)
+		}
+
+		if max > prev_max {
+			test.Error("RESULTS CAME BACK OUT OF MAX ORDER", max, prev_max)
+		}
+
+		prev_parity = parity
+		prev_max = max
+	}
+
+	querySpec = new_query_spec()
+	querySpec.Groups = append(querySpec.Groups, nt.Grouping("age_str"))
+	querySpec.OrderBy = "$GROUP asc"
+
+	nt.MatchAndAggregate(querySpec)
+
+	prev_age := int64(0)
+	for _, v := range querySpec.Sorted {
+		age, _ := strconv.ParseInt(strings.Split(v.GroupByKey, sybil.GROUP_DELIMITER)[0], 10, 64)
+		if age < prev_age {
+			test.Error("RESULTS CAME BACK OUT OF GROUP ORDER", age, prev_age)
+		}
+		prev_age = age
+	}
+
+	if _, err := sybil.ParseOrderBy("age.distinct desc, age.max asc"); err == nil {
+		test.Error("EXPECTED ORDER BY DISTINCT VALUES TO BE REJECTED")
+	}
+
+	if _, err := sybil.ParseOrderBy("age.max up"); err == nil {
+		test.Error("EXPECTED AN UNKNOWN SORT DIRECTION TO BE REJECTED")
+	}
+
+	delete_test_db()
+}
+
+func TestOrderByMetricWithTime(test *testing.T) {
+	delete_test_db()
+
+	block_count := 3
+
+	add_records(func(r *sybil.Record, index int) {
+		age := int64(index%20) + 10
+		r.AddIntField("time", int64(index*60))
+		r.AddIntField("age", age)
+		r.AddStrField("age_str", strconv.FormatInt(age, 10))
+	}, block_count)
+
+	nt := save_and_reload_table(test, block_count)
+
+	time_col_id := sybil.OPTS.TIME_COL_ID
+	sybil.OPTS.TIME_COL_ID = nt.KeyTable["time"]
+	defer func() { sybil.OPTS.TIME_COL_ID = time_col_id }()
+
+	querySpec := new_query_spec()
+	querySpec.Groups = append(querySpec.Groups, nt.Grouping("age_str"))
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("age", "avg"))
+	querySpec.TimeBucket = 3600
+	querySpec.OrderBy = "age.avg desc"
+
+	nt.MatchAndAggregate(querySpec)
+
+	if len(querySpec.Sorted) != 20 {
+		test.Error("EXPECTED 20 SORTED RESULTS, GOT", len(querySpec.Sorted))
+	}
+
+	prev_avg := math.MaxFloat64
+	for _, v := range querySpec.Sorted {
+		h, ok := v.Hists["age"]
+		if !ok {
+			test.Fatal("TIME SERIES RESULT HAS NO HIST TO SORT ON", v.GroupByKey)
+		}
+
+		if h.Mean() > prev_avg {
+			test.Error("RESULTS CAME BACK OUT OF AVG ORDER", h.Mean(), prev_avg)
+		}
+		prev_avg = h.Mean()
+	}
+
+	delete_test_db()
+}
+
+func TestHavingFilters(test *testing.T) {
+	delete_test_db()
+
+	if testing.Short() {
+		test.Skip("Skipping test in short mode")
+		return
+	}
+
+	block_count := 3
+
+	add_records(func(r *sybil.Record, index int) {
+		r.AddIntField("id", int64(index))
+		age := int64(rand.Intn(20)) + 10
+		r.AddIntField("age", age)
+		r.AddStrField("age_str", strconv.FormatInt(int64(age), 10))
+	}, block_count)
+
+	nt := save_and_reload_table(test, block_count)
+
+	querySpec := new_query_spec()
+	querySpec.Groups = append(querySpec.Groups, nt.Grouping("age_str"))
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("age", "avg"))
+
+	having, err := sybil.ParseHaving("count > 0 AND age.avg >= 20", querySpec.Aggregations)
+	if err != nil {
+		test.Fatal("COULDNT PARSE HAVING", err)
+	}
+	querySpec.Having = having
+
+	nt.MatchAndAggregate(querySpec)
+
+	if len(querySpec.Results) != 10 {
+		test.Error("EXPECTED 10 RESULTS AFTER HAVING, GOT", len(querySpec.Results))
+	}
+
+	for _, v := range querySpec.Results {
+		if v.Hists["age"].Mean() < 20 {
+			test.Error("HAVING LET THROUGH", v.GroupByKey, v.Hists["age"].Mean())
+		}
+	}
+
+	if _, err := sybil.ParseHaving("age.avg >> 20", querySpec.Aggregations); err == nil {
+		test.Error("EXPECTED AN ERROR FOR INVALID HAVING")
+	}
+
+	if _, err := sybil.ParseHaving("age.distinct > 5", querySpec.Aggregations); err == nil {
+		test.Error("EXPECTED AN ERROR FOR HAVING ON DISTINCT VALUES")
+	}
+
+	if _, err := sybil.ParseHaving("agee.avg < 500", querySpec.Aggregations); err == nil {
+		test.Error("EXPECTED AN ERROR FOR HAVING ON A COLUMN THAT ISNT AGGREGATED")
+	}
+
+	// A GROUP WITHOUT THE COLUMN DOESNT PASS A CONDITION ON IT
+	cond := sybil.HavingCond{Col: "age", Metric: "avg", Op: "<", Value: 500}
+	if cond.Matches(sybil.NewResult()) {
+		test.Error("HAVING LET THROUGH A RESULT WITHOUT THE COLUMN")
+	}
+
+	delete_test_db()
+}
+
+func TestHavingWithTime(test *testing.T) {
+	delete_test_db()
+
+	block_count := 3
+
+	add_records(func(r *sybil.Record, index int) {
+		age := int64(index%20) + 10
+		r.AddIntField("time", int64(index*60))
+		r.AddIntField("age", age)
+		r.AddStrField("age_str", strconv.FormatInt(age, 10))
+	}, block_count)
+
+	nt := save_and_reload_table(test, block_count)
+
+	time_col_id := sybil.OPTS.TIME_COL_ID
+	sybil.OPTS.TIME_COL_ID = nt.KeyTable["time"]
+	defer func() { sybil.OPTS.TIME_COL_ID = time_col_id }()
+
+	querySpec := new_query_spec()
+	querySpec.Groups = append(querySpec.Groups, nt.Grouping("age_str"))
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("age", "avg"))
+	querySpec.TimeBucket = 3600
+
+	having, err := sybil.ParseHaving("age.avg >= 20", querySpec.Aggregations)
+	if err != nil {
+		test.Fatal("COULDNT PARSE HAVING", err)
+	}
+	querySpec.Having = having
+
+	nt.MatchAndAggregate(querySpec)
+
+	if len(querySpec.Results) != 10 {
+		test.Error("EXPECTED 10 RESULTS AFTER HAVING ON A TIME QUERY, GOT", len(querySpec.Results))
+	}
+
+	delete_test_db()
+}
+
+func TestCompareQuery(test *testing.T) {
+	delete_test_db()
+
+	if testing.Short() {
+		test.Skip("Skipping test in short mode")
+		return
+	}
+
+	block_count := 3
+
+	add_records(func(r *sybil.Record, index int) {
+		ts := int64(1000 + (index*7)%2000)
+		r.AddIntField("id", int64(index))
+		r.AddIntField("time", ts)
+		if ts < 2000 {
+			r.AddIntField("age", 10)
+		} else {
+			r.AddIntField("age", 20)
+		}
+		r.AddStrField("parity", strconv.FormatInt(int64(index%2), 10))
+	}, block_count)
+
+	nt := save_and_reload_table(test, block_count)
+
+	time_col_id := sybil.OPTS.TIME_COL_ID
+	sybil.OPTS.TIME_COL_ID = nt.KeyTable["time"]
+
+	querySpec := new_query_spec()
+	querySpec.Groups = append(querySpec.Groups, nt.Grouping("parity"))
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("age", "avg"))
+	querySpec.CompareOffset = 1000
+	querySpec.CompareStart = 2000
+	querySpec.CompareEnd = 3000
+
+	nt.MatchAndAggregate(querySpec)
+	sybil.OPTS.TIME_COL_ID = time_col_id
+
+	if len(querySpec.Results) != 2 || len(querySpec.CompareResults) != 2 {
+		test.Error("EXPECTED 2 GROUPS IN EACH WINDOW", len(querySpec.Results), len(querySpec.CompareResults))
+	}
+
+	for k, r := range querySpec.Results {
+		prev, ok := querySpec.CompareResults[k]
+		if !ok {
+			test.Error("GROUP", k, "IS MISSING FROM THE PREVIOUS WINDOW")
+			continue
+		}
+
+		if math.Abs(r.Hists["age"].Mean()-20) > 0.01 || math.Abs(prev.Hists["age"].Mean()-10) > 0.01 {
+			test.Error("WINDOWS WERE MIXED UP", k, r.Hists["age"].Mean(), prev.Hists["age"].Mean())
+		}
+
+		if r.Count == 0 || prev.Count == 0 {
+			test.Error("EMPTY WINDOW FOR GROUP", k, r.Count, prev.Count)
+		}
+	}
+
+	delete_test_db()
+}
+
+func TestTopNWithOther(test *testing.T) {
+	delete_test_db()
+
+	if testing.Short() {
+		test.Skip("Skipping test in short mode")
+		return
+	}
+
+	block_count := 3
+
+	add_records(func(r *sybil.Record, index int) {
+		r.AddIntField("id", int64(index))
+		r.AddIntField("time", int64(index%4)*3600)
+		age := int64(rand.Intn(20)) + 10
+		r.AddIntField("age", age)
+		r.AddStrField("age_str", strconv.FormatInt(int64(age), 10))
+	}, block_count)
+
+	nt := save_and_reload_table(test, block_count)
+
+	time_col_id := sybil.OPTS.TIME_COL_ID
+	sybil.OPTS.TIME_COL_ID = nt.KeyTable["time"]
+
+	querySpec := new_query_spec()
+	querySpec.Groups = append(querySpec.Groups, nt.Grouping("age_str"))
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("age", "avg"))
+	querySpec.TimeBucket = 3600
+	querySpec.TopN = 3
+	querySpec.TopBy = "age.avg"
+	querySpec.SeriesFns, _ = sybil.ParseSeriesFns("count:cumsum")
+
+	nt.MatchAndAggregate(querySpec)
+	sybil.OPTS.TIME_COL_ID = time_col_id
+
+	other_key := sybil.OTHER_GROUP + sybil.GROUP_DELIMITER
+	if len(querySpec.Results) != 4 {
+		test.Error("EXPECTED 3 TOP GROUPS AND __other__, GOT", len(querySpec.Results))
+	}
+
+	total := int64(0)
+	for k, r := range querySpec.Results {
+		total += r.Count
+		if k == other_key {
+			continue
+		}
+
+		age, _ := strconv.ParseInt(strings.Split(k, sybil.GROUP_DELIMITER)[0], 10, 64)
+		if age < 27 {
+			test.Error("GROUP", k, "SHOULDNT BE IN THE TOP 3 BY AGE")
+		}
+	}
+
+	bucket_total := int64(0)
+	for _, results := range querySpec.TimeResults {
+		if len(results) > 4 {
+			test.Error("TIME BUCKET HAS MORE THAN 4 SERIES", len(results))
+		}
+
+		for _, r := range results {
+			bucket_total += r.Count
+		}
+
+		// THE SERIES FUNCTIONS RUN ON THE FOLDED __other__ GROUP TOO
+		if r, ok := results[other_key]; ok {
+			if _, ok := r.Series["count:cumsum"]; !ok {
+				test.Error("__other__ IS MISSING ITS SERIES VALUES")
+			}
+		}
+	}
+
+	if total != bucket_total {
+		test.Error("COUNTS DONT ADD UP", total, bucket_total)
+	}
+
+	if _, ok := querySpec.Results[other_key]; !ok {
+		test.Error("MISSING __other__ GROUP")
+	}
+
+	delete_test_db()
+}
+
+func TestTimeGroupings(test *testing.T) {
+	delete_test_db()
+
+	if testing.Short() {
+		test.Skip("Skipping test in short mode")
+		return
+	}
+
+	loc, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		test.Skip("Skipping test without time zone data")
+		return
+	}
+
+	block_count := 3
+
+	add_records(func(r *sybil.Record, index int) {
+		r.AddIntField("id", int64(index))
+		r.AddIntField("time", int64(index)*3600)
+	}, block_count)
+
+	nt := save_and_reload_table(test, block_count)
+
+	expected := make(map[string]int64)
+	for i := 0; i < sybil.CHUNK_SIZE*block_count; i++ {
+		t := time.Unix(int64(i)*3600, 0).In(loc)
+		key := fmt.Sprintf("%d%s%d-%s%s", t.Hour(), sybil.GROUP_DELIMITER, t.Weekday(), t.Weekday().String()[:3], sybil.GROUP_DELIMITER)
+		expected[key]++
+	}
+
+	querySpec := new_query_spec()
+	querySpec.Groups = append(querySpec.Groups, nt.Grouping("hour(time)"))
+	querySpec.Groups = append(querySpec.Groups, nt.Grouping("dow(time)"))
+	querySpec.TimeZone = "Asia/Tokyo"
+
+	nt.MatchAndAggregate(querySpec)
+
+	if len(querySpec.Results) != 24*7 {
+		test.Error("EXPECTED A GROUP FOR EVERY HOUR OF THE WEEK, GOT", len(querySpec.Results))
+	}
+
+	for k, count := range expected {
+		r, ok := querySpec.Results[k]
+		if !ok {
+			test.Error("MISSING GROUP", k)
+			continue
+		}
+
+		if r.Count != count {
+			test.Error("GROUP", k, "HAS", r.Count, "RECORDS, EXPECTED", count)
+		}
+	}
+
+	querySpec = new_query_spec()
+	querySpec.Groups = append(querySpec.Groups, nt.Grouping("month(time)"))
+
+	nt.MatchAndAggregate(querySpec)
+
+	if _, ok := querySpec.Results["1970-01"+sybil.GROUP_DELIMITER]; !ok {
+		test.Error("MISSING MONTH GROUP 1970-01", querySpec.Results)
+	}
+
+	delete_test_db()
+}
+
+func TestGroupBySet(test *testing.T) {
+	delete_test_db()
+
+	if testing.Short() {
+		test.Skip("Skipping test in short mode")
+		return
+	}
+
+	block_count := 3
+
+	sybil.DELETE_BLOCKS_AFTER_QUERY = false
+	sybil.FLAGS.CACHED_QUERIES = &sybil.TRUE
+
+	add_records(func(r *sybil.Record, index int) {
+		r.AddIntField("id", int64(index))
+		r.AddIntField("age", int64(index%10))
+		r.AddStrField("kind", strconv.FormatInt(int64(index%2), 10))
+
+		tags := []string{"all", "even"}
+		if index%2 == 1 {
+			tags = []string{"all", "odd"}
+		}
+		if index%10 == 0 {
+			tags = []string{}
+		}
+		r.AddSetField("tags", tags)
+	}, block_count)
+
+	nt := save_and_reload_table(test, block_count)
+
+	total := sybil.CHUNK_SIZE * block_count
+	expected := map[string]int64{
+		"all" + sybil.GROUP_DELIMITER + "0" + sybil.GROUP_DELIMITER:  int64(total/2 - total/10),
+		"all" + sybil.GROUP_DELIMITER + "1" + sybil.GROUP_DELIMITER:  int64(total / 2),
+		"even" + sybil.GROUP_DELIMITER + "0" + sybil.GROUP_DELIMITER: int64(total/2 - total/10),
+		"odd" + sybil.GROUP_DELIMITER + "1" + sybil.GROUP_DELIMITER:  int64(total / 2),
+		sybil.GROUP_DELIMITER + "0" + sybil.GROUP_DELIMITER:          int64(total / 10),
+	}
+
+	loadSpec := nt.NewLoadSpec()
+	loadSpec.LoadAllColumns = true
+
+	// THE SECOND QUERY READS THE CACHED BLOCK RESULTS
+	for i := 0; i < 2; i++ {
+		querySpec := new_query_spec()
+		querySpec.Table = nt
+		querySpec.Groups = append(querySpec.Groups, nt.Grouping("tags"), nt.Grouping("kind"))
+		querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("age", "avg"))
+
+		nt.LoadAndQueryRecords(&loadSpec, querySpec)
+
+		if len(querySpec.Results) != len(expected) {
+			test.Error("EXPECTED", len(expected), "GROUPS, GOT", len(querySpec.Results))
+		}
+
+		for k, count := range expected {
+			r, ok := querySpec.Results[k]
+			if !ok {
+				test.Error("MISSING GROUP", k)
+				continue
+			}
+
+			if r.Count != count {
+				test.Error("GROUP", k, "HAS", r.Count, "RECORDS, EXPECTED", count)
+			}
+		}
+
+		if querySpec.Cumulative.Count != int64(total) {
+			test.Error("RECORDS IN SEVERAL GROUPS WERE COUNTED TWICE IN THE TOTAL", querySpec.Cumulative.Count)
+		}
+	}
+
+	sybil.FLAGS.CACHED_QUERIES = &sybil.FALSE
+	delete_test_db()
+}
+
+func TestBucketGroupings(test *testing.T) {
+	delete_test_db()
+
+	if testing.Short() {
+		test.Skip("Skipping test in short mode")
+		return
+	}
+
+	block_count := 3
+
+	add_records(func(r *sybil.Record, index int) {
+		r.AddIntField("id", int64(index))
+		r.AddIntField("latency", int64(index))
+	}, block_count)
+
+	nt := save_and_reload_table(test, block_count)
+
+	total := sybil.CHUNK_SIZE * block_count
+	tests := map[string]map[string]int64{
+		"latency:bucket=100":     {"[0,100)": 100, "[100,200)": 100, "[200,300)": int64(total - 200)},
+		"latency:log2":           {"(-inf,1)": 1, "[1,2)": 1, "[2,4)": 2, "[64,128)": 64, "[256,512)": int64(total - 256)},
+		"latency:buckets=10;100": {"(-inf,10)": 10, "[10,100)": 90, "[100,inf)": int64(total - 100)},
+	}
+
+	for group, expected := range tests {
+		querySpec := new_query_spec()
+		querySpec.Groups = append(querySpec.Groups, nt.Grouping(group))
+		querySpec.OrderBy = "$GROUP asc"
+
+		nt.MatchAndAggregate(querySpec)
+
+		for k, count := range expected {
+			r, ok := querySpec.Results[k+sybil.GROUP_DELIMITER]
+			if !ok {
+				test.Error("MISSING GROUP", k, "FOR", group)
+				continue
+			}
+
+			if r.Count != count {
+				test.Error("GROUP", k, "FOR", group, "HAS", r.Count, "RECORDS, EXPECTED", count)
+			}
+		}
+
+		sorted := querySpec.SortResultMap(querySpec.Results)
+		if !strings.HasPrefix(sorted[0].GroupByKey, "[0,") && !strings.HasPrefix(sorted[0].GroupByKey, "(-inf,") {
+			test.Error("BUCKETS ARENT SORTED BY THEIR LOWER BOUND", sorted[0].GroupByKey)
+		}
+	}
+
+	for _, fn := range []string{"bucket=0", "bucket=a", "buckets=10;5", "buckets", "log2=2"} {
+		if _, _, err := sybil.ParseGroupingArgs(fn); err == nil {
+			test.Error("EXPECTED AN ERROR FOR", fn)
+		}
+	}
+
+	delete_test_db()
+}
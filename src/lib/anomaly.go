@@ -0,0 +1,247 @@
+package sybil
+
+import "fmt"
+import "math"
+import "os"
+import "sort"
+import "strconv"
+import "strings"
+import "text/tabwriter"
+
+// {{{ ANOMALIES
+
+// Anomaly detection runs over each group's time series, for the count and
+// the average of every aggregation. A bucket's baseline is the median of the
+// preceding Window buckets (or, with a Season, of the buckets a whole number
+// of seasons earlier) and its spread is the median absolute deviation (or the
+// mean absolute deviation, for flat baselines). Buckets whose robust z-score
+// is above the Threshold are reported.
+
+// scales the MAD to a standard deviation for normally distributed data
+var MAD_SCALE = 1.4826
+
+// scales the mean absolute deviation to a standard deviation, for baselines
+// where more than half the values are the same and the MAD is 0
+var MEAN_AD_SCALE = 1.2533
+
+// the least spread of a baseline, as a fraction of its center
+var MIN_SPREAD_RATIO = 0.01
+
+type AnomalySpec struct {
+	Window    int
+	Threshold float64
+	Season    int
+}
+
+type Anomaly struct {
+	Time     int
+	GroupKey string
+	Metric   string
+	Value    float64
+	Expected float64
+	Low      float64
+	High     float64
+	Score    float64
+}
+
+func median(vals []float64) float64 {
+	sorted := append([]float64{}, vals...)
+	sort.Float64s(sorted)
+
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+
+	return sorted[mid]
+}
+
+// the baseline values for the point at index i of the series
+func (spec *AnomalySpec) baseline(series []float64, present []bool, i int) []float64 {
+	vals := make([]float64, 0, spec.Window)
+
+	step := 1
+	if spec.Season > 0 {
+		step = spec.Season
+	}
+
+	for j := i - step; j >= 0 && len(vals) < spec.Window; j -= step {
+		if present[j] {
+			vals = append(vals, series[j])
+		}
+	}
+
+	return vals
+}
+
+// a (mostly) flat baseline has no MAD, so its spread comes from the mean
+// absolute deviation instead, but never less than a small fraction of the
+// center. a baseline of all zeroes is scored in the metric's own units
+func spreadOfFlat(deviations []float64, center float64) float64 {
+	sum := float64(0)
+	for _, d := range deviations {
+		sum += d
+	}
+
+	scale := math.Max(MEAN_AD_SCALE*sum/float64(len(deviations)), MIN_SPREAD_RATIO*math.Abs(center))
+	if scale == 0 {
+		scale = 1
+	}
+
+	return scale
+}
+
+func (spec *AnomalySpec) detect(keys []int, series []float64, present []bool, group_key string, metric string) []Anomaly {
+	anomalies := make([]Anomaly, 0)
+
+	// we need a few points before the baseline means anything
+	min_points := spec.Window / 2
+	if min_points < 3 {
+		min_points = 3
+	}
+
+	for i := range series {
+		if !present[i] {
+			continue
+		}
+
+		vals := spec.baseline(series, present, i)
+		if len(vals) < min_points {
+			continue
+		}
+
+		center := median(vals)
+		deviations := make([]float64, len(vals))
+		for j, v := range vals {
+			deviations[j] = math.Abs(v - center)
+		}
+
+		scale := MAD_SCALE * median(deviations)
+		if scale == 0 {
+			scale = spreadOfFlat(deviations, center)
+		}
+
+		score := (series[i] - center) / scale
+		if math.Abs(score) < spec.Threshold {
+			continue
+		}
+
+		anomalies = append(anomalies, Anomaly{
+			Time:     keys[i],
+			GroupKey: group_key,
+			Metric:   metric,
+			Value:    series[i],
+			Expected: center,
+			Low:      center - spec.Threshold*scale,
+			High:     center + spec.Threshold*scale,
+			Score:    score,
+		})
+	}
+
+	return anomalies
+}
+
+type sortAnomalies []Anomaly
+
+func (a sortAnomalies) Len() int      { return len(a) }
+func (a sortAnomalies) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a sortAnomalies) Less(i, j int) bool {
+	if a[i].Time != a[j].Time {
+		return a[i].Time < a[j].Time
+	}
+
+	return math.Abs(a[i].Score) > math.Abs(a[j].Score)
+}
+
+// FindAnomalies scans every group's count and averages. Missing buckets count
+// as zero events, but have no average.
+func (querySpec *QuerySpec) FindAnomalies() []Anomaly {
+	anomalies := make([]Anomaly, 0)
+	if querySpec.Anomalies == nil || querySpec.TimeBucket <= 0 {
+		return anomalies
+	}
+
+	keys := querySpec.timeBucketKeys("zero")
+
+	groups := make(map[string]bool)
+	for _, results := range querySpec.TimeResults {
+		for group_key := range results {
+			groups[group_key] = true
+		}
+	}
+
+	metrics := []string{""}
+	for _, agg := range querySpec.Aggregations {
+		metrics = append(metrics, agg.Name)
+	}
+
+	for group_key := range groups {
+		for _, metric := range metrics {
+			series := make([]float64, len(keys))
+			present := make([]bool, len(keys))
+			for i, k := range keys {
+				series[i], present[i] = compareValue(querySpec.TimeResults[k][group_key], metric)
+			}
+
+			name := metric
+			if name == "" {
+				name = "count"
+			}
+
+			anomalies = append(anomalies, querySpec.Anomalies.detect(keys, series, present, group_key, name)...)
+		}
+	}
+
+	sort.Sort(sortAnomalies(anomalies))
+	return anomalies
+}
+
+func printAnomalies(querySpec *QuerySpec) {
+	anomalies := querySpec.FindAnomalies()
+	bucketer := querySpec.TimeBucketer()
+
+	if *FLAGS.JSON {
+		results := make([]ResultJSON, 0)
+		for _, a := range anomalies {
+			res := ResultJSON{
+				"time":     a.Time,
+				"metric":   a.Metric,
+				"value":    a.Value,
+				"expected": a.Expected,
+				"low":      a.Low,
+				"high":     a.High,
+				"score":    a.Score,
+			}
+
+			var group_key = strings.Split(a.GroupKey, GROUP_DELIMITER)
+			for i, g := range querySpec.Groups {
+				res[g.Name] = group_key[i]
+			}
+
+			results = append(results, res)
+		}
+
+		printJson(results)
+		return
+	}
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 1, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "time\tgroup\tmetric\tvalue\texpected\trange\tscore\t")
+	for _, a := range anomalies {
+		group_key := strings.TrimRight(strings.Replace(a.GroupKey, GROUP_DELIMITER, ",", -1), ",")
+		expected_range := fmt.Sprintf("[%.2f, %.2f]", a.Low, a.High)
+		fmt.Fprintln(w, strings.Join([]string{
+			bucketer.Format(int64(a.Time), OPTS.TIME_FORMAT),
+			group_key,
+			a.Metric,
+			strconv.FormatFloat(a.Value, 'f', 2, 64),
+			strconv.FormatFloat(a.Expected, 'f', 2, 64),
+			expected_range,
+			strconv.FormatFloat(a.Score, 'f', 2, 64),
+		}, "\t")+"\t")
+	}
+	w.Flush()
+}
+
+// }}} ANOMALIES
@@ -0,0 +1,121 @@
+package sybil_test
+
+import sybil "./"
+
+import "testing"
+
+func TestFindAnomalies(test *testing.T) {
+	delete_test_db()
+
+	if testing.Short() {
+		test.Skip("Skipping test in short mode")
+		return
+	}
+
+	block_count := 3
+	spike_bucket := 20
+
+	add_records(func(r *sybil.Record, index int) {
+		bucket := index % 30
+		r.AddIntField("id", int64(index))
+		r.AddIntField("time", int64(bucket)*3600)
+
+		latency := int64(100 + index%7)
+		if bucket == spike_bucket {
+			latency = 1000
+		}
+		r.AddIntField("latency", latency)
+	}, block_count)
+
+	nt := save_and_reload_table(test, block_count)
+
+	time_col_id := sybil.OPTS.TIME_COL_ID
+	sybil.OPTS.TIME_COL_ID = nt.KeyTable["time"]
+
+	querySpec := new_query_spec()
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("latency", "avg"))
+	querySpec.TimeBucket = 3600
+	querySpec.Anomalies = &sybil.AnomalySpec{Window: 10, Threshold: 3.5}
+
+	nt.MatchAndAggregate(querySpec)
+	sybil.OPTS.TIME_COL_ID = time_col_id
+
+	anomalies := querySpec.FindAnomalies()
+	found := false
+	for _, a := range anomalies {
+		if a.Metric == "count" {
+			test.Error("UNEXPECTED COUNT ANOMALY", a)
+		}
+
+		if a.Metric == "latency" && a.Time == spike_bucket*3600 {
+			found = true
+			if a.Value < a.High || a.Score < 3.5 {
+				test.Error("SPIKE SHOULD BE ABOVE THE EXPECTED RANGE", a)
+			}
+		}
+	}
+
+	if !found {
+		test.Error("DIDNT FIND THE LATENCY SPIKE", anomalies)
+	}
+
+	delete_test_db()
+}
+
+// Tests that a small change from a flat baseline isn't an anomaly, while a
+// real jump still is
+func TestAnomaliesWithFlatBaseline(test *testing.T) {
+	delete_test_db()
+
+	block_count := 3
+	nudge_bucket := 20
+	spike_bucket := 25
+
+	add_records(func(r *sybil.Record, index int) {
+		bucket := index % 30
+		r.AddIntField("id", int64(index))
+		r.AddIntField("time", int64(bucket)*3600)
+
+		latency := int64(1000)
+		switch bucket {
+		case nudge_bucket:
+			latency = 1004
+		case spike_bucket:
+			latency = 2000
+		}
+		r.AddIntField("latency", latency)
+	}, block_count)
+
+	nt := save_and_reload_table(test, block_count)
+
+	time_col_id := sybil.OPTS.TIME_COL_ID
+	sybil.OPTS.TIME_COL_ID = nt.KeyTable["time"]
+
+	querySpec := new_query_spec()
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("latency", "avg"))
+	querySpec.TimeBucket = 3600
+	querySpec.Anomalies = &sybil.AnomalySpec{Window: 10, Threshold: 3.5}
+
+	nt.MatchAndAggregate(querySpec)
+	sybil.OPTS.TIME_COL_ID = time_col_id
+
+	found := false
+	for _, a := range querySpec.FindAnomalies() {
+		if a.Metric != "latency" {
+			continue
+		}
+
+		if a.Time == spike_bucket*3600 {
+			found = true
+			continue
+		}
+
+		test.Error("UNEXPECTED LATENCY ANOMALY", a)
+	}
+
+	if !found {
+		test.Error("DIDNT FIND THE LATENCY SPIKE")
+	}
+
+	delete_test_db()
+}
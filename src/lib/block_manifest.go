@@ -0,0 +1,181 @@
+package sybil
+
+import "bytes"
+import "compress/gzip"
+import "encoding/gob"
+import "fmt"
+import "hash/crc32"
+import "io/ioutil"
+import "os"
+import "path"
+import "strings"
+
+// {{{ BLOCK MANIFESTS
+
+// Since BLOCK_VERSION 2, every block has a manifest.db next to its columns
+// that describes the block: its version, record count and the name, type,
+// encoding, file, size and checksum of each column. Readers use the manifest
+// to find the columns of a block and decode them by their encoding, blocks
+// without one are version 1 blocks and are read by listing their directory.
+
+var MANIFEST_FILE = "manifest.db"
+
+type ColumnManifest struct {
+	Name     string
+	Type     string // int, str or set
+	Encoding string // bucket, value or delta (delta encoded int values)
+	File     string
+	Size     int64
+	Checksum uint32 // crc32 of the uncompressed file
+}
+
+type BlockManifest struct {
+	Version    int32
+	NumRecords int32
+	Columns    []ColumnManifest
+}
+
+// addColumnManifest records a column file that is being written to the block
+func (tb *TableBlock) addColumnManifest(name, col_type, encoding, filename string, data []byte) {
+	cm := ColumnManifest{Name: name, Type: col_type, Encoding: encoding, File: path.Base(filename)}
+	cm.Size = int64(len(data))
+	cm.Checksum = crc32.ChecksumIEEE(data)
+
+	tb.manifest = append(tb.manifest, cm)
+}
+
+func (tb *TableBlock) SaveManifestToColumns(dirname string) {
+	manifest := BlockManifest{Version: BLOCK_VERSION, NumRecords: int32(len(tb.RecordList)), Columns: tb.manifest}
+
+	var network bytes.Buffer
+	enc := gob.NewEncoder(&network)
+	err := enc.Encode(manifest)
+
+	if err != nil {
+		Error("encode:", err)
+	}
+
+	w, err := os.Create(path.Join(dirname, MANIFEST_FILE))
+	if err != nil {
+		Error("ERROR SAVING BLOCK MANIFEST", dirname, err)
+	}
+
+	network.WriteTo(w)
+	w.Close()
+}
+
+// LoadBlockManifest returns the manifest of a block or nil for version 1
+// blocks, which don't have one
+func LoadBlockManifest(dirname string) *BlockManifest {
+	filename := path.Join(dirname, MANIFEST_FILE)
+	if _, err := os.Stat(filename); err != nil {
+		return nil
+	}
+
+	manifest := BlockManifest{}
+	err := decodeInto(filename, &manifest)
+	if err != nil {
+		Warn("ERROR DECODING BLOCK MANIFEST", dirname, err)
+		return nil
+	}
+
+	return &manifest
+}
+
+// listBlockColumns makes up the column list of a version 1 block from the
+// names of its files, it also returns the size of all files in the block
+func listBlockColumns(dirname string) ([]ColumnManifest, int64) {
+	columns := make([]ColumnManifest, 0)
+	size := int64(0)
+
+	files, _ := ioutil.ReadDir(dirname)
+	for _, f := range files {
+		size += f.Size()
+
+		fname := f.Name()
+		cname := strings.TrimSuffix(strings.TrimSuffix(fname, GZIP_EXT), ".db")
+		for _, col_type := range []string{"str", "set", "int"} {
+			if strings.HasPrefix(fname, col_type) {
+				name := strings.TrimPrefix(cname, col_type+"_")
+				columns = append(columns, ColumnManifest{Name: name, Type: col_type, File: fname, Size: f.Size()})
+				break
+			}
+		}
+	}
+
+	return columns, size
+}
+
+// useEncoding sets the encoding flags of a column from its encoding in the
+// block manifest. version 1 blocks have no encoding in their column list and
+// keep the flags the column was saved with. only int columns can be delta
+// encoded, the others pass a nil delta. returns false for encodings we can't
+// read
+func useEncoding(encoding string, bucketed *bool, delta *bool) bool {
+	switch encoding {
+	case "":
+		return true
+	case "bucket":
+		*bucketed = true
+	case "value":
+		*bucketed = false
+	case "delta":
+		if delta == nil {
+			return false
+		}
+		*bucketed = false
+	default:
+		return false
+	}
+
+	if delta != nil {
+		*delta = encoding == "delta"
+	}
+
+	return true
+}
+
+func readColumnFile(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err == nil || !os.IsNotExist(err) {
+		return data, err
+	}
+
+	// the file may have been compressed after it was written
+	file, err := os.Open(filename + GZIP_EXT)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(reader)
+}
+
+// VerifyBlock checks the columns of a block against the checksums in its
+// manifest
+func VerifyBlock(dirname string) error {
+	manifest := LoadBlockManifest(dirname)
+	if manifest == nil {
+		return fmt.Errorf("block %s has no manifest", dirname)
+	}
+
+	for _, col := range manifest.Columns {
+		data, err := readColumnFile(path.Join(dirname, col.File))
+		if err != nil {
+			return err
+		}
+
+		if crc32.ChecksumIEEE(data) != col.Checksum {
+			return fmt.Errorf("checksum mismatch for %s in block %s", col.File, dirname)
+		}
+	}
+
+	return nil
+}
+
+// }}} BLOCK MANIFESTS
@@ -0,0 +1,131 @@
+package sybil_test
+
+import sybil "./"
+
+import "encoding/gob"
+import "io/ioutil"
+import "os"
+import "path"
+import "testing"
+
+func TestBlockManifests(test *testing.T) {
+	delete_test_db()
+
+	block_count := 3
+	add_records(func(r *sybil.Record, index int) {
+		r.AddIntField("id", int64(index))
+		r.AddStrField("name", "user"+string(rune('a'+index%26)))
+		r.AddSetField("tags", []string{"a", "b"})
+	}, block_count)
+
+	nt := save_and_reload_table(test, block_count)
+
+	blocks := make([]string, 0)
+	for name := range nt.BlockList {
+		blocks = append(blocks, name)
+
+		manifest := sybil.LoadBlockManifest(name)
+		if manifest == nil || manifest.Version != sybil.BLOCK_VERSION || len(manifest.Columns) != 3 {
+			test.Fatal("NEW BLOCK IS MISSING ITS MANIFEST", name, manifest)
+		}
+
+		if err := sybil.VerifyBlock(name); err != nil {
+			test.Error("NEW BLOCK DIDNT VERIFY", err)
+		}
+	}
+
+	// TURN THE BLOCKS INTO VERSION 1 BLOCKS, WHICH STILL READ THE SAME
+	for _, name := range blocks {
+		os.Remove(path.Join(name, sybil.MANIFEST_FILE))
+	}
+
+	unload_test_table()
+	nt = sybil.GetTable(TEST_TABLE_NAME)
+	nt.LoadTableInfo()
+
+	loadSpec := nt.NewLoadSpec()
+	loadSpec.LoadAllColumns = true
+	if count := nt.LoadRecords(&loadSpec); count != sybil.CHUNK_SIZE*block_count {
+		test.Error("COULDNT READ VERSION 1 BLOCKS", count)
+	}
+
+	unload_test_table()
+	nt = sybil.GetTable(TEST_TABLE_NAME)
+	nt.LoadTableInfo()
+
+	if old := nt.MigrateBlocks(true); len(old) != block_count {
+		test.Error("DRY RUN DIDNT FIND THE OLD BLOCKS", old)
+	}
+
+	if migrated := nt.MigrateBlocks(false); len(migrated) != block_count {
+		test.Error("DIDNT MIGRATE THE OLD BLOCKS", migrated)
+	}
+
+	if old := nt.MigrateBlocks(true); len(old) != 0 {
+		test.Error("BLOCKS ARE STILL OLD AFTER MIGRATING", old)
+	}
+
+	unload_test_table()
+	nt = sybil.GetTable(TEST_TABLE_NAME)
+	nt.LoadTableInfo()
+
+	querySpec := new_query_spec()
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("id", "avg"))
+
+	loadSpec = nt.NewLoadSpec()
+	loadSpec.LoadAllColumns = true
+	if count := nt.LoadAndQueryRecords(&loadSpec, querySpec); count != sybil.CHUNK_SIZE*block_count {
+		test.Error("MIGRATED BLOCKS LOST RECORDS", count)
+	}
+
+	for _, r := range querySpec.Results {
+		if r.Hists["id"].Mean() != float64(sybil.CHUNK_SIZE*block_count-1)/2 {
+			test.Error("MIGRATED BLOCKS HAVE WRONG VALUES", r.Hists["id"].Mean())
+		}
+	}
+
+	// COLUMNS ARE DECODED BY THE ENCODING IN THE MANIFEST, SO A COLUMN WITH AN
+	// ENCODING WE DONT KNOW IS LEFT OUT
+	manifest := sybil.LoadBlockManifest(blocks[0])
+	for i, col := range manifest.Columns {
+		if col.Name == "id" {
+			manifest.Columns[i].Encoding = "zstd"
+		}
+	}
+
+	w, _ := os.Create(path.Join(blocks[0], sybil.MANIFEST_FILE))
+	gob.NewEncoder(w).Encode(manifest)
+	w.Close()
+
+	unload_test_table()
+	nt = sybil.GetTable(TEST_TABLE_NAME)
+	nt.LoadTableInfo()
+
+	loadSpec = nt.NewLoadSpec()
+	loadSpec.LoadAllColumns = true
+	nt.LoadRecords(&loadSpec)
+
+	missing_ids, names := 0, 0
+	for _, block := range nt.BlockList {
+		for _, r := range block.RecordList {
+			if _, ok := r.GetIntVal("id"); !ok {
+				missing_ids++
+			}
+			if _, ok := r.GetStrVal("name"); ok {
+				names++
+			}
+		}
+	}
+
+	if missing_ids != sybil.CHUNK_SIZE || names != sybil.CHUNK_SIZE*block_count {
+		test.Error("UNKNOWN ENCODING WASNT SKIPPED", missing_ids, names)
+	}
+
+	// A CHANGED COLUMN FILE DOESNT VERIFY
+	ioutil.WriteFile(path.Join(blocks[0], "int_id.db"), []byte("garbage"), 0666)
+	if err := sybil.VerifyBlock(blocks[0]); err == nil {
+		test.Error("CORRUPT BLOCK VERIFIED")
+	}
+
+	delete_test_db()
+}
@@ -27,10 +27,17 @@ type FlagDefs struct {
 	TIME        *bool
 	TIME_COL    *string
 	TIME_BUCKET *int
+	TIME_ZONE   *string
+	FILL        *string
+	SINCE       *string
+	UNTIL       *string
+	TIME_RANGE  *string
 	HIST_BUCKET *int
 	HDR_HIST    *bool
 	LOG_HIST    *bool
 
+	TDIGEST_HIST *bool
+
 	FIELD_SEPARATOR    *string
 	FILTER_SEPARATOR   *string
 	PRINT_KEYS         *bool
@@ -48,7 +55,8 @@ type FlagDefs struct {
 
 	WEIGHT_COL *string
 
-	LIMIT *int
+	LIMIT       *int
+	PERCENTILES *string
 
 	DEBUG *bool
 	JSON  *bool
@@ -56,6 +64,9 @@ type FlagDefs struct {
 
 	DIR        *string
 	SORT       *string
+	ORDER_BY   *string
+	HAVING     *string
+	SERIES_FN  *string
 	TABLE      *string
 	PRINT_INFO *bool
 	SAMPLES    *bool
@@ -77,6 +88,9 @@ type FlagDefs struct {
 	PATH_KEY       *string
 	PATH_LENGTH    *int
 
+	SESSION_MAX_EVENTS *int
+	SESSION_MAX_LENGTH *int // minutes
+
 	// STATS
 	ANOVA_ICC *bool
 }
@@ -97,8 +111,10 @@ type OptionDefs struct {
 	WRITE_BLOCK_INFO        bool
 	TIMESERIES              bool
 	TIME_COL_ID             int16
+	TIME_BUCKET_UNIT        string
 	TIME_FORMAT             string
 	GROUP_BY                []string
+	PERCENTILES             []float64
 }
 
 // TODO: merge these two into one thing
@@ -132,7 +148,7 @@ func setDefaults() {
 	FLAGS.READ_ROWSTORE = &FALSE
 	FLAGS.ANOVA_ICC = &FALSE
 	FLAGS.DIR = flag.String("dir", "./db/", "Directory to store DB files")
-	FLAGS.TABLE = flag.String("table", "", "Table to operate on [REQUIRED]")
+	FLAGS.TABLE = flag.String("table", "", "Table to operate on [REQUIRED], queries can also use a list of tables and globs like web_*")
 
 	FLAGS.DEBUG = flag.Bool("debug", false, "enable debug logging")
 	FLAGS.FIELD_SEPARATOR = flag.String("field-separator", ",", "Field separator used in command line params")
@@ -149,9 +165,19 @@ func setDefaults() {
 
 	FLAGS.HDR_HIST = &FALSE
 	FLAGS.LOG_HIST = &FALSE
+	FLAGS.TDIGEST_HIST = &FALSE
 
 	DEFAULT_LIMIT := 100
 	FLAGS.LIMIT = &DEFAULT_LIMIT
+	FLAGS.PERCENTILES = &EMPTY
+	FLAGS.ORDER_BY = &EMPTY
+	FLAGS.HAVING = &EMPTY
+	FLAGS.SERIES_FN = &EMPTY
+	FLAGS.TIME_ZONE = &EMPTY
+	FLAGS.FILL = &EMPTY
+	FLAGS.SINCE = &EMPTY
+	FLAGS.UNTIL = &EMPTY
+	FLAGS.TIME_RANGE = &EMPTY
 
 	FLAGS.PROFILE = &FALSE
 	FLAGS.PROFILE_MEM = &FALSE
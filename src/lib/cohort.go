@@ -0,0 +1,161 @@
+package sybil
+
+import "fmt"
+import "sort"
+import "time"
+
+// {{{ COHORTS
+
+// A cohort table groups entities (session column values) by the day, week or
+// month they were first seen and counts how many of them were active again
+// 0..N periods later. It is built from the daily activity in each entity's
+// Calendar, so it needs -calendar.
+
+var COHORT_PERIODS = map[string]bool{
+	"day":   true,
+	"week":  true,
+	"month": true,
+}
+
+type CohortSpec struct {
+	Period  string
+	Periods int
+}
+
+type Cohort struct {
+	Start    int64
+	Size     int64
+	Retained []int64
+}
+
+type CohortTable struct {
+	Spec    CohortSpec
+	Cohorts map[int64]*Cohort
+}
+
+// ParseCohortSpec checks the -cohort period and the number of periods to show
+func ParseCohortSpec(period string, periods int) (*CohortSpec, error) {
+	if !COHORT_PERIODS[period] {
+		return nil, fmt.Errorf("invalid cohort period %s, expected day, week or month", period)
+	}
+
+	if periods <= 0 {
+		return nil, fmt.Errorf("cohorts need at least 1 period")
+	}
+
+	return &CohortSpec{Period: period, Periods: periods}, nil
+}
+
+// the period of a day since the epoch
+func (cs CohortSpec) periodOf(day int64) int64 {
+	switch cs.Period {
+	case "week":
+		// weeks start on monday, the epoch was a thursday
+		return floorDiv(day+3, 7)
+	case "month":
+		t := time.Unix(day*SECONDS_PER_DAY, 0).UTC()
+		return int64(t.Year())*12 + int64(t.Month()) - 1
+	}
+
+	return day
+}
+
+func (cs CohortSpec) formatPeriod(period int64) string {
+	switch cs.Period {
+	case "week":
+		return time.Unix((period*7-3)*SECONDS_PER_DAY, 0).UTC().Format("2006-01-02")
+	case "month":
+		return time.Date(int(floorDiv(period, 12)), time.Month(floorMod(period, 12)+1), 1, 0, 0, 0, 0, time.UTC).Format("2006-01")
+	}
+
+	return time.Unix(period*SECONDS_PER_DAY, 0).UTC().Format("2006-01-02")
+}
+
+func NewCohortTable(spec CohortSpec) *CohortTable {
+	ct := CohortTable{Spec: spec}
+	ct.Cohorts = make(map[int64]*Cohort)
+	return &ct
+}
+
+// AddEntity adds an entity to the cohort of its first active period and
+// counts it as retained in each later period it was active
+func (ct *CohortTable) AddEntity(c *Calendar) {
+	if len(c.Daily) == 0 {
+		return
+	}
+
+	active := make(map[int64]bool)
+	first := int64(0)
+	for day := range c.Daily {
+		period := ct.Spec.periodOf(int64(day))
+		if len(active) == 0 || period < first {
+			first = period
+		}
+		active[period] = true
+	}
+
+	cohort, ok := ct.Cohorts[first]
+	if !ok {
+		cohort = &Cohort{Start: first, Retained: make([]int64, ct.Spec.Periods+1)}
+		ct.Cohorts[first] = cohort
+	}
+
+	cohort.Size++
+	for period := range active {
+		if offset := period - first; offset <= int64(ct.Spec.Periods) {
+			cohort.Retained[offset]++
+		}
+	}
+}
+
+func (ct *CohortTable) sortedCohorts() []*Cohort {
+	starts := make([]int64, 0, len(ct.Cohorts))
+	for start := range ct.Cohorts {
+		starts = append(starts, start)
+	}
+	sort.Sort(sortInt64s(starts))
+
+	cohorts := make([]*Cohort, 0, len(starts))
+	for _, start := range starts {
+		cohorts = append(cohorts, ct.Cohorts[start])
+	}
+	return cohorts
+}
+
+func (ct *CohortTable) PrintCohorts() {
+	fmt.Printf("  cohorts by %s:\n", ct.Spec.Period)
+	fmt.Printf("    %-10s %8s", ct.Spec.Period, "size")
+	for i := 0; i <= ct.Spec.Periods; i++ {
+		fmt.Printf(" %14d", i)
+	}
+	fmt.Printf("\n")
+
+	for _, cohort := range ct.sortedCohorts() {
+		fmt.Printf("    %-10s %8d", ct.Spec.formatPeriod(cohort.Start), cohort.Size)
+		for _, count := range cohort.Retained {
+			fmt.Printf(" %6d %6.1f%%", count, percentOf(count, cohort.Size))
+		}
+		fmt.Printf("\n")
+	}
+}
+
+func (ct *CohortTable) toJSON() []map[string]interface{} {
+	cohorts := make([]map[string]interface{}, 0)
+	for _, cohort := range ct.sortedCohorts() {
+		rates := make([]float64, len(cohort.Retained))
+		for i, count := range cohort.Retained {
+			rates[i] = percentOf(count, cohort.Size)
+		}
+
+		info := make(map[string]interface{})
+		info["cohort"] = ct.Spec.formatPeriod(cohort.Start)
+		info["size"] = cohort.Size
+		info["retained"] = cohort.Retained
+		info["percent"] = rates
+		cohorts = append(cohorts, info)
+	}
+
+	return cohorts
+}
+
+// }}} COHORTS
@@ -0,0 +1,63 @@
+package sybil_test
+
+import sybil "./"
+
+import "testing"
+
+func TestCohortTable(test *testing.T) {
+	prev_retention := sybil.FLAGS.RETENTION
+	sybil.FLAGS.RETENTION = &sybil.TRUE
+	defer func() { sybil.FLAGS.RETENTION = prev_retention }()
+
+	day := 24 * 60 * 60
+	start := 1760054400 // 2025-10-10, a friday
+
+	weekly, err := sybil.ParseCohortSpec("week", 2)
+	if err != nil {
+		test.Fatal("COULDNT PARSE COHORT SPEC", err)
+	}
+
+	daily, _ := sybil.ParseCohortSpec("day", 3)
+	weeks := sybil.NewCohortTable(*weekly)
+	days := sybil.NewCohortTable(*daily)
+
+	// 10 USERS SEEN ON THE FIRST DAY, THE EVEN ONES COME BACK 2 DAYS LATER
+	// AND THE FIRST 3 COME BACK A WEEK LATER
+	for i := 0; i < 10; i++ {
+		c := sybil.NewCalendar()
+		c.AddActivity(start + i*60)
+		if i%2 == 0 {
+			c.AddActivity(start + 2*day)
+		}
+		if i < 3 {
+			c.AddActivity(start + 7*day)
+		}
+
+		weeks.AddEntity(c)
+		days.AddEntity(c)
+	}
+
+	cohort, ok := days.Cohorts[int64(start/day)]
+	if !ok || cohort.Size != 10 {
+		test.Fatal("EXPECTED ONE DAILY COHORT OF 10", days.Cohorts)
+	}
+
+	if cohort.Retained[0] != 10 || cohort.Retained[1] != 0 || cohort.Retained[2] != 5 || len(cohort.Retained) != 4 {
+		test.Error("WRONG DAILY RETENTION", cohort.Retained)
+	}
+
+	if len(weeks.Cohorts) != 1 {
+		test.Fatal("EXPECTED ONE WEEKLY COHORT", weeks.Cohorts)
+	}
+
+	for _, cohort := range weeks.Cohorts {
+		// the friday and the sunday after are in the same week
+		if cohort.Retained[0] != 10 || cohort.Retained[1] != 3 || cohort.Retained[2] != 0 {
+			test.Error("WRONG WEEKLY RETENTION", cohort.Retained)
+		}
+	}
+
+	if _, err := sybil.ParseCohortSpec("year", 2); err == nil {
+		test.Error("PARSED AN INVALID COHORT PERIOD")
+	}
+}
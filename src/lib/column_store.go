@@ -1,8 +1,9 @@
 package sybil
 
 // the BLOCK_VERSION is how we get hints about decoding blocks for backwards
-// compatibility. at least, it will be in the future
-var BLOCK_VERSION = int32(1)
+// compatibility. version 2 blocks have a manifest.db (see block_manifest.go),
+// version 1 blocks are read by listing their column files
+var BLOCK_VERSION = int32(2)
 
 // Before we save the new record list in a table, we tend to sort by time
 type RecordList []*Record
@@ -126,9 +126,14 @@ func (tb *TableBlock) SaveIntsToColumns(dirname string, same_ints map[int16]Valu
 		}
 
 		action := "SERIALIZED"
+		encoding := "value"
 		if intCol.BucketEncoded {
 			action = "BUCKETED  "
+			encoding = "bucket"
+		} else if intCol.ValueEncoded {
+			encoding = "delta"
 		}
+		tb.addColumnManifest(col_name, "int", encoding, col_fname, network.Bytes())
 
 		Debug(action, "COLUMN BLOCK", col_fname, network.Len(), "BYTES", "( PER RECORD", network.Len()/len(tb.RecordList), ")")
 
@@ -148,7 +153,7 @@ func (tb *TableBlock) SaveSetsToColumns(dirname string, same_sets map[int16]Valu
 			Debug("CANT FIGURE OUT FIELD NAME FOR", k, "PROBABLY AN ERRONEOUS FIELD")
 			continue
 		}
-		setCol := SavedSetColumn{}
+		setCol := NewSavedSetColumn()
 		setCol.Name = col_name
 		setCol.DeltaEncodedIDs = OPTS.DELTA_ENCODE_RECORD_IDS
 		temp_block := newTableBlock()
@@ -207,9 +212,12 @@ func (tb *TableBlock) SaveSetsToColumns(dirname string, same_sets map[int16]Valu
 		}
 
 		action := "SERIALIZED"
+		encoding := "value"
 		if setCol.BucketEncoded {
 			action = "BUCKETED  "
+			encoding = "bucket"
 		}
+		tb.addColumnManifest(col_name, "set", encoding, col_fname, network.Bytes())
 
 		Debug(action, "COLUMN BLOCK", col_fname, network.Len(), "BYTES", "( PER RECORD", network.Len()/len(tb.RecordList), ")")
 
@@ -293,9 +301,12 @@ func (tb *TableBlock) SaveStrsToColumns(dirname string, same_strs map[int16]Valu
 		}
 
 		action := "SERIALIZED"
+		encoding := "value"
 		if strCol.BucketEncoded {
 			action = "BUCKETED  "
+			encoding = "bucket"
 		}
+		tb.addColumnManifest(col_name, "str", encoding, col_fname, network.Bytes())
 
 		Debug(action, "COLUMN BLOCK", col_fname, network.Len(), "BYTES", "( PER RECORD", network.Len()/len(tb.RecordList), ")")
 
@@ -442,10 +453,12 @@ func (tb *TableBlock) SaveToColumns(filename string) bool {
 	end := time.Now()
 	Debug("COLLATING BLOCKS TOOK", end.Sub(start))
 
+	tb.manifest = nil
 	tb.SaveIntsToColumns(partialname, separated_columns.ints)
 	tb.SaveStrsToColumns(partialname, separated_columns.strs)
 	tb.SaveSetsToColumns(partialname, separated_columns.sets)
 	tb.SaveInfoToColumns(partialname)
+	tb.SaveManifestToColumns(partialname)
 
 	end = time.Now()
 	Debug("FINISHED BLOCK", partialname, "RELINKING TO", dirname, "TOOK", end.Sub(start))
@@ -471,6 +484,12 @@ func (tb *TableBlock) SaveToColumns(filename string) bool {
 		}
 	}
 
+	if err := VerifyBlock(partialname); err != nil {
+		Warn("RECENTLY SAVED BLOCK DIDNT VERIFY, NOT REPLACING", filename, err)
+		os.RemoveAll(partialname)
+		return false
+	}
+
 	Debug("VALIDATED NEW BLOCK HAS", nb.Info.NumRecords, "RECORDS, TOOK", end.Sub(start))
 
 	os.RemoveAll(oldblock)
@@ -494,7 +513,7 @@ func (tb *TableBlock) SaveToColumns(filename string) bool {
 
 }
 
-func (tb *TableBlock) unpackStrCol(dec *FileDecoder, info SavedColumnInfo) {
+func (tb *TableBlock) unpackStrCol(dec *FileDecoder, info SavedColumnInfo, encoding string) {
 	records := tb.RecordList[:]
 
 	into := &SavedStrColumn{}
@@ -504,6 +523,11 @@ func (tb *TableBlock) unpackStrCol(dec *FileDecoder, info SavedColumnInfo) {
 		return
 	}
 
+	if useEncoding(encoding, &into.BucketEncoded, nil) == false {
+		Warn("CANT READ", encoding, "ENCODING OF COLUMN", into.Name, "IN BLOCK", tb.Name)
+		return
+	}
+
 	string_lookup := make(map[int32]string)
 	key_table_len := len(tb.table.KeyTable)
 	col_id := tb.table.get_key_id(into.Name)
@@ -604,7 +628,7 @@ func (tb *TableBlock) unpackStrCol(dec *FileDecoder, info SavedColumnInfo) {
 	}
 }
 
-func (tb *TableBlock) unpackSetCol(dec *FileDecoder, info SavedColumnInfo) {
+func (tb *TableBlock) unpackSetCol(dec *FileDecoder, info SavedColumnInfo, encoding string) {
 	records := tb.RecordList
 
 	saved_col := NewSavedSetColumn()
@@ -614,6 +638,11 @@ func (tb *TableBlock) unpackSetCol(dec *FileDecoder, info SavedColumnInfo) {
 		Debug("DECODE COL ERR:", err)
 	}
 
+	if useEncoding(encoding, &into.BucketEncoded, nil) == false {
+		Warn("CANT READ", encoding, "ENCODING OF COLUMN", into.Name, "IN BLOCK", tb.Name)
+		return
+	}
+
 	col_id := tb.table.get_key_id(into.Name)
 	string_lookup := make(map[int32]string)
 
@@ -661,7 +690,7 @@ func (tb *TableBlock) unpackSetCol(dec *FileDecoder, info SavedColumnInfo) {
 	}
 }
 
-func (tb *TableBlock) unpackIntCol(dec *FileDecoder, info SavedColumnInfo) {
+func (tb *TableBlock) unpackIntCol(dec *FileDecoder, info SavedColumnInfo, encoding string) {
 	records := tb.RecordList[:]
 
 	into := &SavedIntColumn{}
@@ -670,6 +699,11 @@ func (tb *TableBlock) unpackIntCol(dec *FileDecoder, info SavedColumnInfo) {
 		Debug("DECODE COL ERR:", err)
 	}
 
+	if useEncoding(encoding, &into.BucketEncoded, &into.ValueEncoded) == false {
+		Warn("CANT READ", encoding, "ENCODING OF COLUMN", into.Name, "IN BLOCK", tb.Name)
+		return
+	}
+
 	col_id := tb.table.get_key_id(into.Name)
 
 	is_time_col := false
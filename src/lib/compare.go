@@ -0,0 +1,243 @@
+package sybil
+
+import "fmt"
+import "os"
+import "sort"
+import "strconv"
+import "strings"
+import "text/tabwriter"
+
+// {{{ COMPARE
+
+// A -compare query runs the same QuerySpec over two windows in one pass: the
+// query's time range and the same range CompareOffset seconds earlier. The
+// earlier window's records are shifted forward by the offset, so its groups
+// and time buckets line up with the current window's.
+
+// groups that only show up in the previous window get an empty current
+// result, so they survive sorting and show up as a drop to zero
+func (querySpec *QuerySpec) alignCompareResults() {
+	if querySpec.CompareOffset <= 0 {
+		return
+	}
+
+	for k, r := range querySpec.CompareResults {
+		if _, ok := querySpec.Results[k]; !ok {
+			empty := NewResult()
+			empty.GroupByKey = r.GroupByKey
+			querySpec.Results[k] = empty
+		}
+	}
+}
+
+// compareValue is the count or avg of an aggregation that we diff across the
+// windows
+func compareValue(r *Result, agg string) (float64, bool) {
+	if r == nil {
+		return 0, agg == ""
+	}
+
+	if agg == "" {
+		return float64(r.Count), true
+	}
+
+	h, ok := r.Hists[agg]
+	if !ok {
+		return 0, false
+	}
+
+	return h.Mean(), true
+}
+
+// returns the absolute and percent change between the windows. the percent
+// change is missing when there is nothing to compare against
+func compareDelta(cur, prev float64, cur_ok, prev_ok bool) (interface{}, interface{}) {
+	if !cur_ok || !prev_ok {
+		return nil, nil
+	}
+
+	delta := cur - prev
+	if prev == 0 {
+		return delta, nil
+	}
+
+	return delta, delta / prev * 100
+}
+
+func formatCompareValue(val interface{}, pct bool) string {
+	if val == nil {
+		return "-"
+	}
+
+	if pct {
+		return fmt.Sprintf("%+.1f%%", val.(float64))
+	}
+
+	return strconv.FormatFloat(val.(float64), 'f', 2, 64)
+}
+
+func (querySpec *QuerySpec) compareResultJSON(r *Result, prev *Result) ResultJSON {
+	res := r.toResultJSON(querySpec)
+
+	previous := make(ResultJSON)
+	delta := make(ResultJSON)
+	pct := make(ResultJSON)
+
+	names := []string{""}
+	for _, agg := range querySpec.Aggregations {
+		names = append(names, agg.Name)
+	}
+
+	for _, name := range names {
+		key := name
+		if key == "" {
+			key = "Count"
+		}
+
+		cur, cur_ok := compareValue(r, name)
+		old, old_ok := compareValue(prev, name)
+		if old_ok {
+			previous[key] = old
+		} else {
+			previous[key] = nil
+		}
+
+		delta[key], pct[key] = compareDelta(cur, old, cur_ok, old_ok)
+	}
+
+	res["Previous"] = previous
+	res["Delta"] = delta
+	res["PctChange"] = pct
+
+	return res
+}
+
+func (querySpec *QuerySpec) printCompareRow(w *tabwriter.Writer, prefix []string, r *Result, prev *Result) {
+	group_key := strings.TrimRight(strings.Replace(r.GroupByKey, GROUP_DELIMITER, ",", -1), ",")
+
+	names := []string{""}
+	for _, agg := range querySpec.Aggregations {
+		names = append(names, agg.Name)
+	}
+
+	for _, name := range names {
+		cur, cur_ok := compareValue(r, name)
+		old, old_ok := compareValue(prev, name)
+		delta, pct := compareDelta(cur, old, cur_ok, old_ok)
+
+		label := name
+		if label == "" {
+			label = "count"
+		}
+
+		var cur_val, old_val interface{}
+		if cur_ok {
+			cur_val = cur
+		}
+		if old_ok {
+			old_val = old
+		}
+
+		row := append([]string{}, prefix...)
+		row = append(row, group_key, label, formatCompareValue(cur_val, false), formatCompareValue(old_val, false),
+			formatCompareValue(delta, false), formatCompareValue(pct, true))
+		fmt.Fprintln(w, strings.Join(row, "\t")+"\t")
+	}
+}
+
+func printCompareResults(querySpec *QuerySpec) {
+	sorted := querySpec.Sorted
+	if int(querySpec.Limit) < len(sorted) {
+		sorted = sorted[:querySpec.Limit]
+	}
+
+	if querySpec.TimeBucket > 0 {
+		printCompareTimeResults(querySpec, sorted)
+		return
+	}
+
+	if *FLAGS.JSON {
+		results := make([]ResultJSON, 0)
+		for _, r := range sorted {
+			results = append(results, querySpec.compareResultJSON(r, querySpec.CompareResults[r.GroupByKey]))
+		}
+
+		printJson(results)
+		return
+	}
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 1, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "group\tmetric\tcurrent\tprevious\tdelta\tpct\t")
+	for _, r := range sorted {
+		querySpec.printCompareRow(w, nil, r, querySpec.CompareResults[r.GroupByKey])
+	}
+	w.Flush()
+}
+
+// returns the result for the group in both windows' time bucket, or false if
+// neither window has it
+func compareTimeBucketResults(current ResultMap, previous ResultMap, group_key string) (*Result, *Result, bool) {
+	r, ok := current[group_key]
+	prev, prev_ok := previous[group_key]
+	if !ok && !prev_ok {
+		return nil, nil, false
+	}
+
+	if !ok {
+		r = NewResult()
+		r.GroupByKey = group_key
+	}
+
+	return r, prev, true
+}
+
+func printCompareTimeResults(querySpec *QuerySpec, sorted []*Result) {
+	keys := querySpec.timeBucketKeys("")
+	for k := range querySpec.CompareTimeResults {
+		if _, ok := querySpec.TimeResults[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Ints(keys)
+
+	bucketer := querySpec.TimeBucketer()
+
+	if *FLAGS.JSON {
+		marshalled_results := make(map[string][]ResultJSON)
+		for _, k := range keys {
+			key := strconv.FormatInt(int64(k), 10)
+			marshalled_results[key] = make([]ResultJSON, 0)
+
+			for _, top := range sorted {
+				r, prev, ok := compareTimeBucketResults(querySpec.TimeResults[k], querySpec.CompareTimeResults[k], top.GroupByKey)
+				if !ok {
+					continue
+				}
+
+				marshalled_results[key] = append(marshalled_results[key], querySpec.compareResultJSON(r, prev))
+			}
+		}
+
+		printJson(marshalled_results)
+		return
+	}
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 1, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "time\tgroup\tmetric\tcurrent\tprevious\tdelta\tpct\t")
+	for _, k := range keys {
+		time_str := bucketer.Format(int64(k), OPTS.TIME_FORMAT)
+		for _, top := range sorted {
+			r, prev, ok := compareTimeBucketResults(querySpec.TimeResults[k], querySpec.CompareTimeResults[k], top.GroupByKey)
+			if !ok {
+				continue
+			}
+
+			querySpec.printCompareRow(w, []string{time_str}, r, prev)
+		}
+	}
+	w.Flush()
+}
+
+// }}} COMPARE
@@ -48,9 +48,14 @@ func BuildFilters(t *Table, loadSpec *LoadSpec, filterSpec FilterSpec) []Filter
 		}
 
 		// we align the Time Filter to the Time Bucket iff we are doing a time series query
-		if col == *FLAGS.TIME_COL && *FLAGS.TIME {
-			bucket := int64(*FLAGS.TIME_BUCKET)
-			new_val := int64(val/bucket) * bucket
+		if col == *FLAGS.TIME_COL && FLAGS.TIME != nil && *FLAGS.TIME {
+			tz := ""
+			if FLAGS.TIME_ZONE != nil {
+				tz = *FLAGS.TIME_ZONE
+			}
+
+			bucketer := NewTimeBucketer(*FLAGS.TIME_BUCKET, OPTS.TIME_BUCKET_UNIT, tz)
+			new_val := bucketer.Bucket(val)
 
 			if val != new_val {
 				Debug("ALIGNING TIME FILTER TO BUCKET", val, new_val)
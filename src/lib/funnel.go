@@ -0,0 +1,277 @@
+package sybil
+
+import "fmt"
+import "strconv"
+import "strings"
+import "time"
+
+// {{{ FUNNELS
+
+// A funnel is a list of steps, like page=signup,page=verify,page=purchase. A
+// session reaches a step if it has events matching every step up to it, in
+// order, and (with a window) no later than the window after its first step.
+// Each session column value (the entity) reaches the furthest step of any of
+// its sessions.
+
+type FunnelStep struct {
+	Name  string
+	Col   string
+	Value string
+
+	col_ids tableColumnIds
+}
+
+// the id of a column in each table, resolved before the blocks are loaded so
+// records don't look it up one by one. a table without the column maps to -1
+type tableColumnIds map[*Table]int16
+
+func (ids tableColumnIds) resolve(t *Table, col string) {
+	id, ok := t.lookup_key_id(col)
+	if !ok {
+		id = -1
+	}
+	ids[t] = id
+}
+
+func (ids tableColumnIds) get(t *Table, col string) int16 {
+	if id, ok := ids[t]; ok {
+		return id
+	}
+
+	if id, ok := t.lookup_key_id(col); ok {
+		return id
+	}
+
+	return -1
+}
+
+type Funnel struct {
+	Steps  []FunnelStep
+	Within int64 // seconds from the first step to the last, 0 for no limit
+}
+
+type FunnelStats struct {
+	Sessions []int64
+	Entities []int64
+	Deltas   []*TDigestHist // seconds between each step and the one before it
+
+	Reached int // furthest step of an entity's sessions
+
+	funnel *Funnel
+}
+
+// ParseFunnel parses the -funnel steps and the -within window, like "1h"
+func ParseFunnel(steps string, within string) (*Funnel, error) {
+	f := Funnel{}
+
+	for _, step := range strings.Split(steps, *FLAGS.FIELD_SEPARATOR) {
+		fs, err := parseFunnelStep(step)
+		if err != nil {
+			return nil, err
+		}
+		f.Steps = append(f.Steps, fs)
+	}
+
+	if len(f.Steps) < 2 {
+		return nil, fmt.Errorf("a funnel needs at least 2 steps")
+	}
+
+	if within != "" {
+		seconds, err := ParseRelativeDuration(within)
+		if err != nil {
+			return nil, err
+		}
+		f.Within = seconds
+	}
+
+	return &f, nil
+}
+
+// parses an event like page=signup
+func parseFunnelStep(step string) (FunnelStep, error) {
+	step = strings.TrimSpace(step)
+	tokens := strings.SplitN(step, "=", 2)
+	if len(tokens) != 2 || tokens[0] == "" {
+		return FunnelStep{}, fmt.Errorf("invalid event, expected col=value: %s", step)
+	}
+
+	return FunnelStep{Name: step, Col: tokens[0], Value: tokens[1], col_ids: make(tableColumnIds)}, nil
+}
+
+func (f *Funnel) resolveColumns(t *Table) {
+	for _, step := range f.Steps {
+		step.resolveColumn(t)
+	}
+}
+
+func (s FunnelStep) resolveColumn(t *Table) {
+	if s.col_ids != nil {
+		s.col_ids.resolve(t, s.Col)
+	}
+}
+
+func (f *Funnel) loadColumns(t *Table, loadSpec *LoadSpec) {
+	for _, step := range f.Steps {
+		step.loadColumn(t, loadSpec)
+	}
+}
+
+func (s FunnelStep) loadColumn(t *Table, loadSpec *LoadSpec) {
+	col_id, ok := t.KeyTable[s.Col]
+	if !ok {
+		return
+	}
+
+	switch t.KeyTypes[col_id] {
+	case INT_VAL:
+		loadSpec.Int(s.Col)
+	case STR_VAL:
+		loadSpec.Str(s.Col)
+	}
+}
+
+func (s FunnelStep) matches(r *Record) bool {
+	field_id := s.col_ids.get(r.block.table, s.Col)
+	if field_id < 0 || int(field_id) >= len(r.Populated) {
+		return false
+	}
+
+	switch r.Populated[field_id] {
+	case INT_VAL:
+		return strconv.FormatInt(int64(r.Ints[field_id]), 10) == s.Value
+	case STR_VAL:
+		col := r.block.GetColumnInfo(field_id)
+		return col.get_string_for_val(int32(r.Strs[field_id])) == s.Value
+	}
+
+	return false
+}
+
+// Match returns the times of each step reached by the time sorted records,
+// for the chain of steps that gets furthest into the funnel
+func (f *Funnel) Match(records RecordList) []int64 {
+	// chains[i] reached step i and started the latest, which leaves the most
+	// room in the window for the next steps
+	chains := make([][]int64, len(f.Steps))
+
+	for _, r := range records {
+		// going backwards, so one event doesn't count as two steps
+		for i := len(f.Steps) - 1; i >= 0; i-- {
+			if !f.Steps[i].matches(r) {
+				continue
+			}
+
+			if i == 0 {
+				chains[0] = []int64{r.Timestamp}
+				continue
+			}
+
+			prev := chains[i-1]
+			if prev == nil || (f.Within > 0 && r.Timestamp-prev[0] > f.Within) {
+				continue
+			}
+
+			if chains[i] == nil || prev[0] > chains[i][0] {
+				chain := make([]int64, i, i+1)
+				copy(chain, prev)
+				chains[i] = append(chain, r.Timestamp)
+			}
+		}
+	}
+
+	for i := len(chains) - 1; i >= 0; i-- {
+		if chains[i] != nil {
+			return chains[i]
+		}
+	}
+
+	return nil
+}
+
+func NewFunnelStats(f *Funnel) *FunnelStats {
+	fs := FunnelStats{funnel: f}
+	fs.Sessions = make([]int64, len(f.Steps))
+	fs.Entities = make([]int64, len(f.Steps))
+	fs.Deltas = make([]*TDigestHist, len(f.Steps))
+	for i := 1; i < len(f.Steps); i++ {
+		fs.Deltas[i] = newTDigestHist()
+		fs.Deltas[i].TrackPercentiles()
+	}
+
+	return &fs
+}
+
+func (fs *FunnelStats) SummarizeSession(records RecordList) {
+	chain := fs.funnel.Match(records)
+
+	for i := range chain {
+		fs.Sessions[i]++
+		if i > 0 {
+			fs.Deltas[i].RecordValues(chain[i]-chain[i-1], 1)
+		}
+	}
+
+	if len(chain) > fs.Reached {
+		fs.Reached = len(chain)
+	}
+}
+
+// CombineFunnel adds an entity's (or a group's) funnel to this one
+func (fs *FunnelStats) CombineFunnel(other *FunnelStats) {
+	for i := range fs.Sessions {
+		fs.Sessions[i] += other.Sessions[i]
+		fs.Entities[i] += other.Entities[i]
+		if i < other.Reached {
+			fs.Entities[i]++
+		}
+
+		if i > 0 {
+			fs.Deltas[i].Combine(other.Deltas[i])
+		}
+	}
+}
+
+func percentOf(count int64, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+
+	return float64(count) * 100 / float64(total)
+}
+
+func (fs *FunnelStats) PrintFunnel() {
+	fmt.Printf("  funnel:\n")
+	for i, step := range fs.funnel.Steps {
+		fmt.Printf("    %d. %-24s %8d sessions %8d entities %6.1f%%", i+1, step.Name, fs.Sessions[i], fs.Entities[i], percentOf(fs.Sessions[i], fs.Sessions[0]))
+		if i > 0 {
+			fmt.Printf(" (%.1f%% of previous)", percentOf(fs.Sessions[i], fs.Sessions[i-1]))
+			if fs.Deltas[i].TotalCount() > 0 {
+				median := time.Duration(fs.Deltas[i].GetPercentile(50)) * time.Second
+				fmt.Printf(", median %s", median)
+			}
+		}
+		fmt.Printf("\n")
+	}
+}
+
+func (fs *FunnelStats) toJSON() []map[string]interface{} {
+	steps := make([]map[string]interface{}, 0)
+	for i, step := range fs.funnel.Steps {
+		info := make(map[string]interface{})
+		info["step"] = step.Name
+		info["sessions"] = fs.Sessions[i]
+		info["entities"] = fs.Entities[i]
+		info["conversion"] = percentOf(fs.Sessions[i], fs.Sessions[0])
+		if i > 0 {
+			info["step_conversion"] = percentOf(fs.Sessions[i], fs.Sessions[i-1])
+			if fs.Deltas[i].TotalCount() > 0 {
+				info["median_seconds"] = fs.Deltas[i].GetPercentile(50)
+			}
+		}
+		steps = append(steps, info)
+	}
+
+	return steps
+}
+
+// }}} FUNNELS
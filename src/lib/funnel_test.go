@@ -0,0 +1,88 @@
+package sybil_test
+
+import sybil "./"
+
+import "sort"
+import "testing"
+
+func TestFunnels(test *testing.T) {
+	delete_test_db()
+
+	time_col, prev_time_col := "time", sybil.FLAGS.TIME_COL
+	sybil.FLAGS.TIME_COL = &time_col
+	defer func() { sybil.FLAGS.TIME_COL = prev_time_col }()
+
+	// 10 USERS WITH 10 EVENTS A MINUTE APART. EVERY USER SIGNS UP, EVEN
+	// USERS VERIFY 2 MINUTES LATER AND EVERY FOURTH USER PURCHASES AT THE END
+	add_records(func(r *sybil.Record, index int) {
+		user, pos := index/10, index%10
+
+		page := "home"
+		switch {
+		case pos == 0:
+			page = "signup"
+		case pos == 2 && user%2 == 0:
+			page = "verify"
+		case pos == 9 && user%4 == 0:
+			page = "purchase"
+		}
+
+		r.AddIntField("time", int64(index*60))
+		r.AddIntField("user", int64(user))
+		r.AddStrField("page", page)
+	}, 1)
+
+	nt := save_and_reload_table(test, 1)
+
+	sessions := make(map[int64]sybil.RecordList)
+	user_id := nt.KeyTable["user"]
+	for _, b := range nt.BlockList {
+		for _, r := range b.RecordList {
+			user := int64(r.Ints[user_id])
+			sessions[user] = append(sessions[user], r)
+		}
+	}
+
+	for _, within := range []string{"", "5m"} {
+		funnel, err := sybil.ParseFunnel("page=signup,page=verify,page=purchase", within)
+		if err != nil {
+			test.Fatal("COULDNT PARSE FUNNEL", err)
+		}
+
+		stats := sybil.NewFunnelStats(funnel)
+		for _, records := range sessions {
+			sort.Sort(sybil.SortRecordsByTime{records})
+
+			entity := sybil.NewFunnelStats(funnel)
+			entity.SummarizeSession(records)
+			stats.CombineFunnel(entity)
+		}
+
+		purchases := int64(3)
+		if within != "" {
+			purchases = 0
+		}
+
+		if stats.Sessions[0] != 10 || stats.Sessions[1] != 5 || stats.Sessions[2] != purchases {
+			test.Error("WRONG FUNNEL COUNTS WITHIN", within, stats.Sessions)
+		}
+
+		if stats.Entities[2] != stats.Sessions[2] {
+			test.Error("WRONG FUNNEL ENTITIES WITHIN", within, stats.Entities)
+		}
+
+		if median := stats.Deltas[1].GetPercentile(50); median != 120 {
+			test.Error("EXPECTED 2 MINUTES TO VERIFY, GOT", median)
+		}
+	}
+
+	if _, err := sybil.ParseFunnel("page=signup", ""); err == nil {
+		test.Error("PARSED A FUNNEL WITH ONE STEP")
+	}
+
+	if _, err := sybil.ParseFunnel("page=signup,page", ""); err == nil {
+		test.Error("PARSED A FUNNEL STEP WITHOUT A VALUE")
+	}
+
+	delete_test_db()
+}
@@ -0,0 +1,186 @@
+package sybil
+
+import "fmt"
+import "math"
+import "math/bits"
+import "regexp"
+import "sort"
+import "strconv"
+import "strings"
+import "time"
+
+// {{{ GROUPING FUNCTIONS
+
+// Groups can be computed from an int column per record, like hour(time) or
+// dow(time). The time functions use the query's time zone.
+//
+// hour(col)	hour of the day, 0 - 23
+// dow(col)	day of the week, 0-Sun - 6-Sat
+// date(col)	the date, 2006-01-02
+// month(col)	the month, 2006-01
+//
+// Ints can also be bucketed into ranges, which print like [100,200):
+//
+// col:bucket=N	buckets of N
+// col:log2	powers of two
+// col:buckets=a;b;c	explicit boundaries, with open ended first and last buckets
+
+var groupingFunc = regexp.MustCompile(`^(\w+)\((.+)\)$`)
+
+var TIME_GROUPING_FUNCS = map[string]bool{
+	"hour":  true,
+	"dow":   true,
+	"date":  true,
+	"month": true,
+}
+
+var BUCKET_GROUPING_FUNCS = map[string]bool{
+	"bucket":  true,
+	"log2":    true,
+	"buckets": true,
+}
+
+// ParseGroupingFunc splits a group like "hour(time)" or "latency:bucket=100"
+// into its function and column. Plain columns have no function.
+func ParseGroupingFunc(name string) (string, string) {
+	tokens := groupingFunc.FindStringSubmatch(name)
+	if tokens != nil && TIME_GROUPING_FUNCS[tokens[1]] {
+		return tokens[1], tokens[2]
+	}
+
+	sep := strings.LastIndex(name, *FLAGS.FILTER_SEPARATOR)
+	if sep > 0 {
+		fn := name[sep+len(*FLAGS.FILTER_SEPARATOR):]
+		if BUCKET_GROUPING_FUNCS[strings.SplitN(fn, "=", 2)[0]] {
+			return fn, name[:sep]
+		}
+	}
+
+	return "", name
+}
+
+// ParseGroupingArgs splits a grouping function like "bucket=100" into its
+// name and int arguments
+func ParseGroupingArgs(fn string) (string, []int64, error) {
+	tokens := strings.SplitN(fn, "=", 2)
+	name := tokens[0]
+
+	args := make([]int64, 0)
+	if len(tokens) == 2 {
+		for _, arg := range strings.Split(tokens[1], ";") {
+			val, err := strconv.ParseInt(strings.TrimSpace(arg), 10, 64)
+			if err != nil {
+				return name, nil, fmt.Errorf("invalid argument for %s: %s", name, arg)
+			}
+			args = append(args, val)
+		}
+	}
+
+	switch name {
+	case "bucket":
+		if len(args) != 1 || args[0] <= 0 {
+			return name, nil, fmt.Errorf("bucket needs a size above 0, like bucket=100")
+		}
+	case "buckets":
+		if len(args) == 0 {
+			return name, nil, fmt.Errorf("buckets needs boundaries, like buckets=10;100;1000")
+		}
+		for i := 1; i < len(args); i++ {
+			if args[i] <= args[i-1] {
+				return name, nil, fmt.Errorf("bucket boundaries have to be increasing: %s", tokens[1])
+			}
+		}
+	default:
+		if len(args) > 0 {
+			return name, nil, fmt.Errorf("%s doesn't take arguments", name)
+		}
+	}
+
+	return name, args, nil
+}
+
+func (g Grouping) localTime(ts int64, loc *time.Location) int64 {
+	if loc == nil {
+		return ts
+	}
+
+	_, offset := time.Unix(ts, 0).In(loc).Zone()
+	return ts + int64(offset)
+}
+
+// computes the grouping function's value for an int
+func (g Grouping) apply(val int64, loc *time.Location) int64 {
+	switch g.Func {
+	case "hour":
+		return floorMod(floorDiv(g.localTime(val, loc), 3600), 24)
+	case "dow":
+		// the epoch was a thursday
+		return floorMod(floorDiv(g.localTime(val, loc), SECONDS_PER_DAY)+4, 7)
+	case "date":
+		return floorDiv(g.localTime(val, loc), SECONDS_PER_DAY)
+	case "month":
+		t := time.Unix(g.localTime(val, loc), 0).UTC()
+		return int64(t.Year())*12 + int64(t.Month()) - 1
+	case "bucket":
+		return floorDiv(val, g.Args[0]) * g.Args[0]
+	case "log2":
+		// everything below 1 goes into bucket 0
+		if val < 1 {
+			return 0
+		}
+		return 1 << uint(bits.Len64(uint64(val))-1)
+	case "buckets":
+		// the number of boundaries at or below the value
+		return int64(sort.Search(len(g.Args), func(i int) bool { return g.Args[i] > val }))
+	}
+
+	return val
+}
+
+// formats a value computed by apply
+func (g Grouping) format(val int64) string {
+	switch g.Func {
+	case "hour":
+		return strconv.FormatInt(val, 10)
+	case "dow":
+		return strconv.FormatInt(val, 10) + "-" + time.Weekday(val).String()[:3]
+	case "date":
+		return time.Unix(val*SECONDS_PER_DAY, 0).UTC().Format("2006-01-02")
+	case "month":
+		return time.Date(int(floorDiv(val, 12)), time.Month(floorMod(val, 12)+1), 1, 0, 0, 0, 0, time.UTC).Format("2006-01")
+	case "bucket":
+		return fmt.Sprintf("[%d,%d)", val, val+g.Args[0])
+	case "log2":
+		if val == 0 {
+			return "(-inf,1)"
+		}
+		return fmt.Sprintf("[%d,%d)", val, val*2)
+	case "buckets":
+		switch {
+		case val == 0:
+			return fmt.Sprintf("(-inf,%d)", g.Args[0])
+		case int(val) == len(g.Args):
+			return fmt.Sprintf("[%d,inf)", g.Args[val-1])
+		}
+		return fmt.Sprintf("[%d,%d)", g.Args[val-1], g.Args[val])
+	}
+
+	return strconv.FormatInt(val, 10)
+}
+
+// the lower bound of a bucket's range, for sorting groups
+func rangeLowerBound(val string) (float64, bool) {
+	if strings.HasPrefix(val, "(-inf,") {
+		return math.Inf(-1), true
+	}
+
+	comma := strings.Index(val, ",")
+	if !strings.HasPrefix(val, "[") || comma < 0 {
+		return 0, false
+	}
+
+	lower, err := strconv.ParseInt(val[1:comma], 10, 64)
+	return float64(lower), err == nil
+}
+
+// }}} GROUPING FUNCTIONS
@@ -0,0 +1,160 @@
+package sybil
+
+import "fmt"
+import "regexp"
+import "strconv"
+import "strings"
+
+// {{{ HAVING
+
+// A HavingCond filters aggregated results after they are combined, like the
+// HAVING clause in SQL. Conditions look like "count > 100" or
+// "latency.avg > 500" and are joined with AND.
+type HavingCond struct {
+	Col    string
+	Metric string
+	Op     string
+	Value  float64
+}
+
+var havingAnd = regexp.MustCompile(`(?i)\s+and\s+`)
+var havingCond = regexp.MustCompile(`^\s*(\S+?)\s*(>=|<=|!=|==|=|>|<)\s*(\S+)\s*$`)
+
+// ParseHaving parses the having conditions of a query with the given
+// aggregations, every condition has to be on the count or an aggregated column
+func ParseHaving(having string, aggs []Aggregation) ([]HavingCond, error) {
+	conds, err := parseHavingConds(having)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cond := range conds {
+		if cond.Col == OPTS.SORT_COUNT {
+			continue
+		}
+
+		aggregated := false
+		for _, a := range aggs {
+			if a.Name == cond.Col {
+				aggregated = true
+				break
+			}
+		}
+
+		if !aggregated {
+			return nil, fmt.Errorf("can't filter on %s, it isn't aggregated", cond.Col)
+		}
+	}
+
+	return conds, nil
+}
+
+// HavingKeys returns the columns and metrics the having conditions read, so
+// they can be aggregated before the conditions are parsed with ParseHaving
+func HavingKeys(having string) ([]OrderKey, error) {
+	conds, err := parseHavingConds(having)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]OrderKey, len(conds))
+	for i, cond := range conds {
+		keys[i] = OrderKey{Col: cond.Col, Metric: cond.Metric}
+	}
+
+	return keys, nil
+}
+
+func parseHavingConds(having string) ([]HavingCond, error) {
+	conds := make([]HavingCond, 0)
+	if strings.TrimSpace(having) == "" {
+		return conds, nil
+	}
+
+	for _, clause := range havingAnd.Split(having, -1) {
+		tokens := havingCond.FindStringSubmatch(clause)
+		if tokens == nil {
+			return nil, fmt.Errorf("invalid having condition: %s", clause)
+		}
+
+		val, err := strconv.ParseFloat(tokens[3], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid having value: %s", tokens[3])
+		}
+
+		cond := HavingCond{Op: tokens[2], Value: val}
+		if tokens[1] == "count" || tokens[1] == OPTS.SORT_COUNT {
+			cond.Col = OPTS.SORT_COUNT
+		} else if isDistinctMetric(tokens[1]) {
+			return nil, fmt.Errorf("can't filter on distinct values: %s", tokens[1])
+		} else {
+			cond.Col, cond.Metric = ParseSortCol(tokens[1])
+		}
+
+		conds = append(conds, cond)
+	}
+
+	return conds, nil
+}
+
+// a result without a histogram for the column fails the condition
+func (c HavingCond) Matches(r *Result) bool {
+	val := float64(r.Count)
+	if c.Col != OPTS.SORT_COUNT {
+		if _, ok := r.Hists[c.Col]; !ok {
+			return false
+		}
+		val = r.metricValue(c.Col, c.Metric)
+	}
+
+	switch c.Op {
+	case ">":
+		return val > c.Value
+	case ">=":
+		return val >= c.Value
+	case "<":
+		return val < c.Value
+	case "<=":
+		return val <= c.Value
+	case "=", "==":
+		return val == c.Value
+	case "!=":
+		return val != c.Value
+	}
+
+	return false
+}
+
+func matchesHaving(conds []HavingCond, r *Result) bool {
+	for _, c := range conds {
+		if !c.Matches(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// removes the results that don't pass the having conditions. the cumulative
+// result is left alone, it still describes every matched record
+func (querySpec *QuerySpec) ApplyHaving() {
+	if len(querySpec.Having) == 0 {
+		return
+	}
+
+	for k, r := range querySpec.Results {
+		if !matchesHaving(querySpec.Having, r) {
+			delete(querySpec.Results, k)
+		}
+	}
+
+	for _, results := range querySpec.TimeResults {
+		for k, r := range results {
+			if !matchesHaving(querySpec.Having, r) {
+				delete(results, k)
+			}
+		}
+	}
+}
+
+// }}} HAVING
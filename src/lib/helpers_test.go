@@ -95,3 +95,25 @@ func delete_test_db() {
 	os.RemoveAll(fmt.Sprintf("db/%s", TEST_TABLE_NAME))
 	unload_test_table()
 }
+
+// sets the flags the session command needs, sessionizing by the session
+// column. call the returned func to reset them
+func setup_session_flags(session_col string) func() {
+	prev := sybil.FLAGS
+
+	time_col, cutoff, path_length, max_events, max_length := "time", 60, 3, 0, 0
+	sybil.FLAGS.TIME_COL = &time_col
+	sybil.FLAGS.SESSION_COL = &session_col
+	sybil.FLAGS.SESSION_CUTOFF = &cutoff
+	sybil.FLAGS.PATH_KEY = &sybil.EMPTY
+	sybil.FLAGS.PATH_LENGTH = &path_length
+	sybil.FLAGS.SESSION_MAX_EVENTS = &max_events
+	sybil.FLAGS.SESSION_MAX_LENGTH = &max_length
+	sybil.FLAGS.JOIN_TABLE = &sybil.EMPTY
+	sybil.FLAGS.RETENTION = &sybil.FALSE
+	sybil.FLAGS.INT_FILTERS = &sybil.EMPTY
+	sybil.FLAGS.STR_FILTERS = &sybil.EMPTY
+	sybil.FLAGS.SET_FILTERS = &sybil.EMPTY
+
+	return func() { sybil.FLAGS = prev }
+}
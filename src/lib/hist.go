@@ -1,11 +1,15 @@
 package sybil
 
+import "sort"
+import "strconv"
+
 var NUM_BUCKETS = 1000
 var DEBUG_OUTLIERS = false
 
 // histogram types:
 // HDRHist (wrapper around github.com/codahale/hdrhistogram which implements Histogram interface)
 // BasicHist (which gets wrapped in HistCompat to implement the Histogram interface)
+// TDigestHist (mergeable sketch that needs no min / max, see hist_tdigest.go)
 
 type Histogram interface {
 	Mean() float64
@@ -15,6 +19,7 @@ type Histogram interface {
 
 	RecordValues(int64, int64) error
 	GetPercentiles() []int64
+	GetPercentile(float64) int64
 	GetBuckets() map[string]int64
 	StdDev() float64
 	NewHist() Histogram
@@ -26,6 +31,8 @@ func (t *Table) NewHist(info *IntInfo) Histogram {
 	var hist Histogram
 	if *FLAGS.HDR_HIST && ENABLE_HDR {
 		hist = newHDRHist(t, info)
+	} else if *FLAGS.TDIGEST_HIST {
+		hist = t.NewTDigestHist(info)
 	} else if *FLAGS.LOG_HIST {
 		hist = t.NewMultiHist(info)
 	} else {
@@ -34,3 +41,95 @@ func (t *Table) NewHist(info *IntInfo) Histogram {
 
 	return hist
 }
+
+// picks the histogram kind for an aggregation up front, so that every block
+// builds the same kind of hist and their results can be combined. columns
+// without any IntInfo can't be bucketed, so they get a t-digest
+func (t *Table) histType(col_id int16) string {
+	if *FLAGS.HDR_HIST && ENABLE_HDR {
+		return "hdr"
+	}
+
+	if *FLAGS.TDIGEST_HIST || t.get_int_info(col_id) == nil {
+		return "tdigest"
+	}
+
+	if *FLAGS.LOG_HIST {
+		return "multi"
+	}
+
+	return "basic"
+}
+
+// NewAggHist builds the histogram kind that the aggregation picked
+func (t *Table) NewAggHist(a Aggregation, info *IntInfo) Histogram {
+	hist_type := a.HistType
+	if hist_type == "" {
+		hist_type = t.histType(a.name_id)
+	}
+
+	switch hist_type {
+	case "hdr":
+		return newHDRHist(t, info)
+	case "tdigest":
+		return t.NewTDigestHist(info)
+	case "multi":
+		return t.NewMultiHist(info)
+	}
+
+	return t.NewBasicHist(info)
+}
+
+// returns the value at percentile p (0 - 100) of a sparse bucket -> count map
+func percentile_from_buckets(buckets map[int64]int64, p float64) int64 {
+	keys := make([]int64, 0, len(buckets))
+	total := int64(0)
+	for k, count := range buckets {
+		if count > 0 {
+			keys = append(keys, k)
+			total += count
+		}
+	}
+
+	if total == 0 {
+		return 0
+	}
+
+	sort.Sort(sortInt64s(keys))
+
+	target := p / 100 * float64(total)
+	count := int64(0)
+	for _, k := range keys {
+		count += buckets[k]
+		if float64(count) > target {
+			return k
+		}
+	}
+
+	return keys[len(keys)-1]
+}
+
+type sortInt64s []int64
+
+func (a sortInt64s) Len() int           { return len(a) }
+func (a sortInt64s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a sortInt64s) Less(i, j int) bool { return a[i] < a[j] }
+
+// percentiles are named like p50, p99 and p99.9
+func PercentileName(p float64) string {
+	return "p" + strconv.FormatFloat(p, 'f', -1, 64)
+}
+
+// parses the metric half of a percentile name (p99.9 -> 99.9)
+func ParsePercentileName(name string) (float64, bool) {
+	if len(name) < 2 || name[0] != 'p' {
+		return 0, false
+	}
+
+	p, err := strconv.ParseFloat(name[1:], 64)
+	if err != nil || p < 0 || p > 100 {
+		return 0, false
+	}
+
+	return p, true
+}
@@ -1,5 +1,6 @@
 package sybil
 
+import "fmt"
 import "log"
 import "math"
 import "sort"
@@ -182,6 +183,14 @@ func (h *BasicHist) GetPercentiles() []int64 {
 	return percentiles[:100]
 }
 
+func (h *BasicHist) GetPercentile(p float64) int64 {
+	if h.Count == 0 {
+		return 0
+	}
+
+	return percentile_from_buckets(h.GetSparseBuckets(), p)
+}
+
 // VARIANCE is defined as the squared error from the mean
 func (h *BasicHist) GetVariance() float64 {
 	std := h.GetStdDev()
@@ -257,21 +266,32 @@ func (h *BasicHist) GetBuckets() map[string]int64 {
 }
 
 func (h *BasicHist) Combine(oh interface{}) {
-	next_hist := oh.(*HistCompat)
+	var next_hist *BasicHist
+	switch oh := oh.(type) {
+	case *HistCompat:
+		next_hist = oh.BasicHist
+	case *BasicHist:
+		next_hist = oh
+	default:
+		Error("CAN'T COMBINE BASIC HIST WITH", fmt.Sprintf("%T", oh))
+	}
 
 	for k, v := range next_hist.Values {
 		h.Values[k] += v
 	}
 
 	total := h.Count + next_hist.Count
+	if total == 0 {
+		return
+	}
 	h.Avg = (h.Avg * (float64(h.Count) / float64(total))) + (next_hist.Avg * (float64(next_hist.Count) / float64(total)))
 
-	if h.Min > next_hist.Min() {
-		h.Min = next_hist.Min()
+	if h.Min > next_hist.Min {
+		h.Min = next_hist.Min
 	}
 
-	if h.Max < next_hist.Max() {
-		h.Max = next_hist.Max()
+	if h.Max < next_hist.Max {
+		h.Max = next_hist.Max
 	}
 
 	h.Samples = h.Samples + next_hist.Samples
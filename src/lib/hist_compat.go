@@ -16,7 +16,7 @@ func (hc *HistCompat) Max() int64 {
 }
 
 func (hc *HistCompat) NewHist() Histogram {
-	return hc.table.NewHist(&hc.Info)
+	return hc.table.NewBasicHist(&hc.Info)
 }
 
 func (h *HistCompat) Mean() float64 {
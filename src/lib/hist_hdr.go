@@ -53,6 +53,10 @@ func (th *HDRHist) GetPercentiles() []int64 {
 	return ret
 }
 
+func (th *HDRHist) GetPercentile(p float64) int64 {
+	return th.ValueAtQuantile(p)
+}
+
 func (th *HDRHist) GetBuckets() map[string]int64 {
 	ret := make(map[string]int64)
 	for _, v := range th.Distribution() {
@@ -130,6 +130,14 @@ func (h *MultiHist) GetPercentiles() []int64 {
 	return percentiles[:100]
 }
 
+func (h *MultiHist) GetPercentile(p float64) int64 {
+	if h.Count == 0 {
+		return 0
+	}
+
+	return percentile_from_buckets(h.GetSparseBuckets(), p)
+}
+
 func (h *MultiHist) GetMeanVariance() float64 {
 	return h.GetVariance() / float64(h.Count)
 }
@@ -0,0 +1,301 @@
+package sybil
+
+import "fmt"
+import "math"
+import "sort"
+import "strconv"
+
+// {{{ TDIGEST HIST
+
+// The TDigestHist is a mergeable sketch (https://github.com/tdunning/t-digest)
+// that keeps a bounded number of weighted centroids. Unlike the BasicHist, it
+// does not need the column's min and max up front and it doesn't discard
+// outliers, so it can be used for columns without any IntInfo.
+//
+// Its error is bounded in rank, not in value: a centroid near quantile q holds
+// at most 4 * N * q * (1 - q) / compression samples, so estimates are tightest
+// at the tails and loosest around the median. There is no bound on the
+// relative error of the returned value - a sparse or bimodal column can be
+// off by the gap between two neighbouring centroids.
+
+var TDIGEST_COMPRESSION = float64(100)
+var TDIGEST_BUFFER_FACTOR = 5
+
+type TDigestCentroid struct {
+	Mean  float64
+	Count int64
+}
+
+type TDigestHist struct {
+	Centroids   []TDigestCentroid
+	Unmerged    []TDigestCentroid
+	Compression float64
+
+	MinValue int64
+	MaxValue int64
+	Samples  int
+	Count    int64
+	Avg      float64
+	M2       float64 // used for calculating variance, expressed as M2 / Count
+
+	PercentileMode bool
+}
+
+func newTDigestHist() *TDigestHist {
+	h := TDigestHist{}
+	h.Compression = TDIGEST_COMPRESSION
+	h.MinValue = math.MaxInt64
+	h.MaxValue = math.MinInt64
+
+	if FLAGS.OP != nil && *FLAGS.OP == "hist" {
+		h.TrackPercentiles()
+	}
+
+	return &h
+}
+
+func (t *Table) NewTDigestHist(info *IntInfo) *TDigestHist {
+	return newTDigestHist()
+}
+
+func (h *TDigestHist) TrackPercentiles() {
+	h.PercentileMode = true
+}
+
+func (h *TDigestHist) NewHist() Histogram {
+	nh := newTDigestHist()
+	nh.Compression = h.Compression
+	nh.PercentileMode = h.PercentileMode
+	return nh
+}
+
+func (h *TDigestHist) Mean() float64 {
+	return h.Avg
+}
+
+func (h *TDigestHist) Min() int64 {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.MinValue
+}
+
+func (h *TDigestHist) Max() int64 {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.MaxValue
+}
+
+func (h *TDigestHist) TotalCount() int64 {
+	return h.Count
+}
+
+func (h *TDigestHist) Sum() int64 {
+	return int64(h.Avg * float64(h.Count))
+}
+
+func (h *TDigestHist) GetVariance() float64 {
+	if h.Count == 0 {
+		return 0
+	}
+
+	return h.M2 / float64(h.Count)
+}
+
+func (h *TDigestHist) StdDev() float64 {
+	return math.Sqrt(h.GetVariance())
+}
+
+func (h *TDigestHist) RecordValues(value int64, weight int64) error {
+	if weight <= 0 {
+		return nil
+	}
+
+	h.Samples++
+	h.Count += weight
+
+	// weighted online variance (West, 1979)
+	delta := float64(value) - h.Avg
+	h.Avg = h.Avg + delta*float64(weight)/float64(h.Count)
+	h.M2 = h.M2 + float64(weight)*delta*(float64(value)-h.Avg)
+
+	if value < h.MinValue {
+		h.MinValue = value
+	}
+
+	if value > h.MaxValue {
+		h.MaxValue = value
+	}
+
+	if !h.PercentileMode {
+		return nil
+	}
+
+	h.Unmerged = append(h.Unmerged, TDigestCentroid{float64(value), weight})
+	if len(h.Unmerged) > int(h.Compression)*TDIGEST_BUFFER_FACTOR {
+		h.compress()
+	}
+
+	return nil
+}
+
+type sortCentroidsByMean []TDigestCentroid
+
+func (a sortCentroidsByMean) Len() int           { return len(a) }
+func (a sortCentroidsByMean) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a sortCentroidsByMean) Less(i, j int) bool { return a[i].Mean < a[j].Mean }
+
+// folds the unmerged buffer into the centroid list, keeping each centroid
+// under the size bound of 4 * N * q * (1 - q) / compression
+func (h *TDigestHist) compress() {
+	if len(h.Unmerged) == 0 {
+		return
+	}
+
+	all := make([]TDigestCentroid, 0, len(h.Centroids)+len(h.Unmerged))
+	all = append(all, h.Centroids...)
+	all = append(all, h.Unmerged...)
+	sort.Sort(sortCentroidsByMean(all))
+
+	total := float64(0)
+	for _, c := range all {
+		total += float64(c.Count)
+	}
+
+	merged := make([]TDigestCentroid, 0, int(h.Compression)*2)
+	cur := all[0]
+	so_far := float64(0)
+	for _, c := range all[1:] {
+		proposed := float64(cur.Count + c.Count)
+		q := (so_far + proposed/2) / total
+		bound := math.Max(1, 4*total*q*(1-q)/h.Compression)
+
+		if proposed <= bound {
+			cur.Mean = cur.Mean + (c.Mean-cur.Mean)*float64(c.Count)/proposed
+			cur.Count += c.Count
+		} else {
+			merged = append(merged, cur)
+			so_far += float64(cur.Count)
+			cur = c
+		}
+	}
+	merged = append(merged, cur)
+
+	h.Centroids = merged
+	h.Unmerged = h.Unmerged[:0]
+}
+
+// Quantile returns the estimated value at quantile q (0 <= q <= 1), linearly
+// interpolating between centroid centers and the observed extrema
+func (h *TDigestHist) Quantile(q float64) float64 {
+	h.compress()
+
+	if h.Count == 0 || len(h.Centroids) == 0 {
+		return 0
+	}
+
+	if q <= 0 {
+		return float64(h.MinValue)
+	}
+
+	if q >= 1 {
+		return float64(h.MaxValue)
+	}
+
+	total := float64(0)
+	for _, c := range h.Centroids {
+		total += float64(c.Count)
+	}
+
+	target := q * total
+	prev_center := float64(0)
+	prev_mean := float64(h.MinValue)
+	cumulative := float64(0)
+	for _, c := range h.Centroids {
+		center := cumulative + float64(c.Count)/2
+		if target < center {
+			frac := (target - prev_center) / (center - prev_center)
+			return prev_mean + frac*(c.Mean-prev_mean)
+		}
+
+		prev_center = center
+		prev_mean = c.Mean
+		cumulative += float64(c.Count)
+	}
+
+	if total <= prev_center {
+		return float64(h.MaxValue)
+	}
+
+	frac := (target - prev_center) / (total - prev_center)
+	return prev_mean + frac*(float64(h.MaxValue)-prev_mean)
+}
+
+func (h *TDigestHist) GetPercentiles() []int64 {
+	if h.Count == 0 {
+		return make([]int64, 0)
+	}
+
+	percentiles := make([]int64, 100)
+	for i := 0; i < 100; i++ {
+		percentiles[i] = int64(math.Floor(h.Quantile(float64(i)/100) + 0.5))
+	}
+
+	return percentiles
+}
+
+func (h *TDigestHist) GetPercentile(p float64) int64 {
+	if h.Count == 0 {
+		return 0
+	}
+
+	return int64(math.Floor(h.Quantile(p/100) + 0.5))
+}
+
+func (h *TDigestHist) GetBuckets() map[string]int64 {
+	h.compress()
+
+	ret := make(map[string]int64)
+	for _, c := range h.Centroids {
+		ret[strconv.FormatInt(int64(math.Floor(c.Mean+0.5)), 10)] += c.Count
+	}
+
+	return ret
+}
+
+func (h *TDigestHist) Combine(oh interface{}) {
+	next_hist, ok := oh.(*TDigestHist)
+	if !ok {
+		Error("CAN'T COMBINE T-DIGEST WITH", fmt.Sprintf("%T", oh))
+	}
+
+	if next_hist.Count == 0 {
+		return
+	}
+
+	total := h.Count + next_hist.Count
+	delta := next_hist.Avg - h.Avg
+	h.Avg = h.Avg + delta*float64(next_hist.Count)/float64(total)
+	h.M2 = h.M2 + next_hist.M2 + delta*delta*float64(h.Count)*float64(next_hist.Count)/float64(total)
+
+	if next_hist.MinValue < h.MinValue {
+		h.MinValue = next_hist.MinValue
+	}
+
+	if next_hist.MaxValue > h.MaxValue {
+		h.MaxValue = next_hist.MaxValue
+	}
+
+	h.Samples = h.Samples + next_hist.Samples
+	h.Count = total
+
+	h.Unmerged = append(h.Unmerged, next_hist.Centroids...)
+	h.Unmerged = append(h.Unmerged, next_hist.Unmerged...)
+	if len(next_hist.Centroids) > 0 || len(next_hist.Unmerged) > 0 {
+		h.PercentileMode = true
+	}
+	h.compress()
+}
+
+// }}} TDIGEST HIST
@@ -1,10 +1,14 @@
 package sybil
 
 
+import "fmt"
 import "strconv"
 
 func (t *Table) BuildJoinMap() {
-	joinkey := *FLAGS.JOIN_KEY
+	t.buildJoinMap(*FLAGS.JOIN_KEY)
+}
+
+func (t *Table) buildJoinMap(joinkey string) {
 	joinid := t.get_key_id(joinkey)
 
 	t.join_lookup = make(map[string]*Record)
@@ -27,6 +31,10 @@ func (t *Table) BuildJoinMap() {
 		}
 	}
 
+	if t.RowBlock == nil {
+		return
+	}
+
 	Debug("ROWS", len(t.RowBlock.RecordList))
 	for _, r := range t.RowBlock.RecordList {
 		switch r.Populated[joinid] {
@@ -47,3 +55,46 @@ func (t *Table) GetRecordById(id string) *Record {
 
 	return t.join_lookup[id]
 }
+
+// LoadJoinTable loads a lookup table into memory and maps its records by the
+// join key, for lookup() in virtual columns. Tables with more than max_rows
+// records are refused, since all of them are held in memory.
+func LoadJoinTable(name string, joinkey string, max_rows int) (*Table, error) {
+	jt := GetTable(name)
+	if jt.IsNotExist() {
+		return nil, fmt.Errorf("join table %s does not exist in %s", name, *FLAGS.DIR)
+	}
+
+	jt.LoadTableInfo()
+
+	// WITHOUT A LOAD SPEC ONLY THE BLOCK INFOS ARE READ, SO THE RECORDS THAT
+	// COME BACK ARE THE INGESTION LOG'S (WITH -read-log)
+	rows := jt.LoadRecords(nil)
+	for _, b := range jt.BlockList {
+		if b.Name != ROW_STORE_BLOCK {
+			rows += int(b.Info.NumRecords)
+		}
+	}
+
+	if rows > max_rows {
+		return nil, fmt.Errorf("join table %s has %d rows, more than the join limit of %d", name, rows, max_rows)
+	}
+
+	if _, ok := jt.KeyTable[joinkey]; !ok {
+		return nil, fmt.Errorf("join key %s is not a column of %s", joinkey, name)
+	}
+
+	Debug("LOADING JOIN TABLE", name, "WITH", rows, "ROWS")
+
+	loadSpec := jt.NewLoadSpec()
+	loadSpec.LoadAllColumns = true
+
+	// THE JOIN TABLE'S BLOCKS HAVE TO STAY AROUND FOR THE LOOKUPS
+	delete_blocks := DELETE_BLOCKS_AFTER_QUERY
+	DELETE_BLOCKS_AFTER_QUERY = false
+	jt.LoadRecords(&loadSpec)
+	DELETE_BLOCKS_AFTER_QUERY = delete_blocks
+
+	jt.buildJoinMap(joinkey)
+	return jt, nil
+}
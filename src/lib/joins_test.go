@@ -0,0 +1,123 @@
+package sybil_test
+
+import sybil "./"
+
+import "fmt"
+import "os"
+import "testing"
+
+var TEST_JOIN_TABLE_NAME = "__TEST2__"
+
+func TestLookupJoin(test *testing.T) {
+	delete_test_db()
+	os.RemoveAll(fmt.Sprintf("db/%s", TEST_JOIN_TABLE_NAME))
+	delete(sybil.LOADED_TABLES, TEST_JOIN_TABLE_NAME)
+
+	block_count := 3
+
+	// USER IDS ABOVE THE LOOKUP TABLE'S ROWS HAVE NO JOIN RECORD
+	add_records(func(r *sybil.Record, index int) {
+		r.AddIntField("user_id", int64(index%(sybil.CHUNK_SIZE+20)))
+	}, block_count)
+	nt := save_and_reload_table(test, block_count)
+
+	jt := sybil.GetTable(TEST_JOIN_TABLE_NAME)
+	for i := 0; i < sybil.CHUNK_SIZE; i++ {
+		r := jt.NewRecord()
+		r.AddIntField("user_id", int64(i))
+		r.AddStrField("plan", []string{"free", "pro"}[i%2])
+		r.AddIntField("age", int64(i))
+	}
+	jt.SaveRecordsToColumns()
+	delete(sybil.LOADED_TABLES, TEST_JOIN_TABLE_NAME)
+
+	if _, err := sybil.LoadJoinTable(TEST_JOIN_TABLE_NAME, "user_id", sybil.CHUNK_SIZE-1); err == nil {
+		test.Error("LOADED A JOIN TABLE ABOVE THE ROW LIMIT")
+	}
+
+	if _, err := sybil.LoadJoinTable(TEST_JOIN_TABLE_NAME, "nope", sybil.CHUNK_SIZE); err == nil {
+		test.Error("LOADED A JOIN TABLE WITHOUT ITS JOIN KEY")
+	}
+
+	if _, err := sybil.LoadJoinTable(TEST_JOIN_TABLE_NAME, "user_id", sybil.CHUNK_SIZE); err != nil {
+		test.Fatal("COULDNT LOAD JOIN TABLE", err)
+	}
+
+	plan, err := nt.VirtualColumn("users.plan", fmt.Sprintf(`lookup("%s", user_id, "plan")`, TEST_JOIN_TABLE_NAME))
+	if err != nil {
+		test.Fatal("COULDNT PARSE LOOKUP", err)
+	}
+
+	age, err := nt.VirtualColumn("users.age", fmt.Sprintf(`lookup("%s", user_id, "age")`, TEST_JOIN_TABLE_NAME))
+	if err != nil {
+		test.Fatal("COULDNT PARSE LOOKUP", err)
+	}
+
+	if plan.Type != sybil.STR_VAL || age.Type != sybil.INT_VAL {
+		test.Error("LOOKUPS SHOULD HAVE THE JOIN COLUMN'S TYPE", plan.Type, age.Type)
+	}
+
+	querySpec := new_query_spec()
+	querySpec.Virtuals = []sybil.VirtualColumn{plan, age}
+	querySpec.Groups = append(querySpec.Groups, nt.Grouping("users.plan"))
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("users.age", "avg"))
+
+	nt.MatchAndAggregate(querySpec)
+
+	free, ok := querySpec.Results["free"+sybil.GROUP_DELIMITER]
+	if !ok {
+		test.Fatal("MISSING GROUP FOR free")
+	}
+	pro, ok := querySpec.Results["pro"+sybil.GROUP_DELIMITER]
+	if !ok {
+		test.Fatal("MISSING GROUP FOR pro")
+	}
+
+	// EVERY pro USER IS ONE YEAR OLDER THAN THE free USER BEFORE THEM
+	if free.Count != pro.Count || pro.Hists["users.age"].Mean()-free.Hists["users.age"].Mean() != 1 {
+		test.Error("WRONG AGES", free.Hists["users.age"].Mean(), pro.Hists["users.age"].Mean())
+	}
+	total := free.Count + pro.Count
+
+	missing, ok := querySpec.Results[sybil.GROUP_DELIMITER]
+	if !ok || total+missing.Count != int64(sybil.CHUNK_SIZE*block_count) {
+		test.Error("RECORDS WITHOUT A JOIN RECORD SHOULD GROUP AS MISSING", missing)
+	}
+
+	if _, err := nt.VirtualColumn("users.nope", fmt.Sprintf(`lookup("%s", user_id, "nope")`, TEST_JOIN_TABLE_NAME)); err == nil {
+		test.Error("LOOKUP OF AN UNKNOWN COLUMN SHOULD FAIL")
+	}
+
+	// ROWS IN THE INGESTION LOG COUNT TOWARDS THE LIMIT WITH -read-log
+	delete(sybil.LOADED_TABLES, TEST_JOIN_TABLE_NAME)
+	jt = sybil.GetTable(TEST_JOIN_TABLE_NAME)
+	jt.LoadTableInfo()
+	for i := 0; i < 10; i++ {
+		r := jt.NewRecord()
+		r.AddIntField("user_id", int64(sybil.CHUNK_SIZE+i))
+	}
+	jt.IngestRecords("ingest")
+	delete(sybil.LOADED_TABLES, TEST_JOIN_TABLE_NAME)
+
+	prev_read_log := sybil.FLAGS.READ_INGESTION_LOG
+	sybil.FLAGS.READ_INGESTION_LOG = &sybil.TRUE
+	defer func() { sybil.FLAGS.READ_INGESTION_LOG = prev_read_log }()
+
+	if _, err := sybil.LoadJoinTable(TEST_JOIN_TABLE_NAME, "user_id", sybil.CHUNK_SIZE); err == nil {
+		test.Error("LOADED A JOIN TABLE WITH ITS INGESTION LOG ABOVE THE ROW LIMIT")
+	}
+	delete(sybil.LOADED_TABLES, TEST_JOIN_TABLE_NAME)
+
+	jt, err = sybil.LoadJoinTable(TEST_JOIN_TABLE_NAME, "user_id", sybil.CHUNK_SIZE+10)
+	if err != nil {
+		test.Fatal("COULDNT LOAD JOIN TABLE WITH ITS INGESTION LOG", err)
+	}
+
+	if jt.GetRecordById(fmt.Sprint(sybil.CHUNK_SIZE+9)) == nil {
+		test.Error("MISSING JOIN RECORD FROM THE INGESTION LOG")
+	}
+
+	os.RemoveAll(fmt.Sprintf("db/%s", TEST_JOIN_TABLE_NAME))
+	delete(sybil.LOADED_TABLES, TEST_JOIN_TABLE_NAME)
+	delete_test_db()
+}
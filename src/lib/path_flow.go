@@ -0,0 +1,168 @@
+package sybil
+
+import "fmt"
+import "sort"
+import "strings"
+
+// {{{ PATH FLOWS
+
+// A path flow follows the -path-key values of each session step by step, from
+// the start of the session or from its first anchor event, for -path-length
+// steps. It counts the sessions at each value of each step, the transitions
+// from one step's value to the next and the sessions that end (drop off)
+// after a step, which is what a Sankey diagram draws.
+
+type PathFlow struct {
+	Steps  int
+	Anchor *FunnelStep
+
+	Nodes    []map[string]int
+	Links    []map[string]int // from + GROUP_DELIMITER + to
+	DropOffs []map[string]int
+}
+
+func NewPathFlow(steps int, anchor string) (*PathFlow, error) {
+	if steps < 2 {
+		return nil, fmt.Errorf("path flows need a path length of at least 2")
+	}
+
+	pf := PathFlow{Steps: steps}
+	if anchor != "" {
+		step, err := parseFunnelStep(anchor)
+		if err != nil {
+			return nil, err
+		}
+		pf.Anchor = &step
+	}
+
+	for i := 0; i < steps; i++ {
+		pf.Nodes = append(pf.Nodes, make(map[string]int))
+		pf.Links = append(pf.Links, make(map[string]int))
+		pf.DropOffs = append(pf.DropOffs, make(map[string]int))
+	}
+
+	return &pf, nil
+}
+
+func (pf *PathFlow) loadColumns(t *Table, loadSpec *LoadSpec) {
+	if pf.Anchor != nil {
+		pf.Anchor.loadColumn(t, loadSpec)
+	}
+}
+
+// AddSession follows a session's time sorted records through the flow
+func (pf *PathFlow) AddSession(records RecordList) {
+	start := 0
+	if pf.Anchor != nil {
+		start = -1
+		for i, r := range records {
+			if pf.Anchor.matches(r) {
+				start = i
+				break
+			}
+		}
+
+		if start < 0 {
+			return
+		}
+	}
+
+	path := make([]string, 0, pf.Steps)
+	for _, r := range records[start:] {
+		if r.Path == "" {
+			continue
+		}
+
+		path = append(path, r.Path)
+		if len(path) == pf.Steps {
+			break
+		}
+	}
+
+	for i, val := range path {
+		pf.Nodes[i][val]++
+		if i+1 < len(path) {
+			pf.Links[i][val+GROUP_DELIMITER+path[i+1]]++
+		} else if i+1 < pf.Steps {
+			pf.DropOffs[i][val]++
+		}
+	}
+}
+
+func pathFlowNodeId(step int, val string) string {
+	return fmt.Sprintf("%d:%s", step, val)
+}
+
+// sorts the keys of a step's counts by count, descending
+func sortedFlowKeys(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	sort.Stable(sortFlowKeys{keys, counts})
+	return keys
+}
+
+type sortFlowKeys struct {
+	keys   []string
+	counts map[string]int
+}
+
+func (s sortFlowKeys) Len() int           { return len(s.keys) }
+func (s sortFlowKeys) Swap(i, j int)      { s.keys[i], s.keys[j] = s.keys[j], s.keys[i] }
+func (s sortFlowKeys) Less(i, j int) bool { return s.counts[s.keys[i]] > s.counts[s.keys[j]] }
+
+func (pf *PathFlow) PrintFlow() {
+	for i := 0; i < pf.Steps; i++ {
+		if len(pf.Nodes[i]) == 0 {
+			break
+		}
+
+		fmt.Printf("step %d:\n", i)
+		for _, val := range sortedFlowKeys(pf.Nodes[i]) {
+			fmt.Printf("  %-32s %8d\n", val, pf.Nodes[i][val])
+		}
+
+		for _, link := range sortedFlowKeys(pf.Links[i]) {
+			tokens := strings.SplitN(link, GROUP_DELIMITER, 2)
+			fmt.Printf("    %s -> %s %d\n", tokens[0], tokens[1], pf.Links[i][link])
+		}
+
+		for _, val := range sortedFlowKeys(pf.DropOffs[i]) {
+			fmt.Printf("    %s -> (drop off) %d\n", val, pf.DropOffs[i][val])
+		}
+	}
+}
+
+// toJSON returns the flow as nodes and links, where nodes are identified as
+// step:value
+func (pf *PathFlow) toJSON() map[string]interface{} {
+	nodes := make([]map[string]interface{}, 0)
+	links := make([]map[string]interface{}, 0)
+	drop_offs := make([]map[string]interface{}, 0)
+
+	for i := 0; i < pf.Steps; i++ {
+		for _, val := range sortedFlowKeys(pf.Nodes[i]) {
+			nodes = append(nodes, map[string]interface{}{"id": pathFlowNodeId(i, val), "step": i, "name": val, "value": pf.Nodes[i][val]})
+		}
+
+		for _, link := range sortedFlowKeys(pf.Links[i]) {
+			tokens := strings.SplitN(link, GROUP_DELIMITER, 2)
+			links = append(links, map[string]interface{}{"source": pathFlowNodeId(i, tokens[0]), "target": pathFlowNodeId(i+1, tokens[1]), "value": pf.Links[i][link]})
+		}
+
+		for _, val := range sortedFlowKeys(pf.DropOffs[i]) {
+			drop_offs = append(drop_offs, map[string]interface{}{"node": pathFlowNodeId(i, val), "value": pf.DropOffs[i][val]})
+		}
+	}
+
+	ret := make(map[string]interface{})
+	ret["nodes"] = nodes
+	ret["links"] = links
+	ret["drop_offs"] = drop_offs
+	return ret
+}
+
+// }}} PATH FLOWS
@@ -0,0 +1,66 @@
+package sybil_test
+
+import sybil "./"
+
+import "strconv"
+import "testing"
+
+func TestPathFlow(test *testing.T) {
+	delete_test_db()
+
+	// 20 SESSIONS OF 5 EVENTS, THE ODD SESSIONS ONLY HAVE PATHS FOR THEIR FIRST
+	// 2 EVENTS
+	add_records(func(r *sybil.Record, index int) {
+		r.AddIntField("session", int64(index/5))
+		r.AddIntField("pos", int64(index%5))
+	}, 1)
+
+	nt := save_and_reload_table(test, 1)
+
+	sessions := make(map[int64]sybil.RecordList)
+	session_id := nt.KeyTable["session"]
+	pos_id := nt.KeyTable["pos"]
+	for _, b := range nt.BlockList {
+		for _, r := range b.RecordList {
+			session, pos := int64(r.Ints[session_id]), int64(r.Ints[pos_id])
+			if session%2 == 0 || pos < 2 {
+				r.Path = strconv.FormatInt(pos, 10)
+			}
+			sessions[session] = append(sessions[session], r)
+		}
+	}
+
+	flow, err := sybil.NewPathFlow(3, "")
+	if err != nil {
+		test.Fatal("COULDNT CREATE PATH FLOW", err)
+	}
+
+	anchored, _ := sybil.NewPathFlow(3, "pos=3")
+	for _, records := range sessions {
+		flow.AddSession(records)
+		anchored.AddSession(records)
+	}
+
+	if flow.Nodes[0]["0"] != 20 || flow.Nodes[1]["1"] != 20 || flow.Nodes[2]["2"] != 10 {
+		test.Error("WRONG PATH FLOW NODES", flow.Nodes)
+	}
+
+	if flow.DropOffs[1]["1"] != 10 || len(flow.DropOffs[0]) != 0 || len(flow.DropOffs[2]) != 0 {
+		test.Error("WRONG PATH FLOW DROP OFFS", flow.DropOffs)
+	}
+
+	if len(flow.Links[0]) != 1 || len(flow.Links[1]) != 1 || len(flow.Links[2]) != 0 {
+		test.Error("WRONG PATH FLOW LINKS", flow.Links)
+	}
+
+	// ONLY THE EVEN SESSIONS HAVE A PATH AFTER THE ANCHOR
+	if anchored.Nodes[0]["3"] != 10 || anchored.Nodes[1]["4"] != 10 || anchored.DropOffs[1]["4"] != 10 || len(anchored.Nodes[2]) != 0 {
+		test.Error("WRONG ANCHORED PATH FLOW", anchored.Nodes, anchored.DropOffs)
+	}
+
+	if _, err := sybil.NewPathFlow(1, ""); err == nil {
+		test.Error("CREATED A PATH FLOW WITH ONE STEP")
+	}
+
+	delete_test_db()
+}
@@ -8,7 +8,6 @@ import "os"
 import "fmt"
 import "io/ioutil"
 import "text/tabwriter"
-import "time"
 
 func printJson(data interface{}) {
 	b, err := json.Marshal(data)
@@ -19,6 +18,41 @@ func printJson(data interface{}) {
 	}
 }
 
+// a missing time bucket is filled with a zero count, a null count or the
+// previous bucket's results, depending on -fill
+func fillTimeBucket(prev ResultMap) (ResultMap, bool) {
+	if *FLAGS.FILL == "previous" && prev != nil {
+		return prev, true
+	}
+
+	return nil, false
+}
+
+func filledJSONValue() interface{} {
+	if *FLAGS.FILL == "zero" {
+		return 0
+	}
+
+	return nil
+}
+
+func (querySpec *QuerySpec) filledResultJSON(r *Result) ResultJSON {
+	res := make(ResultJSON)
+	for _, agg := range querySpec.Aggregations {
+		res[agg.Name] = filledJSONValue()
+	}
+
+	var group_key = strings.Split(r.GroupByKey, GROUP_DELIMITER)
+	for i, g := range querySpec.Groups {
+		res[g.Name] = group_key[i]
+	}
+
+	res["Count"] = filledJSONValue()
+	res["Samples"] = filledJSONValue()
+
+	return res
+}
+
 func printTimeResults(querySpec *QuerySpec) {
 	Debug("PRINTING TIME RESULTS")
 	Debug("CHECKING SORT ORDER", len(querySpec.Sorted))
@@ -28,27 +62,47 @@ func printTimeResults(querySpec *QuerySpec) {
 		is_top_result[result.GroupByKey] = true
 	}
 
-	keys := make([]int, 0)
+	keys := querySpec.timeBucketKeys(*FLAGS.FILL)
+	bucketer := querySpec.TimeBucketer()
 
-	for k, _ := range querySpec.TimeResults {
-		keys = append(keys, k)
+	filled_value := "-"
+	if *FLAGS.FILL == "zero" {
+		filled_value = "0"
 	}
 
-	sort.Ints(keys)
-
 	Debug("RESULT COUNT", len(querySpec.TimeResults))
 	if *FLAGS.JSON {
 
 		marshalled_results := make(map[string][]ResultJSON)
-		for k, v := range querySpec.TimeResults {
+		var prev ResultMap
+		for _, k := range keys {
 			key := strconv.FormatInt(int64(k), 10)
 			marshalled_results[key] = make([]ResultJSON, 0)
 
+			v, ok := querySpec.TimeResults[k]
+			if !ok {
+				v, ok = fillTimeBucket(prev)
+			}
+
+			if !ok {
+				if *FLAGS.OP == "distinct" {
+					marshalled_results[key] = append(marshalled_results[key],
+						ResultJSON{"Distinct": filledJSONValue(), "Count": filledJSONValue()})
+					continue
+				}
+
+				for _, r := range querySpec.Sorted {
+					marshalled_results[key] = append(marshalled_results[key], querySpec.filledResultJSON(r))
+				}
+				continue
+			}
+			prev = v
+
 			if *FLAGS.OP == "distinct" {
 				marshalled_results[key] = append(marshalled_results[key],
 					ResultJSON{"Distinct": len(v), "Count": len(v)})
 			} else {
-				for _, r := range v {
+				for _, r := range querySpec.SortResultMap(v) {
 					_, ok := is_top_result[r.GroupByKey]
 					if ok {
 						marshalled_results[key] = append(marshalled_results[key], r.toResultJSON(querySpec))
@@ -63,28 +117,51 @@ func printTimeResults(querySpec *QuerySpec) {
 		return
 	}
 
-	top_results := make([]string, 0)
-	for _, r := range querySpec.Sorted {
-		top_results = append(top_results, r.GroupByKey)
-	}
-
 	w := new(tabwriter.Writer)
 	w.Init(os.Stdout, 0, 1, 0, ' ', tabwriter.AlignRight)
 
+	var prev ResultMap
 	for _, time_bucket := range keys {
-		results := querySpec.TimeResults[time_bucket]
-		time_str := time.Unix(int64(time_bucket), 0).Format(OPTS.TIME_FORMAT)
+		time_str := bucketer.Format(int64(time_bucket), OPTS.TIME_FORMAT)
+
+		results, ok := querySpec.TimeResults[time_bucket]
+		if !ok {
+			results, ok = fillTimeBucket(prev)
+		}
+
+		if !ok {
+			if *FLAGS.OP == "distinct" {
+				fmt.Fprintln(w, time_str, "\t", filled_value, "\t")
+			} else {
+				for _, r := range querySpec.Sorted {
+					fmt.Fprintln(w, time_str, "\t", filled_value, "\t", r.GroupByKey, "\t")
+				}
+			}
+			continue
+		}
+		prev = results
 
 		if *FLAGS.OP == "distinct" {
 			fmt.Fprintln(w, time_str, "\t", len(results), "\t")
 		} else {
-			for _, r := range results {
+			for _, r := range querySpec.SortResultMap(results) {
 				if len(r.Hists) == 0 {
-					fmt.Fprintln(w, time_str, "\t", r.Count, "\t", r.GroupByKey, "\t")
+					if len(querySpec.SeriesFns) > 0 {
+						fmt.Fprintln(w, time_str, "\t", r.Count, "\t", r.GroupByKey, "\t", formatSeries(r, querySpec.SeriesFns, OPTS.SORT_COUNT), "\t")
+					} else {
+						fmt.Fprintln(w, time_str, "\t", r.Count, "\t", r.GroupByKey, "\t")
+					}
 				} else {
 					for agg, hist := range r.Hists {
 						avg_str := fmt.Sprintf("%.2f", hist.Mean())
-						fmt.Fprintln(w, time_str, "\t", r.Count, "\t", r.GroupByKey, "\t", agg, "\t", avg_str, "\t")
+						row := []interface{}{time_str, "\t", r.Count, "\t", r.GroupByKey, "\t", agg, "\t", avg_str, "\t"}
+						if *FLAGS.OP == "hist" && len(OPTS.PERCENTILES) > 0 {
+							row = append(row, formatPercentiles(hist), "\t")
+						}
+						if len(querySpec.SeriesFns) > 0 {
+							row = append(row, formatSeries(r, querySpec.SeriesFns, agg), "\t")
+						}
+						fmt.Fprintln(w, row...)
 					}
 				}
 
@@ -107,6 +184,29 @@ func getSparseBuckets(buckets map[string]int64) map[string]int64 {
 	return non_zero_buckets
 }
 
+// when -percentiles is given, only the requested percentiles are output
+func getPercentilesJSON(h Histogram) interface{} {
+	if len(OPTS.PERCENTILES) == 0 {
+		return h.GetPercentiles()
+	}
+
+	selected := make(map[string]int64)
+	for _, p := range OPTS.PERCENTILES {
+		selected[PercentileName(p)] = h.GetPercentile(p)
+	}
+
+	return selected
+}
+
+func formatPercentiles(h Histogram) string {
+	formatted := make([]string, 0)
+	for _, p := range OPTS.PERCENTILES {
+		formatted = append(formatted, fmt.Sprintf("%s:%d", PercentileName(p), h.GetPercentile(p)))
+	}
+
+	return strings.Join(formatted, " ")
+}
+
 func (r *Result) toResultJSON(querySpec *QuerySpec) ResultJSON {
 
 	var res = make(ResultJSON)
@@ -116,7 +216,7 @@ func (r *Result) toResultJSON(querySpec *QuerySpec) ResultJSON {
 			res[agg.Name] = inner
 			h := r.Hists[agg.Name]
 			if h != nil {
-				inner["percentiles"] = r.Hists[agg.Name].GetPercentiles()
+				inner["percentiles"] = getPercentilesJSON(h)
 				inner["buckets"] = getSparseBuckets(r.Hists[agg.Name].GetBuckets())
 				inner["stddev"] = r.Hists[agg.Name].StdDev()
 				inner["samples"] = r.Hists[agg.Name].TotalCount()
@@ -141,6 +241,10 @@ func (r *Result) toResultJSON(querySpec *QuerySpec) ResultJSON {
 	res["Count"] = r.Count
 	res["Samples"] = r.Samples
 
+	if len(r.Series) > 0 {
+		res["Series"] = r.Series
+	}
+
 	return res
 
 }
@@ -209,12 +313,21 @@ func printResult(querySpec *QuerySpec, v *Result) {
 			if len(p) > 0 {
 				avg_str := fmt.Sprintf("%.2f", h.Mean())
 				std_str := fmt.Sprintf("%.2f", h.StdDev())
-				fmt.Println(col_name, "|", p[0], p[99], "|", avg_str, "|", p[0], p[25], p[50], p[75], p[99], "|", std_str)
+				if len(OPTS.PERCENTILES) > 0 {
+					fmt.Println(col_name, "|", h.Min(), h.Max(), "|", avg_str, "|", formatPercentiles(h), "|", std_str)
+				} else {
+					fmt.Println(col_name, "|", p[0], p[99], "|", avg_str, "|", p[0], p[25], p[50], p[75], p[99], "|", std_str)
+				}
 			} else {
 				fmt.Println(col_name, "No Data")
 			}
 		} else if *FLAGS.OP == "avg" {
-			fmt.Println(col_name, fmt.Sprintf("%.2f", v.Hists[agg.Name].Mean()))
+			h, ok := v.Hists[agg.Name]
+			if !ok {
+				fmt.Println(col_name, "No Data")
+				continue
+			}
+			fmt.Println(col_name, fmt.Sprintf("%.2f", h.Mean()))
 		}
 	}
 }
@@ -263,7 +376,11 @@ func PrintResults(querySpec *QuerySpec) {
 
 func (qs *QuerySpec) PrintResults() {
 	if *FLAGS.PRINT {
-		if qs.TimeBucket > 0 {
+		if qs.Anomalies != nil && qs.TimeBucket > 0 {
+			printAnomalies(qs)
+		} else if qs.CompareOffset > 0 {
+			printCompareResults(qs)
+		} else if qs.TimeBucket > 0 {
 			printTimeResults(qs)
 		} else if qs.OrderBy != "" {
 			printSortedResults(qs)
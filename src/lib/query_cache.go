@@ -17,6 +17,7 @@ func registerTypesForQueryCache() {
 	gob.Register(SetFilter{})
 	gob.Register(&HistCompat{})
 	gob.Register(&MultiHistCompat{})
+	gob.Register(&TDigestHist{})
 }
 
 func (t *Table) getCachedQueryForBlock(dirname string, querySpec *QuerySpec) (*TableBlock, *QuerySpec) {
@@ -99,7 +100,8 @@ func (querySpec *QuerySpec) GetCacheRelevantFilters(blockname string) []Filter {
 		switch fil := f.(type) {
 		case IntFilter:
 			// we only use block extents for skipping gt and lt filters
-			if fil.Op != "lt" && fil.Op != "gt" {
+			// and virtual columns have no block extents
+			if fil.Op != "lt" && fil.Op != "gt" || t.isVirtual(fil.FieldId) {
 				filters = append(filters, f)
 				continue
 			}
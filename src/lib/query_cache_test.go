@@ -155,7 +155,7 @@ func testCachedQueryConsistency(test *testing.T) {
 func testCachedBasicHist(test *testing.T) {
 	nt := sybil.GetTable(TEST_TABLE_NAME)
 
-	for _, hist_type := range []string{"basic", "loghist"} {
+	for _, hist_type := range []string{"basic", "loghist", "tdigest"} {
 		// set query flags as early as possible
 		if hist_type == "loghist" {
 			sybil.FLAGS.LOG_HIST = &sybil.TRUE
@@ -163,6 +163,12 @@ func testCachedBasicHist(test *testing.T) {
 			sybil.FLAGS.LOG_HIST = &sybil.FALSE
 		}
 
+		if hist_type == "tdigest" {
+			sybil.FLAGS.TDIGEST_HIST = &sybil.TRUE
+		} else {
+			sybil.FLAGS.TDIGEST_HIST = &sybil.FALSE
+		}
+
 		HIST := "hist"
 		sybil.FLAGS.OP = &HIST
 
@@ -233,4 +239,6 @@ func testCachedBasicHist(test *testing.T) {
 		}
 	}
 
+	sybil.FLAGS.TDIGEST_HIST = &sybil.FALSE
+
 }
@@ -14,16 +14,35 @@ type savedQueryResults struct {
 	MatchedCount int
 	Sorted       []*Result
 	Matched      RecordList
+
+	// the shifted window of a -compare query
+	CompareResults     ResultMap
+	CompareTimeResults map[int]ResultMap
+
+	// set when groups were dropped at the INTERNAL_RESULT_LIMIT
+	Truncated bool
 }
 
 type savedQueryParams struct {
 	Filters      []Filter
 	Groups       []Grouping
 	Aggregations []Aggregation
+	Virtuals     []VirtualColumn
 
 	OrderBy    string
 	Limit      int16
 	TimeBucket int
+
+	// calendar unit (d, w or mo) and time zone of the time buckets, empty for
+	// epoch aligned buckets of TimeBucket seconds
+	TimeBucketUnit string
+	TimeZone       string
+
+	// -compare queries aggregate [CompareStart, CompareEnd) and the same
+	// window CompareOffset seconds earlier
+	CompareOffset int
+	CompareStart  int64
+	CompareEnd    int64
 }
 
 // For outside consumption
@@ -37,6 +56,20 @@ type QuerySpec struct {
 	BlockList map[string]TableBlock
 	Table     *Table
 
+	// Having is applied after the results are combined, so it isn't part of
+	// the cached params
+	Having []HavingCond
+
+	SeriesFns []SeriesFn
+	Anomalies *AnomalySpec
+
+	TopN  int
+	TopBy string
+
+	// partial results are combined with other tables before they are
+	// finalized, see union.go
+	partial bool
+
 	Sessions SessionList
 
 	LuaResult LuaTable
@@ -50,6 +83,14 @@ type Filter interface {
 type Grouping struct {
 	Name    string
 	name_id int16
+
+	// a function of the column's value, like hour(time) or bucket=100, see
+	// grouping.go
+	Func string
+	Args []int64
+
+	// the column isn't in the table at all, see QuerySpec.ForTable
+	absent bool
 }
 
 type Aggregation struct {
@@ -67,6 +108,9 @@ type Result struct {
 	BinaryByKey string
 	Count       int64
 	Samples     int64
+
+	// values of the series functions, filled in after combining
+	Series map[string]float64
 }
 
 func NewResult() *Result {
@@ -120,6 +164,8 @@ func (rs *Result) Combine(next_result *Result) {
 func (querySpec *QuerySpec) Punctuate() {
 	querySpec.Results = make(ResultMap)
 	querySpec.TimeResults = make(map[int]ResultMap)
+	querySpec.CompareResults = make(ResultMap)
+	querySpec.CompareTimeResults = make(map[int]ResultMap)
 }
 
 func (querySpec *QuerySpec) ResetResults() {
@@ -137,8 +183,14 @@ func (querySpec *QuerySpec) ResetResults() {
 	}
 }
 func (t *Table) Grouping(name string) Grouping {
-	col_id := t.get_key_id(name)
-	return Grouping{name, col_id}
+	fn, col := ParseGroupingFunc(name)
+	fn, args, err := ParseGroupingArgs(fn)
+	if err != nil {
+		Debug("INVALID GROUPING", name, err)
+	}
+
+	col_id := t.get_key_id(col)
+	return Grouping{Name: name, name_id: col_id, Func: fn, Args: args}
 }
 
 func (t *Table) Aggregation(name string, op string) Aggregation {
@@ -151,17 +203,10 @@ func (t *Table) Aggregation(name string, op string) Aggregation {
 
 	if op == "hist" {
 		agg.op_id = OP_HIST
-		agg.HistType = "basic"
-		if *FLAGS.LOG_HIST {
-			agg.HistType = "multi"
-
-		}
-
-		if *FLAGS.HDR_HIST {
-			agg.HistType = "hdr"
-		}
 	}
 
+	agg.HistType = t.histType(col_id)
+
 	if op == "distinct" {
 		agg.op_id = OP_DISTINCT
 	}
@@ -0,0 +1,189 @@
+package sybil
+
+import "fmt"
+import "strings"
+
+// {{{ SESSION AGGREGATIONS
+
+// Session aggregations compute one value per session from its records and
+// histogram those values across sessions, like the revenue per session:
+//
+// sum:col, min:col, max:col, avg:col	of an int column in the session
+// count:col=value	the number of events in the session matching col=value
+
+var SESSION_AGG_OPS = map[string]bool{
+	"sum":   true,
+	"min":   true,
+	"max":   true,
+	"avg":   true,
+	"count": true,
+}
+
+type SessionAgg struct {
+	Name  string
+	Op    string
+	Col   string
+	Event FunnelStep
+
+	col_ids tableColumnIds
+}
+
+type SessionAggStats struct {
+	Hists []*TDigestHist
+
+	aggs []SessionAgg
+}
+
+// ParseSessionAggs parses a list of session aggregations, like
+// sum:bytes,max:latency,count:page=purchase
+func ParseSessionAggs(spec string) ([]SessionAgg, error) {
+	aggs := make([]SessionAgg, 0)
+
+	for _, agg := range strings.Split(spec, *FLAGS.FIELD_SEPARATOR) {
+		tokens := strings.SplitN(strings.TrimSpace(agg), *FLAGS.FILTER_SEPARATOR, 2)
+		if len(tokens) != 2 || !SESSION_AGG_OPS[tokens[0]] {
+			return nil, fmt.Errorf("invalid session aggregation, expected op:col: %s", agg)
+		}
+
+		sa := SessionAgg{Name: fmt.Sprintf("%s(%s)", tokens[0], tokens[1]), Op: tokens[0], Col: tokens[1], col_ids: make(tableColumnIds)}
+		if sa.Op == "count" {
+			event, err := parseFunnelStep(tokens[1])
+			if err != nil {
+				return nil, err
+			}
+			sa.Event = event
+			sa.Col = event.Col
+		}
+
+		aggs = append(aggs, sa)
+	}
+
+	return aggs, nil
+}
+
+func (sa SessionAgg) resolveColumns(t *Table) {
+	if sa.Op == "count" {
+		sa.Event.resolveColumn(t)
+		return
+	}
+
+	if sa.col_ids != nil {
+		sa.col_ids.resolve(t, sa.Col)
+	}
+}
+
+func (sa SessionAgg) loadColumns(t *Table, loadSpec *LoadSpec) {
+	if sa.Op == "count" {
+		sa.Event.loadColumn(t, loadSpec)
+		return
+	}
+
+	if t.GetColumnType(sa.Col) == INT_VAL {
+		loadSpec.Int(sa.Col)
+	}
+}
+
+// apply computes the aggregation for a session's records. It returns false
+// when the session has no values for it.
+func (sa SessionAgg) apply(records RecordList) (int64, bool) {
+	if sa.Op == "count" {
+		count := int64(0)
+		for _, r := range records {
+			if sa.Event.matches(r) {
+				count++
+			}
+		}
+		return count, true
+	}
+
+	val := int64(0)
+	count := int64(0)
+	for _, r := range records {
+		field_id := sa.col_ids.get(r.block.table, sa.Col)
+		if field_id < 0 || int(field_id) >= len(r.Populated) || r.Populated[field_id] != INT_VAL {
+			continue
+		}
+
+		v := int64(r.Ints[field_id])
+		switch {
+		case count == 0:
+			val = v
+		case sa.Op == "sum" || sa.Op == "avg":
+			val += v
+		case sa.Op == "min" && v < val, sa.Op == "max" && v > val:
+			val = v
+		}
+		count++
+	}
+
+	if count == 0 {
+		return 0, false
+	}
+
+	if sa.Op == "avg" {
+		return val / count, true
+	}
+
+	return val, true
+}
+
+func NewSessionAggStats(aggs []SessionAgg) *SessionAggStats {
+	sas := SessionAggStats{aggs: aggs}
+	for range aggs {
+		h := newTDigestHist()
+		h.TrackPercentiles()
+		sas.Hists = append(sas.Hists, h)
+	}
+
+	return &sas
+}
+
+func (sas *SessionAggStats) SummarizeSession(records RecordList) {
+	for i, sa := range sas.aggs {
+		if val, ok := sa.apply(records); ok {
+			sas.Hists[i].RecordValues(val, 1)
+		}
+	}
+}
+
+func (sas *SessionAggStats) CombineAggs(other *SessionAggStats) {
+	for i, h := range sas.Hists {
+		h.Combine(other.Hists[i])
+	}
+}
+
+func (sas *SessionAggStats) PrintAggs() {
+	fmt.Printf("  per session:\n")
+	for i, sa := range sas.aggs {
+		h := sas.Hists[i]
+		if h.TotalCount() == 0 {
+			fmt.Printf("    %-24s No Data\n", sa.Name)
+			continue
+		}
+
+		fmt.Printf("    %-24s avg %.2f | p50 %d p90 %d p99 %d | %d sessions\n", sa.Name, h.Mean(), h.GetPercentile(50), h.GetPercentile(90), h.GetPercentile(99), h.TotalCount())
+	}
+}
+
+func (sas *SessionAggStats) toJSON() map[string]interface{} {
+	ret := make(map[string]interface{})
+	for i, sa := range sas.aggs {
+		h := sas.Hists[i]
+		if h.TotalCount() == 0 {
+			ret[sa.Name] = nil
+			continue
+		}
+
+		info := make(map[string]interface{})
+		info["avg"] = h.Mean()
+		info["p50"] = h.GetPercentile(50)
+		info["p90"] = h.GetPercentile(90)
+		info["p99"] = h.GetPercentile(99)
+		info["sessions"] = h.TotalCount()
+		ret[sa.Name] = info
+	}
+
+	return ret
+}
+
+// }}} SESSION AGGREGATIONS
@@ -0,0 +1,76 @@
+package sybil_test
+
+import sybil "./"
+
+import "math"
+import "testing"
+
+func TestSessionAggs(test *testing.T) {
+	delete_test_db()
+
+	// 10 SESSIONS OF 10 EVENTS, WITH 1..10 BYTES EACH. ODD SESSIONS HAVE
+	// PURCHASES ON THEIR ODD EVENTS
+	add_records(func(r *sybil.Record, index int) {
+		session, pos := index/10, index%10
+
+		page := "home"
+		if session%2 == 1 && pos%2 == 1 {
+			page = "purchase"
+		}
+
+		r.AddIntField("session", int64(session))
+		r.AddIntField("bytes", int64(pos+1))
+		r.AddIntField("latency", int64(session*100+pos))
+		r.AddStrField("page", page)
+	}, 1)
+
+	nt := save_and_reload_table(test, 1)
+
+	sessions := make(map[int64]sybil.RecordList)
+	session_id := nt.KeyTable["session"]
+	for _, b := range nt.BlockList {
+		for _, r := range b.RecordList {
+			session := int64(r.Ints[session_id])
+			sessions[session] = append(sessions[session], r)
+		}
+	}
+
+	aggs, err := sybil.ParseSessionAggs("sum:bytes,max:latency,min:latency,avg:bytes,count:page=purchase,sum:nope")
+	if err != nil {
+		test.Fatal("COULDNT PARSE SESSION AGGS", err)
+	}
+
+	stats := sybil.NewSessionAggStats(aggs)
+	for _, records := range sessions {
+		session_stats := sybil.NewSessionAggStats(aggs)
+		session_stats.SummarizeSession(records)
+		stats.CombineAggs(session_stats)
+	}
+
+	if _, ok := nt.KeyTable["nope"]; ok {
+		test.Error("SESSION AGGS SHOULDN'T ADD MISSING COLUMNS TO THE TABLE")
+	}
+
+	expected := []float64{55, 459, 450, 5, 2.5, 0}
+	for i, agg := range aggs {
+		h := stats.Hists[i]
+		if agg.Col == "nope" {
+			if h.TotalCount() != 0 {
+				test.Error("SESSIONS WITHOUT VALUES SHOULDN'T BE COUNTED FOR", agg.Name)
+			}
+			continue
+		}
+
+		if h.TotalCount() != 10 || math.Abs(h.Mean()-expected[i]) > 0.001 {
+			test.Error("WRONG VALUES FOR", agg.Name, h.TotalCount(), h.Mean())
+		}
+	}
+
+	for _, spec := range []string{"sum", "median:bytes", "count:page"} {
+		if _, err := sybil.ParseSessionAggs(spec); err == nil {
+			test.Error("PARSED AN INVALID SESSION AGG", spec)
+		}
+	}
+
+	delete_test_db()
+}
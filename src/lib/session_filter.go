@@ -0,0 +1,107 @@
+package sybil
+
+import "fmt"
+import "strings"
+
+// {{{ SESSION FILTERS
+
+// Session filters keep or drop whole sessions, based on the events in them.
+// Events are described like funnel steps, as col=value:
+//
+// contains:page=signup	the session has a signup event
+// not-contains:page=error	the session has no error event
+// followed-by:page=cart:page=purchase	a cart event is later followed by a purchase
+// not-followed-by:page=cart:page=purchase	no cart event is followed by a purchase
+
+var SESSION_FILTER_OPS = map[string]int{
+	"contains":        1,
+	"not-contains":    1,
+	"followed-by":     2,
+	"not-followed-by": 2,
+}
+
+type SessionFilter struct {
+	Op     string
+	Events []FunnelStep
+}
+
+// ParseSessionFilter parses a -session-filter, like contains:page=signup
+func ParseSessionFilter(spec string) (SessionFilter, error) {
+	tokens := strings.Split(spec, *FLAGS.FILTER_SEPARATOR)
+
+	sf := SessionFilter{Op: strings.TrimSpace(tokens[0])}
+	count, ok := SESSION_FILTER_OPS[sf.Op]
+	if !ok {
+		return sf, fmt.Errorf("unknown session filter: %s", sf.Op)
+	}
+
+	if len(tokens)-1 != count {
+		return sf, fmt.Errorf("%s takes %d events, got %d", sf.Op, count, len(tokens)-1)
+	}
+
+	for _, event := range tokens[1:] {
+		step, err := parseFunnelStep(event)
+		if err != nil {
+			return sf, err
+		}
+		sf.Events = append(sf.Events, step)
+	}
+
+	return sf, nil
+}
+
+// Matches returns whether a session's time sorted records pass the filter
+func (sf SessionFilter) Matches(records RecordList) bool {
+	switch sf.Op {
+	case "contains", "not-contains":
+		found := false
+		for _, r := range records {
+			if sf.Events[0].matches(r) {
+				found = true
+				break
+			}
+		}
+		return found == (sf.Op == "contains")
+
+	case "followed-by", "not-followed-by":
+		found := false
+		seen_first := false
+		for _, r := range records {
+			if seen_first && sf.Events[1].matches(r) {
+				found = true
+				break
+			}
+
+			if sf.Events[0].matches(r) {
+				seen_first = true
+			}
+		}
+		return found == (sf.Op == "followed-by")
+	}
+
+	return true
+}
+
+func (sf SessionFilter) resolveColumns(t *Table) {
+	for _, event := range sf.Events {
+		event.resolveColumn(t)
+	}
+}
+
+func (sf SessionFilter) loadColumns(t *Table, loadSpec *LoadSpec) {
+	for _, event := range sf.Events {
+		event.loadColumn(t, loadSpec)
+	}
+}
+
+func sessionMatchesFilters(records RecordList, filters []SessionFilter) bool {
+	for _, sf := range filters {
+		if !sf.Matches(records) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// }}} SESSION FILTERS
@@ -0,0 +1,148 @@
+package sybil_test
+
+import sybil "./"
+
+import "sort"
+import "strings"
+import "testing"
+
+func TestSessionFilters(test *testing.T) {
+	delete_test_db()
+
+	time_col, prev_time_col := "time", sybil.FLAGS.TIME_COL
+	sybil.FLAGS.TIME_COL = &time_col
+	defer func() { sybil.FLAGS.TIME_COL = prev_time_col }()
+
+	// 10 SESSIONS OF 10 EVENTS. EVEN SESSIONS ADD TO THEIR CART AND EVERY
+	// THIRD SESSION PURCHASES, EITHER AFTER OR BEFORE THE CART
+	add_records(func(r *sybil.Record, index int) {
+		session, pos := index/10, index%10
+
+		page := "home"
+		switch {
+		case pos == 5 && session%2 == 0:
+			page = "cart"
+		case pos == 8 && session%3 == 0:
+			page = "purchase"
+		case pos == 1 && session%3 == 1:
+			page = "purchase"
+		}
+
+		r.AddIntField("time", int64(index))
+		r.AddIntField("session", int64(session))
+		r.AddStrField("page", page)
+	}, 1)
+
+	nt := save_and_reload_table(test, 1)
+
+	sessions := make(map[int64]sybil.RecordList)
+	session_id := nt.KeyTable["session"]
+	for _, b := range nt.BlockList {
+		for _, r := range b.RecordList {
+			session := int64(r.Ints[session_id])
+			sessions[session] = append(sessions[session], r)
+		}
+	}
+
+	// sessions with carts: 0 2 4 6 8, purchases after: 0 3 6 9, before: 1 4 7
+	expected := map[string]int{
+		"contains:page=cart":                      5,
+		"not-contains:page=purchase":              3,
+		"followed-by:page=cart:page=purchase":     2,
+		"not-followed-by:page=cart:page=purchase": 8,
+		"followed-by:page=purchase:page=cart":     1,
+		"followed-by:page=home:page=purchase":     7,
+		"contains:session=3":                      1,
+	}
+
+	for spec, count := range expected {
+		sf, err := sybil.ParseSessionFilter(spec)
+		if err != nil {
+			test.Error("COULDNT PARSE SESSION FILTER", spec, err)
+			continue
+		}
+
+		matched := 0
+		for _, records := range sessions {
+			sort.Sort(sybil.SortRecordsByTime{records})
+			if sf.Matches(records) {
+				matched++
+			}
+		}
+
+		if matched != count {
+			test.Error("SESSION FILTER", spec, "MATCHED", matched, "SESSIONS, EXPECTED", count)
+		}
+	}
+
+	for _, spec := range []string{"contains", "contains:page", "followed-by:page=cart", "bogus:page=cart"} {
+		if _, err := sybil.ParseSessionFilter(spec); err == nil {
+			test.Error("PARSED AN INVALID SESSION FILTER", spec)
+		}
+	}
+
+	delete_test_db()
+}
+
+// Tests that only the sessions that pass the filters count towards the path
+// n-grams
+func TestSessionFilterPaths(test *testing.T) {
+	delete_test_db()
+
+	reset_flags := setup_session_flags("session")
+	defer reset_flags()
+
+	// THE SAME 10 SESSIONS, WITH MORE THAN THE CUTOFF BETWEEN THEM
+	add_records(func(r *sybil.Record, index int) {
+		session, pos := index/10, index%10
+
+		page := "home"
+		switch {
+		case pos == 5 && session%2 == 0:
+			page = "cart"
+		case pos == 8 && session%3 == 0:
+			page = "purchase"
+		}
+
+		r.AddIntField("time", int64(session*10000+pos*60))
+		r.AddIntField("session", int64(session))
+		r.AddStrField("page", page)
+	}, 1)
+
+	nt := save_and_reload_table(test, 1)
+
+	as := sybil.ActiveSession{PathStats: make(map[string]int)}
+	for _, b := range nt.BlockList {
+		for _, r := range b.RecordList {
+			r.Timestamp = int64(r.Ints[nt.KeyTable["time"]])
+			r.Path, _ = r.GetStrVal("page")
+			as.Records = append(as.Records, r)
+		}
+	}
+	sort.Sort(sybil.SortRecordsByTime{as.Records})
+
+	sf, err := sybil.ParseSessionFilter("contains:page=cart")
+	if err != nil {
+		test.Fatal("COULDNT PARSE SESSION FILTER", err)
+	}
+
+	sessions := as.ExpireRecords(1000*1000, []sybil.SessionFilter{sf})
+	if len(sessions) != 5 {
+		test.Fatal("EXPECTED 5 SESSIONS WITH A CART, GOT", len(sessions))
+	}
+
+	// ONLY SESSIONS 0 AND 6 OF THE 4 WITH A PURCHASE HAVE A CART
+	expected := map[string]int{
+		"home,home,cart":     5,
+		"home,home,purchase": 2,
+	}
+
+	for path, count := range expected {
+		key := strings.Replace(path, ",", sybil.GROUP_DELIMITER, -1)
+		if as.PathStats[key] != count {
+			test.Error("PATH", path, "COUNTED", as.PathStats[key], "TIMES, EXPECTED", count)
+		}
+	}
+
+	delete_test_db()
+}
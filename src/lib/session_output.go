@@ -0,0 +1,96 @@
+package sybil
+
+import "os"
+import "path"
+import "strings"
+
+// {{{ SESSION TABLES
+
+// With an output table, every closed session (that passes the session
+// filters) is written as a record into a regular table, so sessions can be
+// queried, grouped and trimmed like events. The record has the session
+// columns, the session start as the time column, end, duration, events,
+// first_path and last_path (with -path-key) and a column per session
+// aggregation, like sum_bytes.
+
+// the column for a session aggregation in an output table, like sum_bytes
+func (sa SessionAgg) column() string {
+	name := sa.Col
+	if sa.Op == "count" {
+		name = sa.Event.Name
+	}
+
+	return strings.Map(func(c rune) rune {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+			return c
+		}
+		return '_'
+	}, sa.Op+"_"+name)
+}
+
+// outputSession adds a record for a session to the output table. Records are
+// saved to columns once they fill a block.
+func (sl *SessionList) outputSession(key string, records RecordList) {
+	if len(records) == 0 {
+		return
+	}
+
+	t := sl.Output
+	r := t.NewRecord()
+
+	cols := strings.Split(*FLAGS.SESSION_COL, *FLAGS.FIELD_SEPARATOR)
+	vals := strings.Split(key, GROUP_DELIMITER)
+	for i, col := range cols {
+		if i < len(vals) {
+			r.AddStrField(col, vals[i])
+		}
+	}
+
+	first := records[0]
+	last := records[len(records)-1]
+	r.AddIntField(*FLAGS.TIME_COL, first.Timestamp)
+	r.AddIntField("end", last.Timestamp)
+	r.AddIntField("duration", last.Timestamp-first.Timestamp)
+	r.AddIntField("events", int64(len(records)))
+
+	if *FLAGS.PATH_KEY != "" {
+		r.AddStrField("first_path", first.Path)
+		r.AddStrField("last_path", last.Path)
+	}
+
+	for _, sa := range sl.Aggs {
+		if val, ok := sa.apply(records); ok {
+			r.AddIntField(sa.column(), val)
+		}
+	}
+
+	if len(t.newRecords) >= CHUNK_SIZE {
+		sl.SaveOutput()
+	}
+}
+
+// SaveOutput saves the session records that are left to the output table.
+// blocks are only saved under the table's digest lock, if a digest or ingest
+// holds it, the sessions go to the ingestion log for the next digest to save
+func (sl *SessionList) SaveOutput() {
+	t := sl.Output
+	if t == nil || len(t.newRecords) == 0 {
+		return
+	}
+
+	// a new output table needs its dir for the lock file
+	os.MkdirAll(path.Join(*FLAGS.DIR, t.Name), 0777)
+	if t.GrabDigestLock() == false {
+		Warn("CANT GRAB DIGEST LOCK FOR", t.Name, "SAVING", len(t.newRecords), "SESSIONS TO ITS INGESTION LOG")
+		t.AppendRecordsToLog(t.newRecords, "sessions")
+		t.newRecords = make(RecordList, 0)
+		t.SaveTableInfo("info")
+		return
+	}
+	defer t.ReleaseDigestLock()
+
+	Debug("SAVING", len(t.newRecords), "SESSIONS TO", t.Name)
+	t.SaveRecordsToColumns()
+}
+
+// }}} SESSION TABLES
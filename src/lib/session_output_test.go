@@ -0,0 +1,113 @@
+package sybil_test
+
+import sybil "./"
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path"
+import "strconv"
+import "testing"
+
+var TEST_SESSION_TABLE_NAME = "__TEST3__"
+
+func TestSessionOutputTable(test *testing.T) {
+	delete_test_db()
+	os.RemoveAll(fmt.Sprintf("db/%s", TEST_SESSION_TABLE_NAME))
+	delete(sybil.LOADED_TABLES, TEST_SESSION_TABLE_NAME)
+
+	reset_flags := setup_session_flags("user")
+	defer reset_flags()
+
+	// 10 USERS WITH 2 SESSIONS OF 10 EVENTS EACH, A DAY APART
+	block_count := 2
+	add_records(func(r *sybil.Record, index int) {
+		user, pos := index%10, index/10
+		day := int64(pos / 10)
+
+		r.AddIntField("time", day*86400+int64(user*1000+pos%10*60))
+		r.AddStrField("user", fmt.Sprintf("u%d", user))
+		r.AddIntField("bytes", int64(user))
+	}, block_count)
+
+	nt := save_and_reload_table(test, block_count)
+
+	aggs, _ := sybil.ParseSessionAggs("sum:bytes")
+	sessionSpec := sybil.NewSessionSpec()
+	sessionSpec.Aggs = aggs
+	sessionSpec.Output = sybil.GetTable(TEST_SESSION_TABLE_NAME)
+
+	querySpec := new_query_spec()
+	sybil.LoadAndSessionize([]*sybil.Table{nt}, querySpec, &sessionSpec)
+
+	delete(sybil.LOADED_TABLES, TEST_SESSION_TABLE_NAME)
+	st := sybil.GetTable(TEST_SESSION_TABLE_NAME)
+	st.LoadTableInfo()
+
+	loadSpec := st.NewLoadSpec()
+	loadSpec.LoadAllColumns = true
+	if count := st.LoadRecords(&loadSpec); count != 20 {
+		test.Fatal("EXPECTED 20 SESSIONS IN THE OUTPUT TABLE, GOT", count)
+	}
+
+	sessionQuery := new_query_spec()
+	sessionQuery.Groups = append(sessionQuery.Groups, st.Grouping("user"))
+	sessionQuery.Aggregations = append(sessionQuery.Aggregations, st.Aggregation("duration", "avg"), st.Aggregation("events", "avg"), st.Aggregation("sum_bytes", "avg"))
+	st.MatchAndAggregate(sessionQuery)
+
+	for i := 0; i < 10; i++ {
+		r, ok := sessionQuery.Results[fmt.Sprintf("u%d", i)+sybil.GROUP_DELIMITER]
+		if !ok || r.Count != 2 {
+			test.Error("EXPECTED 2 SESSIONS FOR USER", i, r)
+			continue
+		}
+
+		if r.Hists["duration"].Mean() != 540 || r.Hists["events"].Mean() != 10 || r.Hists["sum_bytes"].Mean() != float64(i*10) {
+			test.Error("WRONG SESSION VALUES FOR USER", i, r.Hists["duration"].Mean(), r.Hists["events"].Mean(), r.Hists["sum_bytes"].Mean())
+		}
+	}
+
+	// WHILE ANOTHER PROCESS HOLDS THE OUTPUT TABLE'S DIGEST LOCK, THE
+	// SESSIONS GO TO ITS INGESTION LOG INSTEAD OF ITS BLOCKS
+	os.RemoveAll(fmt.Sprintf("db/%s", TEST_SESSION_TABLE_NAME))
+	delete(sybil.LOADED_TABLES, TEST_SESSION_TABLE_NAME)
+	os.MkdirAll(fmt.Sprintf("db/%s", TEST_SESSION_TABLE_NAME), 0777)
+
+	lockfile := path.Join("db", TEST_SESSION_TABLE_NAME, sybil.STOMACHE_DIR+".lock")
+	ioutil.WriteFile(lockfile, []byte(strconv.Itoa(os.Getppid())), 0666)
+
+	unload_test_table()
+	nt = sybil.GetTable(TEST_TABLE_NAME)
+	nt.LoadTableInfo()
+	nt.LoadRecords(nil)
+
+	sessionSpec = sybil.NewSessionSpec()
+	sessionSpec.Output = sybil.GetTable(TEST_SESSION_TABLE_NAME)
+
+	sybil.LoadAndSessionize([]*sybil.Table{nt}, new_query_spec(), &sessionSpec)
+	os.Remove(lockfile)
+
+	prev_read_log := sybil.FLAGS.READ_INGESTION_LOG
+	sybil.FLAGS.READ_INGESTION_LOG = &sybil.FALSE
+	delete(sybil.LOADED_TABLES, TEST_SESSION_TABLE_NAME)
+	st = sybil.GetTable(TEST_SESSION_TABLE_NAME)
+	st.LoadTableInfo()
+
+	if count := st.LoadRecords(nil); count != 0 {
+		test.Error("SAVED SESSIONS TO BLOCKS WITHOUT THE DIGEST LOCK", count)
+	}
+
+	sybil.FLAGS.READ_INGESTION_LOG = &sybil.TRUE
+	delete(sybil.LOADED_TABLES, TEST_SESSION_TABLE_NAME)
+	st = sybil.GetTable(TEST_SESSION_TABLE_NAME)
+	st.LoadTableInfo()
+
+	if count := st.LoadRecords(nil); count != 20 {
+		test.Error("EXPECTED 20 SESSIONS IN THE INGESTION LOG, GOT", count)
+	}
+	sybil.FLAGS.READ_INGESTION_LOG = prev_read_log
+
+	os.RemoveAll(fmt.Sprintf("db/%s", TEST_SESSION_TABLE_NAME))
+	delete(sybil.LOADED_TABLES, TEST_SESSION_TABLE_NAME)
+	delete_test_db()
+}
@@ -0,0 +1,312 @@
+package sybil
+
+import "bytes"
+import "encoding/gob"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "sort"
+
+// {{{ SESSION SPILLING
+
+// Active sessions keep their records in memory until they close, so keys that
+// never go quiet (bots, shared IPs) can hold on to a lot of records. With a
+// memory budget (-session-mem), the records of the oldest active sessions are
+// written to spill files in the table directory and read back once their
+// session can close. The budget is checked every BLOCKS_BEFORE_GC blocks.
+
+var SPILL_DIR = ".session.spill"
+
+// records are spilled with the values of their string and set columns
+// instead of ids into their block's string tables, so the spill doesn't hold
+// on to the blocks. they are read back into a new block per session
+type SpilledRecord struct {
+	Table     string
+	Strs      map[int16]string
+	Ints      []IntField
+	Sets      map[int16][]string
+	Populated []int8
+	Timestamp int64
+	Path      string
+}
+
+func newSpilledRecord(r *Record) SpilledRecord {
+	sr := SpilledRecord{Table: r.block.table.Name, Ints: r.Ints, Populated: r.Populated, Timestamp: r.Timestamp, Path: r.Path}
+
+	for i, p := range r.Populated {
+		field_id := int16(i)
+		switch p {
+		case STR_VAL:
+			if sr.Strs == nil {
+				sr.Strs = make(map[int16]string)
+			}
+			col := r.block.GetColumnInfo(field_id)
+			sr.Strs[field_id] = col.get_string_for_val(int32(r.Strs[field_id]))
+		case SET_VAL:
+			if sr.Sets == nil {
+				sr.Sets = make(map[int16][]string)
+			}
+			col := r.block.GetColumnInfo(field_id)
+			vals := make([]string, len(r.SetMap[field_id]))
+			for j, v := range r.SetMap[field_id] {
+				vals[j] = col.get_string_for_val(v)
+			}
+			sr.Sets[field_id] = vals
+		}
+	}
+
+	return sr
+}
+
+// toRecord turns the spilled record back into a record of the block, adding
+// its strings to the block's columns
+func (sr SpilledRecord) toRecord(block *TableBlock) *Record {
+	r := Record{Ints: sr.Ints, Populated: sr.Populated, Timestamp: sr.Timestamp, Path: sr.Path}
+	r.block = block
+
+	if len(sr.Strs) > 0 {
+		r.Strs = make([]StrField, len(sr.Populated))
+		for field_id, val := range sr.Strs {
+			r.Strs[field_id] = StrField(block.GetColumnInfo(field_id).get_val_id(val))
+		}
+	}
+
+	if len(sr.Sets) > 0 {
+		r.SetMap = make(SetMap)
+		for field_id, vals := range sr.Sets {
+			col := block.GetColumnInfo(field_id)
+			set := make(SetField, len(vals))
+			for i, val := range vals {
+				set[i] = col.get_val_id(val)
+			}
+			r.SetMap[field_id] = set
+		}
+	}
+
+	return &r
+}
+
+// recordMemory approximates the bytes a record holds in an active session
+func recordMemory(r *Record) int64 {
+	return int64(64 + len(r.Populated)*13 + len(r.Path))
+}
+
+func (sl *SessionList) MemoryUsage() int64 {
+	usage := int64(0)
+	for _, as := range sl.List {
+		for _, r := range as.Records {
+			usage += recordMemory(r)
+		}
+	}
+
+	return usage
+}
+
+type sortSessionsByStart struct {
+	keys   []string
+	starts map[string]int64
+}
+
+func (s sortSessionsByStart) Len() int      { return len(s.keys) }
+func (s sortSessionsByStart) Swap(i, j int) { s.keys[i], s.keys[j] = s.keys[j], s.keys[i] }
+func (s sortSessionsByStart) Less(i, j int) bool {
+	return s.starts[s.keys[i]] < s.starts[s.keys[j]]
+}
+
+// Spill writes out the records of the oldest active sessions until the rest
+// fit in 3/4 of the memory budget and returns the number of sessions spilled
+func (sl *SessionList) Spill() int {
+	if sl.MemoryBudget <= 0 || sl.SpillDir == "" {
+		return 0
+	}
+
+	usage := sl.MemoryUsage()
+	if usage <= sl.MemoryBudget {
+		return 0
+	}
+
+	starts := make(map[string]int64)
+	keys := make([]string, 0)
+	for key, as := range sl.List {
+		if len(as.Records) == 0 {
+			continue
+		}
+
+		start := as.Records[0].Timestamp
+		for _, r := range as.Records {
+			if r.Timestamp < start {
+				start = r.Timestamp
+			}
+		}
+		if len(as.Spilled) > 0 {
+			start = as.SpilledStart
+		}
+
+		starts[key] = start
+		keys = append(keys, key)
+	}
+
+	sort.Sort(sortSessionsByStart{keys, starts})
+
+	spilled := 0
+	for _, key := range keys {
+		if usage <= sl.MemoryBudget*3/4 {
+			break
+		}
+
+		as := sl.List[key]
+		size := int64(0)
+		for _, r := range as.Records {
+			size += recordMemory(r)
+		}
+
+		err := sl.spillSession(as)
+		if err != nil {
+			Warn("COULDNT SPILL SESSION", key, err)
+			break
+		}
+
+		usage -= size
+		spilled++
+	}
+
+	Debug("SPILLED", spilled, "SESSIONS TO", sl.SpillDir)
+	return spilled
+}
+
+func (sl *SessionList) spillSession(as *ActiveSession) error {
+	err := os.MkdirAll(sl.SpillDir, 0777)
+	if err != nil {
+		return err
+	}
+
+	records := make([]SpilledRecord, len(as.Records))
+	for i, r := range as.Records {
+		records[i] = newSpilledRecord(r)
+
+		if len(as.Spilled) == 0 && i == 0 || r.Timestamp < as.SpilledStart {
+			as.SpilledStart = r.Timestamp
+		}
+		if r.Timestamp > as.SpilledEnd {
+			as.SpilledEnd = r.Timestamp
+		}
+	}
+
+	var network bytes.Buffer
+	enc := gob.NewEncoder(&network)
+	err = enc.Encode(records)
+	if err != nil {
+		return err
+	}
+
+	w, err := ioutil.TempFile(sl.SpillDir, "session_")
+	if err != nil {
+		return err
+	}
+
+	_, err = network.WriteTo(w)
+	w.Close()
+	if err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+
+	as.Spilled = append(as.Spilled, w.Name())
+	as.SpilledEvents += len(records)
+	as.Records = nil
+
+	return nil
+}
+
+// restoreSession reads a session's spilled records back into memory. the
+// records of each table get one new block for their strings
+func (sl *SessionList) restoreSession(as *ActiveSession) error {
+	blocks := make(map[string]*TableBlock)
+	for _, filename := range as.Spilled {
+		var records []SpilledRecord
+		err := decodeInto(filename, &records)
+		if err != nil {
+			return fmt.Errorf("couldn't read spilled session %s: %s", filename, err)
+		}
+
+		for _, sr := range records {
+			block, ok := blocks[sr.Table]
+			if !ok {
+				tb := newTableBlock()
+				tb.Name = SPILL_DIR
+				tb.table = GetTable(sr.Table)
+				block = &tb
+				blocks[sr.Table] = block
+			}
+
+			as.Records = append(as.Records, sr.toRecord(block))
+		}
+
+		os.Remove(filename)
+	}
+
+	as.Spilled = nil
+	as.SpilledEvents = 0
+	as.SpilledStart = 0
+	as.SpilledEnd = 0
+
+	return nil
+}
+
+// canClose is true when a spilled session may close by the timestamp: it went
+// quiet, a newer record leaves a gap after it or it hit a session cap. Until
+// then its records can stay on disk. The in memory records must be sorted.
+func (as *ActiveSession) canClose(timestamp int) bool {
+	session_cutoff := int64(*FLAGS.SESSION_CUTOFF * 60)
+	events := as.SpilledEvents
+	last := as.SpilledEnd
+
+	for _, r := range as.Records {
+		if r.Timestamp < last || r.Timestamp-last > session_cutoff {
+			return true
+		}
+
+		events++
+		last = r.Timestamp
+	}
+
+	if int64(timestamp)-last > session_cutoff {
+		return true
+	}
+
+	if *FLAGS.SESSION_MAX_EVENTS > 0 && events >= *FLAGS.SESSION_MAX_EVENTS {
+		return true
+	}
+
+	return *FLAGS.SESSION_MAX_LENGTH > 0 && last-as.SpilledStart > int64(*FLAGS.SESSION_MAX_LENGTH*60)
+}
+
+// RemoveSpills deletes the spill dir with the spill files that are left
+func (sl *SessionList) RemoveSpills() {
+	if sl.SpillDir == "" {
+		return
+	}
+
+	for _, as := range sl.List {
+		as.Spilled = nil
+	}
+
+	os.RemoveAll(sl.SpillDir)
+}
+
+// sessionCapped is true when a session can't take another event at the time,
+// because it has -max-session-events events or started more than
+// -max-session-length minutes before
+func sessionCapped(session RecordList, time_val int) bool {
+	if len(session) == 0 {
+		return false
+	}
+
+	if *FLAGS.SESSION_MAX_EVENTS > 0 && len(session) >= *FLAGS.SESSION_MAX_EVENTS {
+		return true
+	}
+
+	return *FLAGS.SESSION_MAX_LENGTH > 0 && time_val-int(session[0].Timestamp) > *FLAGS.SESSION_MAX_LENGTH*60
+}
+
+// }}} SESSION SPILLING
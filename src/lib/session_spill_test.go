@@ -0,0 +1,125 @@
+package sybil_test
+
+import sybil "./"
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path"
+import "testing"
+
+// sessionizes the test table with a tiny memory budget and loads the sessions
+// from the output table
+func run_spilled_sessions(test *testing.T, filters ...sybil.SessionFilter) *sybil.Table {
+	unload_test_table()
+	nt := sybil.GetTable(TEST_TABLE_NAME)
+	nt.LoadTableInfo()
+	nt.LoadRecords(nil)
+
+	os.RemoveAll(fmt.Sprintf("db/%s", TEST_SESSION_TABLE_NAME))
+	delete(sybil.LOADED_TABLES, TEST_SESSION_TABLE_NAME)
+
+	// A RUN THAT FAILED LEFT A SPILL BEHIND
+	spill_dir := path.Join(*sybil.FLAGS.DIR, nt.Name, sybil.SPILL_DIR)
+	os.MkdirAll(spill_dir, 0777)
+	ioutil.WriteFile(path.Join(spill_dir, "session_stale"), []byte("garbage"), 0666)
+
+	sessionSpec := sybil.NewSessionSpec()
+	sessionSpec.MemoryBudget = 1
+	sessionSpec.Filters = filters
+	sessionSpec.Output = sybil.GetTable(TEST_SESSION_TABLE_NAME)
+
+	if _, err := sybil.LoadAndSessionize([]*sybil.Table{nt}, new_query_spec(), &sessionSpec); err != nil {
+		test.Error("COULDNT SESSIONIZE", err)
+	}
+
+	if _, err := os.Stat(spill_dir); err == nil {
+		test.Error("SPILL DIR WASNT REMOVED")
+	}
+
+	delete(sybil.LOADED_TABLES, TEST_SESSION_TABLE_NAME)
+	st := sybil.GetTable(TEST_SESSION_TABLE_NAME)
+	st.LoadTableInfo()
+
+	loadSpec := st.NewLoadSpec()
+	loadSpec.LoadAllColumns = true
+	st.LoadRecords(&loadSpec)
+	return st
+}
+
+func single_result(test *testing.T, querySpec *sybil.QuerySpec) *sybil.Result {
+	for _, r := range querySpec.Results {
+		return r
+	}
+
+	test.Fatal("NO SESSIONS IN THE OUTPUT TABLE")
+	return nil
+}
+
+func TestSpilledSessions(test *testing.T) {
+	delete_test_db()
+
+	reset_flags := setup_session_flags("user")
+	defer reset_flags()
+
+	// 10 USERS WITH AN EVENT EVERY MINUTE ACROSS ALL BLOCKS, SO THEIR SESSIONS
+	// ARE SPILLED AT EVERY CHECK
+	block_count := 20
+	add_records(func(r *sybil.Record, index int) {
+		user, pos := index%10, index/10
+
+		r.AddIntField("time", int64(pos*60+user))
+		r.AddStrField("user", fmt.Sprintf("u%d", user))
+		if user < 5 && pos == 150 {
+			r.AddStrField("page", "cart")
+		} else {
+			r.AddStrField("page", "home")
+		}
+	}, block_count)
+
+	save_and_reload_table(test, block_count)
+
+	st := run_spilled_sessions(test)
+	sessionQuery := new_query_spec()
+	sessionQuery.Aggregations = append(sessionQuery.Aggregations, st.Aggregation("events", "avg"), st.Aggregation("duration", "avg"))
+	st.MatchAndAggregate(sessionQuery)
+
+	r := single_result(test, sessionQuery)
+	if r.Count != 10 || r.Hists["events"].Mean() != 200 || r.Hists["duration"].Mean() != 199*60 {
+		test.Error("WRONG SPILLED SESSIONS", r.Count, r.Hists["events"].Mean(), r.Hists["duration"].Mean())
+	}
+
+	// THE PAGES OF SPILLED RECORDS ARE STILL THERE AFTER THEY ARE READ BACK
+	sf, err := sybil.ParseSessionFilter("contains:page=cart")
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	st = run_spilled_sessions(test, sf)
+	sessionQuery = new_query_spec()
+	sessionQuery.Aggregations = append(sessionQuery.Aggregations, st.Aggregation("events", "avg"))
+	st.MatchAndAggregate(sessionQuery)
+
+	r = single_result(test, sessionQuery)
+	if r.Count != 5 || r.Hists["events"].Mean() != 200 {
+		test.Error("WRONG FILTERED SPILLED SESSIONS", r.Count, r.Hists["events"].Mean())
+	}
+
+	// CAPPING SESSIONS AT 50 EVENTS SPLITS EACH ONE IN 4
+	max_events := 50
+	sybil.FLAGS.SESSION_MAX_EVENTS = &max_events
+
+	st = run_spilled_sessions(test)
+	sessionQuery = new_query_spec()
+	sessionQuery.Aggregations = append(sessionQuery.Aggregations, st.Aggregation("events", "avg"))
+	st.MatchAndAggregate(sessionQuery)
+
+	r = single_result(test, sessionQuery)
+	if r.Count != 40 || r.Hists["events"].Mean() != 50 {
+		test.Error("WRONG CAPPED SESSIONS", r.Count, r.Hists["events"].Mean())
+	}
+
+	os.RemoveAll(fmt.Sprintf("db/%s", TEST_SESSION_TABLE_NAME))
+	delete(sybil.LOADED_TABLES, TEST_SESSION_TABLE_NAME)
+	delete_test_db()
+}
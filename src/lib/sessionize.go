@@ -1,8 +1,10 @@
 package sybil
 
 import "fmt"
+import "math"
 
 import "os"
+import "path"
 import "sort"
 import "strings"
 import "strconv"
@@ -12,8 +14,8 @@ import "bytes"
 import "runtime/debug"
 
 // TODO:
-// * add first pass at filters
-// * add event level aggregations for a session
+// x add first pass at filters
+// x add event level aggregations for a session
 
 // GOALS:
 // Query support: "time spent on site", "retention", "common paths"
@@ -29,13 +31,18 @@ import "runtime/debug"
 // filter: event1 follows event2
 // filter: event2 does not exist
 // filter: event1 does not follow event2
+//
+// see session_filter.go, filters are checked when a session closes
 
 // SESSION AGGREGATIONS
 // x length of sessions
+// x sum, min, max and avg of int columns per session (see session_agg.go)
 // x actions per session
 // x frequency of sessions (by calendar day)
 // x common session patterns (pathing)
+// x path flows, step by step transitions of the path (see path_flow.go)
 // * number of actions per fixed time period
+// x funnels (sessions that reach each of a list of events, in order)
 
 var SINGLE_EVENT_DURATION = int64(30) // i think this means 30 seconds
 var BLOCKS_BEFORE_GC = 8
@@ -45,6 +52,15 @@ type SessionSpec struct {
 
 	Sessions SessionList
 	Count    int
+
+	Funnel  *Funnel
+	Filters []SessionFilter
+	Cohorts *CohortSpec
+	Aggs    []SessionAgg
+	Output  *Table
+	Flow    *PathFlow
+
+	MemoryBudget int64 // bytes of active session records before spilling
 }
 
 func NewSessionSpec() SessionSpec {
@@ -56,8 +72,27 @@ func NewSessionSpec() SessionSpec {
 	return ss
 }
 
-func (ss *SessionSpec) ExpireRecords() {
-	ss.Count += ss.Sessions.ExpireRecords()
+// resolves the columns of the funnel, session filters, aggregations and path
+// anchor in the table, before its blocks are sessionized concurrently
+func (ss *SessionSpec) resolveColumns(t *Table) {
+	if ss.Funnel != nil {
+		ss.Funnel.resolveColumns(t)
+	}
+	for _, sf := range ss.Filters {
+		sf.resolveColumns(t)
+	}
+	for _, sa := range ss.Aggs {
+		sa.resolveColumns(t)
+	}
+	if ss.Flow != nil && ss.Flow.Anchor != nil {
+		ss.Flow.Anchor.resolveColumn(t)
+	}
+}
+
+func (ss *SessionSpec) ExpireRecords() error {
+	count, err := ss.Sessions.ExpireRecords()
+	ss.Count += count
+	return err
 }
 
 type Sessions map[string]*ActiveSession
@@ -66,6 +101,15 @@ type SessionList struct {
 
 	JoinTable *Table
 	Results   map[string]*SessionStats
+	Funnel    *Funnel
+	Filters   []SessionFilter
+	Cohorts   *CohortSpec
+	Aggs      []SessionAgg
+	Output    *Table
+	Flow      *PathFlow
+
+	MemoryBudget int64
+	SpillDir     string
 
 	PathCounts  map[string]int
 	PathUniques map[string]int
@@ -74,28 +118,76 @@ type SessionList struct {
 	LastExpiration int
 }
 
-func (sl *SessionList) ExpireRecords() int {
+func (sl *SessionList) ExpireRecords() (int, error) {
 	if sl.LastExpiration == sl.Expiration {
-		return 0
+		return 0, nil
 	}
 
 	count := 0
+	var err error
 	m := &sync.Mutex{}
 	var wg sync.WaitGroup
-	for _, as := range sl.List {
+	for key, as := range sl.List {
 		wg.Add(1)
 		bs := as
+		session_key := key
 		go func() {
 			sort.Sort(SortRecordsByTime{bs.Records})
 
-			sessions := bs.ExpireRecords(sl.Expiration)
+			if len(bs.Spilled) > 0 {
+				if !bs.canClose(sl.Expiration) {
+					wg.Done()
+					return
+				}
+
+				if restore_err := sl.restoreSession(bs); restore_err != nil {
+					m.Lock()
+					err = restore_err
+					m.Unlock()
+					wg.Done()
+					return
+				}
+				sort.Sort(SortRecordsByTime{bs.Records})
+			}
+
+			sessions := bs.ExpireRecords(sl.Expiration, sl.Filters)
 
 			for _, session := range sessions {
 				bs.Stats.SummarizeSession(session)
 			}
 
+			if sl.Funnel != nil && len(sessions) > 0 {
+				if bs.Stats.Funnel == nil {
+					bs.Stats.Funnel = NewFunnelStats(sl.Funnel)
+				}
+
+				for _, session := range sessions {
+					bs.Stats.Funnel.SummarizeSession(session)
+				}
+			}
+
+			if len(sl.Aggs) > 0 && len(sessions) > 0 {
+				if bs.Stats.Aggs == nil {
+					bs.Stats.Aggs = NewSessionAggStats(sl.Aggs)
+				}
+
+				for _, session := range sessions {
+					bs.Stats.Aggs.SummarizeSession(session)
+				}
+			}
+
 			m.Lock()
 			count += len(sessions)
+			if sl.Output != nil {
+				for _, session := range sessions {
+					sl.outputSession(session_key, session)
+				}
+			}
+			if sl.Flow != nil {
+				for _, session := range sessions {
+					sl.Flow.AddSession(session)
+				}
+			}
 			m.Unlock()
 
 			wg.Done()
@@ -107,17 +199,20 @@ func (sl *SessionList) ExpireRecords() int {
 
 	sl.LastExpiration = sl.Expiration
 
-	return count
+	return count, err
 }
 
 type ActiveSession struct {
 	Records RecordList
 	Stats   *SessionStats
 
-	Path       []string
-	PathKey    bytes.Buffer
-	PathLength int
-	PathStats  map[string]int
+	PathKey   bytes.Buffer
+	PathStats map[string]int
+
+	Spilled       []string // spill files with older records of the session
+	SpilledEvents int
+	SpilledStart  int64
+	SpilledEnd    int64
 }
 
 type SessionStats struct {
@@ -129,6 +224,9 @@ type SessionStats struct {
 	Calendar        *Calendar
 
 	SessionDelta BasicHist
+	Funnel       *FunnelStats
+	Cohorts      *CohortTable
+	Aggs         *SessionAggStats
 
 	LastSessionEnd int64
 }
@@ -136,6 +234,12 @@ type SessionStats struct {
 func NewSessionStats() *SessionStats {
 	ss := SessionStats{}
 	ss.Calendar = NewCalendar()
+
+	// session counts and durations have no column info to bound them
+	for _, h := range []*BasicHist{&ss.NumEvents, &ss.NumBounces, &ss.NumSessions, &ss.SessionDuration, &ss.Retention, &ss.SessionDelta} {
+		h.Info.Max = math.MaxInt64 / 10
+	}
+
 	return &ss
 }
 
@@ -147,6 +251,20 @@ func (ss *SessionStats) CombineStats(stats *SessionStats) {
 	ss.SessionDelta.Combine(&stats.SessionDelta)
 
 	ss.Calendar.CombineCalendar(stats.Calendar)
+
+	if stats.Funnel != nil {
+		if ss.Funnel == nil {
+			ss.Funnel = NewFunnelStats(stats.Funnel.funnel)
+		}
+		ss.Funnel.CombineFunnel(stats.Funnel)
+	}
+
+	if stats.Aggs != nil {
+		if ss.Aggs == nil {
+			ss.Aggs = NewSessionAggStats(stats.Aggs.aggs)
+		}
+		ss.Aggs.CombineAggs(stats.Aggs)
+	}
 }
 
 func (ss *SessionStats) SummarizeSession(records RecordList) {
@@ -195,6 +313,18 @@ func (ss *SessionStats) PrintStats(key string) {
 	}
 
 	fmt.Printf("  avg retention: %d days\n", int(ss.Retention.Avg))
+
+	if ss.Funnel != nil {
+		ss.Funnel.PrintFunnel()
+	}
+
+	if ss.Cohorts != nil {
+		ss.Cohorts.PrintCohorts()
+	}
+
+	if ss.Aggs != nil {
+		ss.Aggs.PrintAggs()
+	}
 }
 
 func (as *ActiveSession) AddRecord(r *Record) {
@@ -207,7 +337,9 @@ func (as *ActiveSession) IsExpired() bool {
 	return false
 }
 
-func (as *ActiveSession) ExpireRecords(timestamp int) []RecordList {
+// ExpireRecords splits off the sessions that ended before the timestamp,
+// keeping the ones that pass the session filters
+func (as *ActiveSession) ExpireRecords(timestamp int, filters []SessionFilter) []RecordList {
 	prev_time := 0
 
 	session_cutoff := *FLAGS.SESSION_CUTOFF * 60
@@ -217,8 +349,6 @@ func (as *ActiveSession) ExpireRecords(timestamp int) []RecordList {
 		return sessions
 	}
 
-	var path_key bytes.Buffer
-	var path_length = *FLAGS.PATH_LENGTH
 	current_session := make(RecordList, 0)
 
 	var avg_delta = 0.0
@@ -227,31 +357,12 @@ func (as *ActiveSession) ExpireRecords(timestamp int) []RecordList {
 	for _, r := range as.Records {
 		time_val := int(r.Timestamp)
 
-		if r.Path != "" {
-			path_val := r.Path
-
-			for i := 1; i < path_length; i++ {
-				as.Path[i-1] = as.Path[i]
-				path_key.WriteString(as.Path[i])
-				path_key.WriteString(GROUP_DELIMITER)
-			}
-
-			as.Path[path_length-1] = path_val
-
-			path_key.WriteString(r.Path)
-
-			if as.PathLength < path_length {
-				as.PathLength++
-			} else {
-				as.PathStats[path_key.String()]++
+		if prev_time > 0 && (time_val-prev_time > session_cutoff || sessionCapped(current_session, time_val)) {
+			if sessionMatchesFilters(current_session, filters) {
+				sessions = append(sessions, current_session)
+				as.addPathStats(current_session)
 			}
 
-			path_key.Reset()
-		}
-
-		if prev_time > 0 && time_val-prev_time > session_cutoff {
-			sessions = append(sessions, current_session)
-
 			current_session = make(RecordList, 0)
 			current_session = append(current_session, r.CopyRecord())
 
@@ -278,8 +389,11 @@ func (as *ActiveSession) ExpireRecords(timestamp int) []RecordList {
 		prev_time = time_val
 	}
 
-	if timestamp-prev_time > session_cutoff {
-		sessions = append(sessions, current_session)
+	if timestamp-prev_time > session_cutoff || sessionCapped(current_session, timestamp) {
+		if sessionMatchesFilters(current_session, filters) {
+			sessions = append(sessions, current_session)
+			as.addPathStats(current_session)
+		}
 
 		current_session = nil
 	}
@@ -289,12 +403,32 @@ func (as *ActiveSession) ExpireRecords(timestamp int) []RecordList {
 	return sessions
 }
 
+// counts the path n-grams of a closed session, the last PATH_LENGTH path
+// values up to each of its records
+func (as *ActiveSession) addPathStats(session RecordList) {
+	path_length := *FLAGS.PATH_LENGTH
+	path := make([]string, 0, path_length+1)
+	for _, r := range session {
+		if r.Path == "" {
+			continue
+		}
+
+		path = append(path, r.Path)
+		if len(path) > path_length {
+			path = path[1:]
+		}
+
+		if len(path) == path_length {
+			as.PathStats[strings.Join(path, GROUP_DELIMITER)]++
+		}
+	}
+}
+
 func (sl *SessionList) AddRecord(group_key string, r *Record) {
 	session, ok := sl.List[group_key]
 	if !ok {
 		session = &ActiveSession{}
 		session.Records = make(RecordList, 0)
-		session.Path = make([]string, *FLAGS.PATH_LENGTH)
 		session.PathStats = make(map[string]int)
 		session.Stats = NewSessionStats()
 		sl.List[group_key] = session
@@ -368,6 +502,13 @@ func (ss *SessionSpec) Finalize() {
 		}
 
 		stats.CombineStats(as.Stats)
+		if sl.Cohorts != nil {
+			if stats.Cohorts == nil {
+				stats.Cohorts = NewCohortTable(*sl.Cohorts)
+			}
+			stats.Cohorts.AddEntity(as.Stats.Calendar)
+		}
+
 		duration := as.Stats.Calendar.Max - as.Stats.Calendar.Min
 
 		retention := duration / int64(time.Hour.Seconds()*24)
@@ -393,7 +534,14 @@ func (ss *SessionSpec) PrintResults() {
 		Debug("AVERAGE EVENTS PER SESSIONS", ss.Count/len(ss.Sessions.List))
 	}
 
-	if *FLAGS.PATH_KEY != "" {
+	if ss.Sessions.Flow != nil {
+		if *FLAGS.JSON {
+			printJson(ss.Sessions.Flow.toJSON())
+			fmt.Println("")
+		} else {
+			ss.Sessions.Flow.PrintFlow()
+		}
+	} else if *FLAGS.PATH_KEY != "" {
 		if *FLAGS.JSON {
 			ret := make(map[string]interface{})
 			ret["uniques"] = ss.Sessions.PathUniques
@@ -403,6 +551,23 @@ func (ss *SessionSpec) PrintResults() {
 		} else {
 			Debug("PATHS", len(ss.Sessions.PathCounts))
 		}
+	} else if (ss.Sessions.Funnel != nil || ss.Sessions.Cohorts != nil || len(ss.Sessions.Aggs) > 0) && *FLAGS.JSON {
+		ret := make(map[string]interface{})
+		for key, s := range ss.Sessions.Results {
+			group := make(map[string]interface{})
+			if s.Funnel != nil {
+				group["funnel"] = s.Funnel.toJSON()
+			}
+			if s.Cohorts != nil {
+				group["cohorts"] = s.Cohorts.toJSON()
+			}
+			if s.Aggs != nil {
+				group["aggs"] = s.Aggs.toJSON()
+			}
+			ret[key] = group
+		}
+		printJson(ret)
+		fmt.Println("")
 	} else {
 		for key, s := range ss.Sessions.Results {
 			s.PrintStats(key)
@@ -490,14 +655,80 @@ func (a SortBlocksByEndTime) Less(i, j int) bool {
 	return a[i].Info.IntInfoMap[time_col].Max < a[j].Info.IntInfoMap[time_col].Max
 }
 
-func LoadAndSessionize(tables []*Table, querySpec *QuerySpec, sessionSpec *SessionSpec) int {
+// loadRowStoreBlock reads the records in a table's ingestion log into a block
+// with the time range of the records, so it sorts in with the column blocks
+func loadRowStoreBlock(t *Table) *TableBlock {
+	records := make(RecordList, 0)
+	t.LoadRowStoreRecords(INGEST_DIR, func(filename string, rows RecordList) {
+		if filename != NO_MORE_BLOCKS {
+			records = append(records, rows...)
+		}
+	})
+
+	// row store records don't have their time and path filled in by the
+	// column loader
+	time_id := t.get_key_id(*FLAGS.TIME_COL)
+	path_id := int16(-1)
+	if *FLAGS.PATH_KEY != "" {
+		path_id = t.get_key_id(*FLAGS.PATH_KEY)
+	}
+
+	info := IntInfo{}
+	timed := make(RecordList, 0, len(records))
+	for _, r := range records {
+		if int(time_id) >= len(r.Populated) || r.Populated[time_id] != INT_VAL {
+			continue
+		}
+
+		r.Timestamp = int64(r.Ints[time_id])
+		if path_id >= 0 && int(path_id) < len(r.Populated) && r.Populated[path_id] == STR_VAL {
+			r.Path, _ = r.GetStrVal(*FLAGS.PATH_KEY)
+		}
+
+		if len(timed) == 0 || r.Timestamp < info.Min {
+			info.Min = r.Timestamp
+		}
+		if len(timed) == 0 || r.Timestamp > info.Max {
+			info.Max = r.Timestamp
+		}
+
+		timed = append(timed, r)
+	}
+
+	if len(timed) == 0 {
+		return nil
+	}
+
+	block := TableBlock{Name: ROW_STORE_BLOCK, RecordList: timed, table: t}
+	block.Info = &SavedColumnInfo{NumRecords: int32(len(timed))}
+	block.Info.IntInfoMap = SavedIntInfo{*FLAGS.TIME_COL: &info}
+
+	return &block
+}
+
+func LoadAndSessionize(tables []*Table, querySpec *QuerySpec, sessionSpec *SessionSpec) (int, error) {
 
 	blocks := make(SortBlocksByTime, 0)
+	filterSpec := FilterSpec{Int: *FLAGS.INT_FILTERS, Str: *FLAGS.STR_FILTERS, Set: *FLAGS.SET_FILTERS}
 
+	skipped := 0
 	for _, t := range tables {
+		sessionSpec.resolveColumns(t)
+
+		// the int filters (including -since and -until) let us skip blocks
+		// that are outside the time range
+		filterLoadSpec := t.NewLoadSpec()
+		filterQuery := QuerySpec{}
+		filterQuery.Filters = BuildFilters(t, &filterLoadSpec, filterSpec)
+
 		for _, b := range t.BlockList {
 			block := t.LoadBlockFromDir(b.Name, nil, false)
 			if block != nil {
+				if !t.ShouldLoadBlockFromDir(b.Name, &filterQuery) {
+					skipped++
+					continue
+				}
+
 				if block.Info.IntInfoMap[*FLAGS.TIME_COL] != nil {
 					block.table = t
 					blocks = append(blocks, block)
@@ -508,10 +739,37 @@ func LoadAndSessionize(tables []*Table, querySpec *QuerySpec, sessionSpec *Sessi
 		}
 	}
 
+	// the ingestion log has the latest records, which aren't in any block yet.
+	// they are sorted in by time as one more block per table
+	if *FLAGS.READ_INGESTION_LOG {
+		for _, t := range tables {
+			block := loadRowStoreBlock(t)
+			if block != nil {
+				Debug("READ", len(block.RecordList), "RECORDS FROM THE INGESTION LOG OF", t.Name)
+				blocks = append(blocks, block)
+			}
+		}
+	}
+
 	sort.Sort(SortBlocksByTime(blocks))
 	Debug("SORTED BLOCKS", len(blocks))
+	Debug("SKIPPED", skipped, "BLOCKS BASED ON PRE FILTERS")
 
 	masterSession := NewSessionSpec()
+	masterSession.Sessions.Funnel = sessionSpec.Funnel
+	masterSession.Sessions.Filters = sessionSpec.Filters
+	masterSession.Sessions.Cohorts = sessionSpec.Cohorts
+	masterSession.Sessions.Aggs = sessionSpec.Aggs
+	masterSession.Sessions.Output = sessionSpec.Output
+	masterSession.Sessions.Flow = sessionSpec.Flow
+	masterSession.Sessions.MemoryBudget = sessionSpec.MemoryBudget
+	if len(tables) > 0 {
+		masterSession.Sessions.SpillDir = path.Join(*FLAGS.DIR, tables[0].Name, SPILL_DIR)
+	}
+	// a run that failed can leave its spills behind
+	masterSession.Sessions.RemoveSpills()
+	defer masterSession.Sessions.RemoveSpills()
+
 	// Setup the join table for the session spec
 	if *FLAGS.JOIN_TABLE != "" {
 		start := time.Now()
@@ -541,8 +799,6 @@ func LoadAndSessionize(tables []*Table, querySpec *QuerySpec, sessionSpec *Sessi
 	result_lock := sync.Mutex{}
 	count_lock := sync.Mutex{}
 
-	filterSpec := FilterSpec{Int: *FLAGS.INT_FILTERS, Str: *FLAGS.STR_FILTERS, Set: *FLAGS.SET_FILTERS}
-
 	for i, b := range blocks {
 
 		min_time := b.Info.IntInfoMap[*FLAGS.TIME_COL].Min
@@ -569,11 +825,27 @@ func LoadAndSessionize(tables []*Table, querySpec *QuerySpec, sessionSpec *Sessi
 				loadSpec.Str(col)
 			}
 			loadSpec.Int(*FLAGS.TIME_COL)
+			if sessionSpec.Funnel != nil {
+				sessionSpec.Funnel.loadColumns(this_block.table, &loadSpec)
+			}
+			for _, sf := range sessionSpec.Filters {
+				sf.loadColumns(this_block.table, &loadSpec)
+			}
+			for _, sa := range sessionSpec.Aggs {
+				sa.loadColumns(this_block.table, &loadSpec)
+			}
+			if sessionSpec.Flow != nil {
+				sessionSpec.Flow.loadColumns(this_block.table, &loadSpec)
+			}
 
 			filters := BuildFilters(this_block.table, &loadSpec, filterSpec)
 			blockQuery.Filters = filters
 
-			block := this_block.table.LoadBlockFromDir(this_block.Name, &loadSpec, false)
+			block := this_block
+			if this_block.Name != ROW_STORE_BLOCK {
+				block = this_block.table.LoadBlockFromDir(this_block.Name, &loadSpec, false)
+			}
+
 			if block != nil {
 
 				SessionizeRecords(blockQuery, &blockSession, &block.RecordList)
@@ -608,10 +880,17 @@ func LoadAndSessionize(tables []*Table, querySpec *QuerySpec, sessionSpec *Sessi
 
 			result_lock.Lock()
 			masterSession.Sessions.NoMoreRecordsBefore(int(min_time))
-			masterSession.ExpireRecords()
+			err := masterSession.ExpireRecords()
+			if err == nil {
+				masterSession.Sessions.Spill()
+			}
 
 			result_lock.Unlock()
 
+			if err != nil {
+				return count, err
+			}
+
 		}
 
 	}
@@ -621,7 +900,10 @@ func LoadAndSessionize(tables []*Table, querySpec *QuerySpec, sessionSpec *Sessi
 	fmt.Fprintf(os.Stderr, "+")
 	session_cutoff := *FLAGS.SESSION_CUTOFF * 60
 	masterSession.Sessions.NoMoreRecordsBefore(int(max_time) + 2*session_cutoff)
-	masterSession.ExpireRecords()
+	if err := masterSession.ExpireRecords(); err != nil {
+		return count, err
+	}
+	masterSession.Sessions.SaveOutput()
 	fmt.Fprintf(os.Stderr, "\n")
 	Debug("INSPECTED", count, "RECORDS")
 
@@ -629,6 +911,6 @@ func LoadAndSessionize(tables []*Table, querySpec *QuerySpec, sessionSpec *Sessi
 	masterSession.Finalize()
 	masterSession.PrintResults()
 
-	return count
+	return count, nil
 
 }
@@ -0,0 +1,72 @@
+package sybil_test
+
+import sybil "./"
+
+import "fmt"
+import "os"
+import "testing"
+
+func TestSessionsWithIngestionLog(test *testing.T) {
+	delete_test_db()
+	os.RemoveAll(fmt.Sprintf("db/%s", TEST_SESSION_TABLE_NAME))
+	delete(sybil.LOADED_TABLES, TEST_SESSION_TABLE_NAME)
+
+	reset_flags := setup_session_flags("user")
+	defer reset_flags()
+
+	// 10 USERS WITH AN EVENT EVERY MINUTE, THE LAST 10 EVENTS OF EACH ARE ONLY
+	// IN THE INGESTION LOG
+	offset := 0
+	add_user_events := func(r *sybil.Record, index int) {
+		user, pos := index%10, (offset+index)/10
+
+		r.AddIntField("time", int64(pos*60+user))
+		r.AddStrField("user", fmt.Sprintf("u%d", user))
+	}
+
+	t := sybil.GetTable(TEST_TABLE_NAME)
+	add_records(add_user_events, 2)
+	t.SaveRecordsToColumns()
+
+	offset = 2 * sybil.CHUNK_SIZE
+	add_records(add_user_events, 1)
+	t.IngestRecords("ingest")
+
+	unload_test_table()
+	nt := sybil.GetTable(TEST_TABLE_NAME)
+	nt.LoadTableInfo()
+	nt.LoadRecords(nil)
+
+	prev_read_log := sybil.FLAGS.READ_INGESTION_LOG
+	sybil.FLAGS.READ_INGESTION_LOG = &sybil.TRUE
+	defer func() { sybil.FLAGS.READ_INGESTION_LOG = prev_read_log }()
+
+	sessionSpec := sybil.NewSessionSpec()
+	sessionSpec.Output = sybil.GetTable(TEST_SESSION_TABLE_NAME)
+	sybil.LoadAndSessionize([]*sybil.Table{nt}, new_query_spec(), &sessionSpec)
+
+	delete(sybil.LOADED_TABLES, TEST_SESSION_TABLE_NAME)
+	st := sybil.GetTable(TEST_SESSION_TABLE_NAME)
+	st.LoadTableInfo()
+
+	loadSpec := st.NewLoadSpec()
+	loadSpec.LoadAllColumns = true
+	if count := st.LoadRecords(&loadSpec); count != 10 {
+		test.Fatal("EXPECTED 10 SESSIONS IN THE OUTPUT TABLE, GOT", count)
+	}
+
+	sessionQuery := new_query_spec()
+	sessionQuery.Groups = append(sessionQuery.Groups, st.Grouping("user"))
+	sessionQuery.Aggregations = append(sessionQuery.Aggregations, st.Aggregation("events", "avg"), st.Aggregation("duration", "avg"))
+	st.MatchAndAggregate(sessionQuery)
+
+	for key, r := range sessionQuery.Results {
+		if r.Hists["events"].Mean() != 30 || r.Hists["duration"].Mean() != 29*60 {
+			test.Error("SESSION IS MISSING EVENTS FROM THE INGESTION LOG", key, r.Hists["events"].Mean(), r.Hists["duration"].Mean())
+		}
+	}
+
+	os.RemoveAll(fmt.Sprintf("db/%s", TEST_SESSION_TABLE_NAME))
+	delete(sybil.LOADED_TABLES, TEST_SESSION_TABLE_NAME)
+	delete_test_db()
+}
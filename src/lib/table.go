@@ -31,6 +31,9 @@ type Table struct {
 	// This is used for join tables
 	join_lookup map[string]*Record
 
+	// the query's virtual columns by key id, they are never saved
+	virtual map[int16]VirtualColumn
+
 	string_id_m *sync.RWMutex
 	record_m    *sync.Mutex
 	block_m     *sync.Mutex
@@ -117,6 +120,15 @@ func (t *Table) populate_string_id_lookup() {
 	}
 }
 
+// looks up a column's id without adding it to the KeyTable
+func (t *Table) lookup_key_id(name string) (int16, bool) {
+	t.string_id_m.RLock()
+	defer t.string_id_m.RUnlock()
+
+	id, ok := t.KeyTable[name]
+	return id, ok
+}
+
 func (t *Table) get_key_id(name string) int16 {
 	t.string_id_m.RLock()
 	id, ok := t.KeyTable[name]
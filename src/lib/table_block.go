@@ -19,6 +19,8 @@ type TableBlock struct {
 	val_string_id_lookup map[int32]string
 	columns              map[int16]*TableColumn
 	broken_keys          map[string]int16
+
+	manifest []ColumnManifest // columns written to the block, see block_manifest.go
 }
 
 func newTableBlock() TableBlock {
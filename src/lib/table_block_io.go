@@ -144,6 +144,11 @@ func (t *Table) ShouldLoadBlockFromDir(dirname string, querySpec *QuerySpec) boo
 		// make the minima record and the maxima records...
 		switch fil := f.(type) {
 		case IntFilter:
+			// virtual columns have no saved min and max
+			if t.isVirtual(fil.FieldId) {
+				continue
+			}
+
 			if fil.Op == "gt" || fil.Op == "lt" {
 				if f.Filter(&min_record) != true && f.Filter(&max_record) != true {
 					add = false
@@ -211,6 +216,24 @@ func (t *Table) LoadBlockFromDir(dirname string, loadSpec *LoadSpec, load_record
 		return nil
 	}
 
+	// the manifest tells us the columns of version 2 blocks and how they are
+	// encoded, older blocks are listed from their directory
+	manifest := LoadBlockManifest(dirname)
+	var columns []ColumnManifest
+	size := int64(0)
+	switch {
+	case manifest == nil:
+		columns, size = listBlockColumns(dirname)
+	case manifest.Version > BLOCK_VERSION:
+		Warn("BLOCK", dirname, "HAS VERSION", manifest.Version, "BUT WE CAN ONLY READ UP TO", BLOCK_VERSION)
+		return nil
+	default:
+		columns = manifest.Columns
+		for _, col := range columns {
+			size += col.Size
+		}
+	}
+
 	t.block_m.Lock()
 	t.BlockList[dirname] = &tb
 	t.block_m.Unlock()
@@ -218,15 +241,8 @@ func (t *Table) LoadBlockFromDir(dirname string, loadSpec *LoadSpec, load_record
 	tb.allocateRecords(loadSpec, *info, load_records)
 	tb.Info = info
 
-	file, _ := os.Open(dirname)
-	files, _ := file.Readdir(-1)
-
-	size := int64(0)
-
-	for _, f := range files {
-		fname := f.Name()
-		fsize := f.Size()
-		size += fsize
+	for _, col := range columns {
+		fname := col.File
 
 		// over here, we have to accomodate .gz extension, i guess
 		if loadSpec != nil {
@@ -243,13 +259,13 @@ func (t *Table) LoadBlockFromDir(dirname string, loadSpec *LoadSpec, load_record
 
 		dec := GetFileDecoder(filename)
 
-		switch {
-		case strings.HasPrefix(fname, "str"):
-			tb.unpackStrCol(dec, *info)
-		case strings.HasPrefix(fname, "set"):
-			tb.unpackSetCol(dec, *info)
-		case strings.HasPrefix(fname, "int"):
-			tb.unpackIntCol(dec, *info)
+		switch col.Type {
+		case "str":
+			tb.unpackStrCol(dec, *info, col.Encoding)
+		case "set":
+			tb.unpackSetCol(dec, *info, col.Encoding)
+		case "int":
+			tb.unpackIntCol(dec, *info, col.Encoding)
 		}
 
 		dec.File.Close()
@@ -258,7 +274,6 @@ func (t *Table) LoadBlockFromDir(dirname string, loadSpec *LoadSpec, load_record
 
 	tb.Size = size
 
-	file.Close()
 	return &tb
 }
 
@@ -76,9 +76,24 @@ func (t *Table) SaveTableInfo(fname string) {
 }
 
 func getSaveTable(t *Table) *Table {
+	key_table := t.KeyTable
+	key_types := t.KeyTypes
+
+	// VIRTUAL COLUMNS ONLY EXIST FOR THE QUERY THAT DEFINED THEM
+	if len(t.virtual) > 0 {
+		key_table = make(map[string]int16)
+		key_types = make(map[int16]int8)
+		for name, id := range t.KeyTable {
+			if _, ok := t.virtual[id]; !ok {
+				key_table[name] = id
+				key_types[id] = t.KeyTypes[id]
+			}
+		}
+	}
+
 	return &Table{Name: t.Name,
-		KeyTable: t.KeyTable,
-		KeyTypes: t.KeyTypes,
+		KeyTable: key_table,
+		KeyTypes: key_types,
 		IntInfo:  t.IntInfo,
 		StrInfo:  t.StrInfo}
 }
@@ -174,6 +189,8 @@ func (t *Table) LoadTableInfoFrom(filename string) bool {
 		t.KeyTypes = saved_table.KeyTypes
 	}
 
+	t.restoreVirtuals()
+
 	if saved_table.IntInfo != nil {
 		t.IntInfo = saved_table.IntInfo
 	}
@@ -221,6 +238,8 @@ func file_looks_like_block(v os.FileInfo) bool {
 		return false
 	case v.Name() == CACHE_DIR:
 		return false
+	case v.Name() == SPILL_DIR:
+		return false
 	case strings.HasPrefix(v.Name(), STOMACHE_DIR):
 		return false
 	case strings.HasSuffix(v.Name(), "info.db"):
@@ -661,8 +680,13 @@ func (t *Table) LoadAndQueryRecords(loadSpec *LoadSpec, querySpec *QuerySpec) in
 
 		querySpec.Results = resultSpec.Results
 		querySpec.TimeResults = resultSpec.TimeResults
+		querySpec.CompareResults = resultSpec.CompareResults
+		querySpec.CompareTimeResults = resultSpec.CompareTimeResults
+		querySpec.Truncated = resultSpec.Truncated
 
-		SortResults(querySpec)
+		if !querySpec.partial {
+			FinalizeResults(querySpec)
+		}
 	}
 
 	t.WriteBlockCache()
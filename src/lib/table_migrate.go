@@ -0,0 +1,64 @@
+package sybil
+
+import "io/ioutil"
+import "path"
+import "sort"
+
+// MigrateBlocks rewrites the blocks of the table that are older than
+// BLOCK_VERSION in the current format. Each block is rewritten under its
+// block lock, into a partial block that replaces it once it is verified. It
+// returns the names of the migrated (or with dry_run, the old) blocks.
+func (t *Table) MigrateBlocks(dry_run bool) []string {
+	files, _ := ioutil.ReadDir(path.Join(*FLAGS.DIR, t.Name))
+
+	names := make([]string, 0)
+	for _, v := range files {
+		if v.IsDir() && file_looks_like_block(v) {
+			names = append(names, path.Join(*FLAGS.DIR, t.Name, v.Name()))
+		}
+	}
+	sort.Strings(names)
+
+	migrated := make([]string, 0)
+	for _, name := range names {
+		manifest := LoadBlockManifest(name)
+		if manifest != nil && manifest.Version >= BLOCK_VERSION {
+			continue
+		}
+
+		if dry_run {
+			migrated = append(migrated, name)
+			continue
+		}
+
+		if t.migrateBlock(name) {
+			migrated = append(migrated, name)
+		}
+	}
+
+	return migrated
+}
+
+func (t *Table) migrateBlock(filename string) bool {
+	if t.GrabBlockLock(filename) == false {
+		Warn("CANT MIGRATE BLOCK DUE TO LOCK", filename)
+		return false
+	}
+
+	defer t.ReleaseBlockLock(filename)
+
+	delete(t.BlockInfoCache, filename)
+	block := t.LoadBlockFromDir(filename, nil, true /* LOAD ALL RECORDS */)
+	if block == nil || len(block.RecordList) != int(block.Info.NumRecords) {
+		Warn("COULDNT LOAD BLOCK FOR MIGRATION", filename)
+		return false
+	}
+
+	if t.SaveRecordsToBlock(block.RecordList, filename) == false {
+		Warn("COULDNT REWRITE BLOCK", filename)
+		return false
+	}
+
+	Debug("MIGRATED BLOCK", filename, "TO VERSION", BLOCK_VERSION)
+	return true
+}
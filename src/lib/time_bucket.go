@@ -0,0 +1,279 @@
+package sybil
+
+import "fmt"
+import "regexp"
+import "sort"
+import "strconv"
+import "sync"
+import "time"
+
+// {{{ TIME BUCKETS
+
+// Time buckets are either a fixed number of seconds (aligned to the epoch, or
+// to the local midnight when a time zone is given) or a number of calendar
+// days, weeks or months. Calendar buckets follow the time zone, so a daily
+// bucket in America/New_York starts at the local midnight, even across DST.
+
+var MAX_FILLED_BUCKETS = 100 * 1000
+var SECONDS_PER_DAY = int64(24 * 60 * 60)
+
+var SECONDS_PER_UNIT = map[string]int{
+	"d":  24 * 60 * 60,
+	"w":  7 * 24 * 60 * 60,
+	"mo": 30 * 24 * 60 * 60,
+}
+
+var calendarBucket = regexp.MustCompile(`^(\d+)\s*(d|w|mo)$`)
+
+type TimeBucketer struct {
+	Size  int
+	Unit  string
+	Count int
+	Loc   *time.Location
+}
+
+// ParseTimeBucket parses a bucket like "3600", "90s", "15m", "1h", "1d", "1w"
+// or "1mo" into a size in seconds and a calendar unit (empty for fixed size
+// buckets). Calendar sizes are approximate, months count as 30 days.
+func ParseTimeBucket(bucket string) (int, string, error) {
+	if seconds, err := strconv.Atoi(bucket); err == nil {
+		if seconds <= 0 {
+			return 0, "", fmt.Errorf("time bucket must be positive: %s", bucket)
+		}
+		return seconds, "", nil
+	}
+
+	tokens := calendarBucket.FindStringSubmatch(bucket)
+	if tokens != nil {
+		count, _ := strconv.Atoi(tokens[1])
+		if count <= 0 {
+			return 0, "", fmt.Errorf("time bucket must be positive: %s", bucket)
+		}
+		return count * SECONDS_PER_UNIT[tokens[2]], tokens[2], nil
+	}
+
+	duration, err := time.ParseDuration(bucket)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid time bucket: %s", bucket)
+	}
+
+	if duration < time.Second {
+		return 0, "", fmt.Errorf("time bucket must be at least one second: %s", bucket)
+	}
+
+	return int(duration.Seconds()), "", nil
+}
+
+var tz_cache = make(map[string]*time.Location)
+var tz_lock = sync.Mutex{}
+
+// LoadTimeZone looks up (and caches) a location like "America/New_York". An
+// empty name means UTC and returns nil
+func LoadTimeZone(tz string) (*time.Location, error) {
+	if tz == "" {
+		return nil, nil
+	}
+
+	tz_lock.Lock()
+	defer tz_lock.Unlock()
+
+	loc, ok := tz_cache[tz]
+	if ok {
+		return loc, nil
+	}
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, err
+	}
+
+	tz_cache[tz] = loc
+	return loc, nil
+}
+
+func NewTimeBucketer(size int, unit string, tz string) *TimeBucketer {
+	b := TimeBucketer{Size: size, Unit: unit, Count: 1}
+
+	if unit_size, ok := SECONDS_PER_UNIT[unit]; ok && size >= unit_size {
+		b.Count = size / unit_size
+	}
+
+	loc, err := LoadTimeZone(tz)
+	if err != nil {
+		Warn("Couldn't load time zone", tz, "using UTC:", err)
+	}
+	b.Loc = loc
+
+	return &b
+}
+
+func (querySpec *QuerySpec) TimeBucketer() *TimeBucketer {
+	return NewTimeBucketer(querySpec.TimeBucket, querySpec.TimeBucketUnit, querySpec.TimeZone)
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+
+	return q
+}
+
+func floorMod(a, b int64) int64 {
+	return a - floorDiv(a, b)*b
+}
+
+func (b *TimeBucketer) location() *time.Location {
+	if b.Loc == nil {
+		return time.UTC
+	}
+
+	return b.Loc
+}
+
+// the number of days between the epoch and ts's local date
+func (b *TimeBucketer) localDays(ts int64) int64 {
+	t := time.Unix(ts, 0).In(b.location())
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix() / SECONDS_PER_DAY
+}
+
+func (b *TimeBucketer) dayStart(days int64) int64 {
+	return time.Date(1970, 1, 1+int(days), 0, 0, 0, 0, b.location()).Unix()
+}
+
+// Bucket returns the start of the bucket that ts falls into
+func (b *TimeBucketer) Bucket(ts int64) int64 {
+	count := int64(b.Count)
+
+	switch b.Unit {
+	case "d":
+		days := b.localDays(ts)
+		return b.dayStart(floorDiv(days, count) * count)
+	case "w":
+		// weeks start on monday, the epoch was a thursday
+		weeks := floorDiv(b.localDays(ts)+3, 7)
+		return b.dayStart(floorDiv(weeks, count)*count*7 - 3)
+	case "mo":
+		t := time.Unix(ts, 0).In(b.location())
+		months := int64(t.Year())*12 + int64(t.Month()) - 1
+		aligned := floorDiv(months, count) * count
+		return time.Date(int(aligned/12), time.Month(aligned%12+1), 1, 0, 0, 0, 0, b.location()).Unix()
+	}
+
+	size := int64(b.Size)
+	if b.Loc == nil {
+		return floorDiv(ts, size) * size
+	}
+
+	_, offset := time.Unix(ts, 0).In(b.Loc).Zone()
+	return floorDiv(ts+int64(offset), size)*size - int64(offset)
+}
+
+// Next returns the start of the bucket after the one starting at bucket
+func (b *TimeBucketer) Next(bucket int64) int64 {
+	t := time.Unix(bucket, 0).In(b.location())
+
+	var next int64
+	switch b.Unit {
+	case "d":
+		next = t.AddDate(0, 0, b.Count).Unix()
+	case "w":
+		next = t.AddDate(0, 0, 7*b.Count).Unix()
+	case "mo":
+		next = t.AddDate(0, b.Count, 0).Unix()
+	default:
+		next = b.Bucket(bucket + int64(b.Size))
+	}
+
+	if next <= bucket {
+		next = bucket + int64(b.Size)
+	}
+
+	return next
+}
+
+func (b *TimeBucketer) Format(bucket int64, format string) string {
+	return time.Unix(bucket, 0).In(b.location()).Format(format)
+}
+
+// returns the time range from the query's time column filters, the bounds
+// are missing if there is no gt or lt filter
+func (querySpec *QuerySpec) timeFilterRange() (int64, bool, int64, bool) {
+	var start, end int64
+	has_start, has_end := false, false
+
+	if FLAGS.TIME_COL == nil {
+		return start, has_start, end, has_end
+	}
+
+	for _, f := range querySpec.Filters {
+		filter, ok := f.(IntFilter)
+		if !ok || filter.Field != *FLAGS.TIME_COL {
+			continue
+		}
+
+		switch filter.Op {
+		case "gt":
+			if !has_start || int64(filter.Value)+1 > start {
+				start = int64(filter.Value) + 1
+			}
+			has_start = true
+		case "lt":
+			if !has_end || int64(filter.Value)-1 < end {
+				end = int64(filter.Value) - 1
+			}
+			has_end = true
+		}
+	}
+
+	return start, has_start, end, has_end
+}
+
+// returns the sorted time buckets to print. when filling, every bucket
+// between the query's time range (or the first and last buckets with data)
+// is included
+func (querySpec *QuerySpec) timeBucketKeys(fill string) []int {
+	keys := make([]int, 0, len(querySpec.TimeResults))
+	var min_bucket, max_bucket int64
+	for k := range querySpec.TimeResults {
+		if len(keys) == 0 || int64(k) < min_bucket {
+			min_bucket = int64(k)
+		}
+		if len(keys) == 0 || int64(k) > max_bucket {
+			max_bucket = int64(k)
+		}
+		keys = append(keys, k)
+	}
+
+	if fill == "" || querySpec.TimeBucket <= 0 {
+		sort.Ints(keys)
+		return keys
+	}
+
+	bucketer := querySpec.TimeBucketer()
+	start, has_start, end, has_end := querySpec.timeFilterRange()
+	if has_start {
+		min_bucket = bucketer.Bucket(start)
+	}
+	if has_end {
+		max_bucket = bucketer.Bucket(end)
+	}
+
+	if len(keys) == 0 && !(has_start && has_end) {
+		return keys
+	}
+
+	filled := make([]int, 0)
+	for bucket := min_bucket; bucket <= max_bucket; bucket = bucketer.Next(bucket) {
+		if len(filled) >= MAX_FILLED_BUCKETS {
+			Warn("Not filling more than", MAX_FILLED_BUCKETS, "time buckets")
+			break
+		}
+		filled = append(filled, int(bucket))
+	}
+
+	return filled
+}
+
+// }}} TIME BUCKETS
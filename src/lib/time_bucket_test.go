@@ -0,0 +1,76 @@
+package sybil_test
+
+import sybil "./"
+
+import "testing"
+import "time"
+
+func TestParseTimeBucket(test *testing.T) {
+	expected := map[string]int{
+		"3600": 3600,
+		"90s":  90,
+		"15m":  15 * 60,
+		"1h":   60 * 60,
+		"1d":   24 * 60 * 60,
+		"2w":   14 * 24 * 60 * 60,
+		"1mo":  30 * 24 * 60 * 60,
+	}
+
+	for bucket, size := range expected {
+		parsed, _, err := sybil.ParseTimeBucket(bucket)
+		if err != nil || parsed != size {
+			test.Error("PARSED TIME BUCKET", bucket, "AS", parsed, "EXPECTED", size, err)
+		}
+	}
+
+	for _, bucket := range []string{"", "0", "-5", "1y", "10ms"} {
+		if _, _, err := sybil.ParseTimeBucket(bucket); err == nil {
+			test.Error("EXPECTED AN ERROR FOR TIME BUCKET", bucket)
+		}
+	}
+}
+
+func TestCalendarTimeBuckets(test *testing.T) {
+	loc, err := sybil.LoadTimeZone("America/New_York")
+	if err != nil {
+		test.Skip("Skipping test without time zone data")
+		return
+	}
+
+	// 2017-03-12 is the day DST starts, so the day is only 23 hours long
+	ts := time.Date(2017, 3, 12, 22, 30, 0, 0, loc).Unix()
+
+	size, unit, _ := sybil.ParseTimeBucket("1d")
+	bucketer := sybil.NewTimeBucketer(size, unit, "America/New_York")
+	day := bucketer.Bucket(ts)
+	if day != time.Date(2017, 3, 12, 0, 0, 0, 0, loc).Unix() {
+		test.Error("DAILY BUCKET DOESNT START AT LOCAL MIDNIGHT", time.Unix(day, 0).In(loc))
+	}
+
+	if bucketer.Next(day)-day != 23*60*60 {
+		test.Error("DAILY BUCKET SHOULD BE 23 HOURS ON DST DAY", bucketer.Next(day)-day)
+	}
+
+	size, unit, _ = sybil.ParseTimeBucket("1w")
+	bucketer = sybil.NewTimeBucketer(size, unit, "America/New_York")
+	week := time.Unix(bucketer.Bucket(ts), 0).In(loc)
+	if week.Weekday() != time.Monday || week.Day() != 6 {
+		test.Error("WEEKLY BUCKET DOESNT START ON MONDAY", week)
+	}
+
+	size, unit, _ = sybil.ParseTimeBucket("1mo")
+	bucketer = sybil.NewTimeBucketer(size, unit, "America/New_York")
+	month := bucketer.Bucket(ts)
+	if month != time.Date(2017, 3, 1, 0, 0, 0, 0, loc).Unix() {
+		test.Error("MONTHLY BUCKET DOESNT START ON THE FIRST", time.Unix(month, 0).In(loc))
+	}
+
+	if bucketer.Next(month) != time.Date(2017, 4, 1, 0, 0, 0, 0, loc).Unix() {
+		test.Error("NEXT MONTHLY BUCKET DOESNT START ON THE FIRST", time.Unix(bucketer.Next(month), 0).In(loc))
+	}
+
+	bucketer = sybil.NewTimeBucketer(3600, "", "")
+	if bucketer.Bucket(7199) != 3600 {
+		test.Error("FIXED BUCKET MISALIGNED", bucketer.Bucket(7199))
+	}
+}
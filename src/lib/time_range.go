@@ -0,0 +1,198 @@
+package sybil
+
+import "fmt"
+import "regexp"
+import "strconv"
+import "strings"
+import "time"
+
+// {{{ TIME RANGES
+
+// The -since, -until and -range flags are shorthand for gt and lt int filters
+// on the time column. Values can be relative to now ("6h", "7d"), epoch
+// seconds or dates ("2026-10-01", "2026-10-01T00:00:00Z"). Ranges are either
+// "last-<duration>", "today", "yesterday" or "<start>..<end>". Dates without
+// an offset, today and yesterday are read in the -tz time zone (UTC without
+// one).
+
+type TimeRange struct {
+	Start    int64
+	End      int64
+	HasStart bool
+	HasEnd   bool
+}
+
+var relativeTime = regexp.MustCompile(`^(\d+)\s*(s|m|h|d|w)$`)
+
+var RELATIVE_UNITS = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+var TIME_RANGE_FORMATS = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// ParseRelativeDuration parses a duration like "6h" or "7d" into seconds
+func ParseRelativeDuration(val string) (int64, error) {
+	tokens := relativeTime.FindStringSubmatch(strings.TrimSpace(val))
+	if tokens == nil {
+		return 0, fmt.Errorf("invalid duration: %s", val)
+	}
+
+	count, _ := strconv.ParseInt(tokens[1], 10, 64)
+	return count * int64(RELATIVE_UNITS[tokens[2]].Seconds()), nil
+}
+
+// ParseTimeValue turns a relative duration, epoch seconds or a date into
+// epoch seconds
+func ParseTimeValue(val string, now time.Time) (int64, error) {
+	val = strings.TrimSpace(val)
+
+	if seconds, err := ParseRelativeDuration(val); err == nil {
+		return now.Unix() - seconds, nil
+	}
+
+	if epoch, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return epoch, nil
+	}
+
+	for _, format := range TIME_RANGE_FORMATS {
+		t, err := time.ParseInLocation(format, val, now.Location())
+		if err == nil {
+			return t.Unix(), nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid time: %s", val)
+}
+
+func ParseTimeRange(since string, until string, time_range string, now time.Time) (TimeRange, error) {
+	tr := TimeRange{}
+
+	if time_range != "" {
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+		switch {
+		case time_range == "today":
+			since = strconv.FormatInt(midnight.Unix(), 10)
+		case time_range == "yesterday":
+			since = strconv.FormatInt(midnight.AddDate(0, 0, -1).Unix(), 10)
+			until = strconv.FormatInt(midnight.Unix(), 10)
+		case strings.HasPrefix(time_range, "last-"):
+			since = strings.TrimPrefix(time_range, "last-")
+		case strings.Contains(time_range, ".."):
+			bounds := strings.SplitN(time_range, "..", 2)
+			since, until = bounds[0], bounds[1]
+		default:
+			return tr, fmt.Errorf("invalid time range: %s", time_range)
+		}
+	}
+
+	if since != "" {
+		start, err := ParseTimeValue(since, now)
+		if err != nil {
+			return tr, err
+		}
+		tr.Start, tr.HasStart = start, true
+	}
+
+	if until != "" {
+		end, err := ParseTimeValue(until, now)
+		if err != nil {
+			return tr, err
+		}
+		tr.End, tr.HasEnd = end, true
+	}
+
+	if tr.HasStart && tr.HasEnd && tr.Start >= tr.End {
+		return tr, fmt.Errorf("time range is empty: %s to %s", since, until)
+	}
+
+	return tr, nil
+}
+
+// IntFilters returns the range as int filter strings on col: records with
+// Start <= col < End pass
+func (tr TimeRange) IntFilters(col string) []string {
+	filters := make([]string, 0)
+	sep := *FLAGS.FILTER_SEPARATOR
+
+	if tr.HasStart {
+		filters = append(filters, strings.Join([]string{col, "gt", strconv.FormatInt(tr.Start-1, 10)}, sep))
+	}
+
+	if tr.HasEnd {
+		filters = append(filters, strings.Join([]string{col, "lt", strconv.FormatInt(tr.End, 10)}, sep))
+	}
+
+	return filters
+}
+
+// reads -since, -until and -range from the FLAGS
+func ParseTimeRangeFlags() (TimeRange, error) {
+	since, until, time_range := "", "", ""
+	if FLAGS.SINCE != nil {
+		since = *FLAGS.SINCE
+	}
+	if FLAGS.UNTIL != nil {
+		until = *FLAGS.UNTIL
+	}
+	if FLAGS.TIME_RANGE != nil {
+		time_range = *FLAGS.TIME_RANGE
+	}
+
+	now := time.Now().UTC()
+	if FLAGS.TIME_ZONE != nil {
+		loc, err := LoadTimeZone(*FLAGS.TIME_ZONE)
+		if err != nil {
+			return TimeRange{}, err
+		}
+		if loc != nil {
+			now = now.In(loc)
+		}
+	}
+
+	return ParseTimeRange(since, until, time_range, now)
+}
+
+// AddTimeRangeFilters appends the time range flags to the int filters, so
+// they go through BuildFilters (and its time bucket alignment) and block
+// skipping like any other time filter
+func AddTimeRangeFilters() error {
+	tr, err := ParseTimeRangeFlags()
+	if err != nil {
+		return err
+	}
+
+	return tr.AddIntFilters()
+}
+
+func (tr TimeRange) AddIntFilters() error {
+	filters := tr.IntFilters(*FLAGS.TIME_COL)
+	if len(filters) == 0 {
+		return nil
+	}
+
+	if *FLAGS.TIME_COL == "" {
+		return fmt.Errorf("time ranges require a -time-col")
+	}
+
+	if *FLAGS.INT_FILTERS != "" {
+		filters = append([]string{*FLAGS.INT_FILTERS}, filters...)
+	}
+
+	joined := strings.Join(filters, *FLAGS.FIELD_SEPARATOR)
+	FLAGS.INT_FILTERS = &joined
+	Debug("ADDED TIME RANGE FILTERS", joined)
+
+	return nil
+}
+
+// }}} TIME RANGES
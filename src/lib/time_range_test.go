@@ -0,0 +1,56 @@
+package sybil_test
+
+import sybil "./"
+
+import "fmt"
+import "testing"
+import "time"
+
+func TestParseTimeRange(test *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	tr, err := sybil.ParseTimeRange("6h", "", "", now)
+	if err != nil || !tr.HasStart || tr.HasEnd || tr.Start != now.Add(-6*time.Hour).Unix() {
+		test.Error("UNEXPECTED RANGE FOR -since 6h", tr, err)
+	}
+
+	tr, err = sybil.ParseTimeRange("", "2026-10-01T00:00:00Z", "", now)
+	if err != nil || tr.HasStart || !tr.HasEnd || tr.End != time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC).Unix() {
+		test.Error("UNEXPECTED RANGE FOR -until", tr, err)
+	}
+
+	tr, err = sybil.ParseTimeRange("", "", "last-7d", now)
+	if err != nil || tr.Start != now.AddDate(0, 0, -7).Unix() {
+		test.Error("UNEXPECTED RANGE FOR -range last-7d", tr, err)
+	}
+
+	tr, err = sybil.ParseTimeRange("", "", "yesterday", now)
+	if err != nil || tr.End-tr.Start != 24*60*60 || tr.End != time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC).Unix() {
+		test.Error("UNEXPECTED RANGE FOR -range yesterday", tr, err)
+	}
+
+	// 02:00 UTC is still the day before in New York
+	eastern := time.FixedZone("EST", -5*60*60)
+	tr, err = sybil.ParseTimeRange("", "", "today", time.Date(2026, 10, 19, 2, 0, 0, 0, time.UTC).In(eastern))
+	if err != nil || tr.Start != time.Date(2026, 10, 18, 5, 0, 0, 0, time.UTC).Unix() {
+		test.Error("UNEXPECTED RANGE FOR -range today IN A TIME ZONE", tr, err)
+	}
+
+	tr, err = sybil.ParseTimeRange("", "", "2026-10-01..2026-10-08", now)
+	if err != nil || tr.End-tr.Start != 7*24*60*60 {
+		test.Error("UNEXPECTED RANGE FOR -range start..end", tr, err)
+	}
+
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC).Unix()
+	end := time.Date(2026, 10, 8, 0, 0, 0, 0, time.UTC).Unix()
+	filters := tr.IntFilters("time")
+	if len(filters) != 2 || filters[0] != fmt.Sprintf("time:gt:%d", start-1) || filters[1] != fmt.Sprintf("time:lt:%d", end) {
+		test.Error("UNEXPECTED FILTERS FOR RANGE", filters)
+	}
+
+	for _, bad := range [][]string{{"6x", ""}, {"", "tomorrow"}, {"1h", "2h"}} {
+		if _, err := sybil.ParseTimeRange(bad[0], bad[1], "", now); err == nil {
+			test.Error("EXPECTED AN ERROR FOR RANGE", bad)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package sybil
+
+import "fmt"
+import "strconv"
+import "strings"
+
+// {{{ SERIES FUNCTIONS
+
+// Series functions post-process time series results, per group and metric.
+// They are given as metric:fn[:arg], like "count:cumsum", "latency:movavg:5"
+// or "latency.p95:ewma:0.3", and are run over the combined time buckets in
+// order. The results are stored in each Result's Series, keyed by the spec.
+//
+// movavg:N	average of the last N buckets
+// cumsum	running total
+// rate	value per second of the bucket
+// deriv	change per second since the previous bucket
+// ewma:alpha	exponentially weighted moving average
+//
+// Empty buckets in a movavg window count as 0 for count and are left out of
+// the average for other metrics.
+
+type SeriesFn struct {
+	Name   string
+	Col    string
+	Metric string
+	Fn     string
+	Arg    float64
+}
+
+func ParseSeriesFns(spec string) ([]SeriesFn, error) {
+	fns := make([]SeriesFn, 0)
+	if spec == "" {
+		return fns, nil
+	}
+
+	for _, name := range strings.Split(spec, *FLAGS.FIELD_SEPARATOR) {
+		name = strings.TrimSpace(name)
+		tokens := strings.Split(name, *FLAGS.FILTER_SEPARATOR)
+		if len(tokens) < 2 || len(tokens) > 3 {
+			return nil, fmt.Errorf("invalid series function: %s", name)
+		}
+
+		fn := SeriesFn{Name: name, Fn: tokens[1]}
+		fn.Col, fn.Metric = ParseSortCol(tokens[0])
+		if tokens[0] == "count" {
+			fn.Col = OPTS.SORT_COUNT
+		}
+
+		switch fn.Fn {
+		case "movavg":
+			fn.Arg = 3
+		case "ewma":
+			fn.Arg = 0.5
+		case "cumsum", "rate", "deriv":
+		default:
+			return nil, fmt.Errorf("unknown series function: %s", fn.Fn)
+		}
+
+		if len(tokens) == 3 {
+			arg, err := strconv.ParseFloat(tokens[2], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid argument for %s: %s", fn.Fn, tokens[2])
+			}
+			fn.Arg = arg
+		}
+
+		if fn.Fn == "movavg" && fn.Arg < 1 {
+			return nil, fmt.Errorf("movavg needs a window of at least 1 bucket: %s", name)
+		}
+
+		if fn.Fn == "ewma" && (fn.Arg <= 0 || fn.Arg > 1) {
+			return nil, fmt.Errorf("ewma needs an alpha between 0 and 1: %s", name)
+		}
+
+		fns = append(fns, fn)
+	}
+
+	return fns, nil
+}
+
+func (fn SeriesFn) value(r *Result) (float64, bool) {
+	if fn.Col == OPTS.SORT_COUNT {
+		return float64(r.Count), true
+	}
+
+	if _, ok := r.Hists[fn.Col]; !ok {
+		return 0, false
+	}
+
+	return r.metricValue(fn.Col, fn.Metric), true
+}
+
+type seriesValue struct {
+	Bucket int64
+	Value  float64
+}
+
+// seriesPoint is one group's value in one time bucket
+type seriesPoint struct {
+	Bucket int64
+	Width  int64
+	Result *Result
+}
+
+func (fn SeriesFn) apply(points []seriesPoint, bucketer *TimeBucketer) {
+	window := make([]seriesValue, 0)
+	first_bucket := int64(0)
+	total := float64(0)
+	smoothed := float64(0)
+	has_prev := false
+	prev_val := float64(0)
+	prev_bucket := int64(0)
+
+	for _, p := range points {
+		val, ok := fn.value(p.Result)
+		if !ok {
+			continue
+		}
+
+		if !has_prev {
+			first_bucket = p.Bucket
+		}
+
+		var out float64
+		has_out := true
+
+		switch fn.Fn {
+		case "movavg":
+			// the window is the last N buckets by time, but never reaches
+			// back past the series' first bucket
+			start := p.Bucket
+			buckets := 1
+			for buckets < int(fn.Arg) && start > first_bucket {
+				start = bucketer.Bucket(start - 1)
+				buckets++
+			}
+
+			window = append(window, seriesValue{p.Bucket, val})
+			for window[0].Bucket < start {
+				window = window[1:]
+			}
+
+			sum := float64(0)
+			for _, v := range window {
+				sum += v.Value
+			}
+
+			if fn.Col == OPTS.SORT_COUNT {
+				out = sum / float64(buckets)
+			} else {
+				out = sum / float64(len(window))
+			}
+		case "cumsum":
+			total += val
+			out = total
+		case "rate":
+			out = val / float64(p.Width)
+		case "deriv":
+			if has_prev {
+				out = (val - prev_val) / float64(p.Bucket-prev_bucket)
+			} else {
+				has_out = false
+			}
+		case "ewma":
+			if has_prev {
+				smoothed = fn.Arg*val + (1-fn.Arg)*smoothed
+			} else {
+				smoothed = val
+			}
+			out = smoothed
+		}
+
+		has_prev = true
+		prev_val = val
+		prev_bucket = p.Bucket
+
+		if has_out {
+			if p.Result.Series == nil {
+				p.Result.Series = make(map[string]float64)
+			}
+			p.Result.Series[fn.Name] = out
+		}
+	}
+}
+
+// runs the series functions over every group's time series
+func (querySpec *QuerySpec) ApplySeriesFns() {
+	if len(querySpec.SeriesFns) == 0 || querySpec.TimeBucket <= 0 {
+		return
+	}
+
+	keys := querySpec.timeBucketKeys("")
+	bucketer := querySpec.TimeBucketer()
+
+	series := make(map[string][]seriesPoint)
+	for _, k := range keys {
+		width := bucketer.Next(int64(k)) - int64(k)
+		for group_key, r := range querySpec.TimeResults[k] {
+			series[group_key] = append(series[group_key], seriesPoint{int64(k), width, r})
+		}
+	}
+
+	for _, points := range series {
+		for _, fn := range querySpec.SeriesFns {
+			fn.apply(points, bucketer)
+		}
+	}
+}
+
+func formatSeries(r *Result, fns []SeriesFn, col string) string {
+	formatted := make([]string, 0)
+	for _, fn := range fns {
+		if fn.Col != col && fn.Col != OPTS.SORT_COUNT {
+			continue
+		}
+
+		val, ok := r.Series[fn.Name]
+		if !ok {
+			formatted = append(formatted, fmt.Sprintf("%s=-", fn.Name))
+			continue
+		}
+
+		formatted = append(formatted, fmt.Sprintf("%s=%.2f", fn.Name, val))
+	}
+
+	return strings.Join(formatted, " ")
+}
+
+// }}} SERIES FUNCTIONS
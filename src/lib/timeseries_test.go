@@ -0,0 +1,132 @@
+package sybil_test
+
+import sybil "./"
+
+import "math"
+import "testing"
+
+func TestSeriesFunctions(test *testing.T) {
+	delete_test_db()
+
+	if testing.Short() {
+		test.Skip("Skipping test in short mode")
+		return
+	}
+
+	block_count := 3
+
+	add_records(func(r *sybil.Record, index int) {
+		r.AddIntField("id", int64(index))
+		r.AddIntField("time", int64(index%5)*3600)
+		r.AddIntField("age", int64(index%5)*10)
+	}, block_count)
+
+	nt := save_and_reload_table(test, block_count)
+
+	fns, err := sybil.ParseSeriesFns("count:cumsum,count:rate,age:movavg:2,age:deriv,age:ewma:0.5")
+	if err != nil {
+		test.Fatal("COULDNT PARSE SERIES FNS", err)
+	}
+
+	time_col_id := sybil.OPTS.TIME_COL_ID
+	sybil.OPTS.TIME_COL_ID = nt.KeyTable["time"]
+
+	querySpec := new_query_spec()
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("age", "avg"))
+	querySpec.TimeBucket = 3600
+	querySpec.SeriesFns = fns
+
+	nt.MatchAndAggregate(querySpec)
+	sybil.OPTS.TIME_COL_ID = time_col_id
+
+	if len(querySpec.TimeResults) != 5 {
+		test.Fatal("EXPECTED 5 TIME BUCKETS, GOT", len(querySpec.TimeResults))
+	}
+
+	per_bucket := float64(querySpec.TimeResults[0]["total"].Count)
+	for bucket := 0; bucket < 5; bucket++ {
+		r := querySpec.TimeResults[bucket*3600]["total"]
+		i := float64(bucket)
+
+		expected := map[string]float64{
+			"count:cumsum": per_bucket * (i + 1),
+			"count:rate":   per_bucket / 3600,
+			"age:movavg:2": math.Max(i-0.5, 0) * 10,
+			"age:ewma:0.5": (i - 1 + math.Pow(0.5, i)) * 10,
+		}
+		if bucket > 0 {
+			expected["age:deriv"] = 10.0 / 3600
+		}
+
+		for name, val := range expected {
+			if math.Abs(r.Series[name]-val) > 0.0001 {
+				test.Error("BUCKET", bucket, name, "WAS", r.Series[name], "EXPECTED", val)
+			}
+		}
+
+		if _, ok := r.Series["age:deriv"]; bucket == 0 && ok {
+			test.Error("DERIVATIVE SHOULDNT BE SET FOR THE FIRST BUCKET")
+		}
+	}
+
+	if _, err := sybil.ParseSeriesFns("age:median"); err == nil {
+		test.Error("EXPECTED AN ERROR FOR UNKNOWN SERIES FUNCTION")
+	}
+
+	delete_test_db()
+}
+
+// Tests that the moving average window is the last N buckets by time, not the
+// last N buckets with data
+func TestMovingAverageWithGaps(test *testing.T) {
+	delete_test_db()
+
+	block_count := 3
+
+	add_records(func(r *sybil.Record, index int) {
+		r.AddIntField("id", int64(index))
+		r.AddIntField("time", int64(index%2)*3*3600)
+		r.AddIntField("age", int64(index%2)*10)
+	}, block_count)
+
+	nt := save_and_reload_table(test, block_count)
+
+	fns, err := sybil.ParseSeriesFns("count:movavg:2,age:movavg:2")
+	if err != nil {
+		test.Fatal("COULDNT PARSE SERIES FNS", err)
+	}
+
+	time_col_id := sybil.OPTS.TIME_COL_ID
+	sybil.OPTS.TIME_COL_ID = nt.KeyTable["time"]
+
+	querySpec := new_query_spec()
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("age", "avg"))
+	querySpec.TimeBucket = 3600
+	querySpec.SeriesFns = fns
+
+	nt.MatchAndAggregate(querySpec)
+	sybil.OPTS.TIME_COL_ID = time_col_id
+
+	if len(querySpec.TimeResults) != 2 {
+		test.Fatal("EXPECTED 2 TIME BUCKETS, GOT", len(querySpec.TimeResults))
+	}
+
+	first := querySpec.TimeResults[0]["total"]
+	last := querySpec.TimeResults[3*3600]["total"]
+
+	if first.Series["count:movavg:2"] != float64(first.Count) {
+		test.Error("FIRST BUCKET COUNT AVERAGE WAS", first.Series["count:movavg:2"], "EXPECTED", first.Count)
+	}
+
+	// the empty bucket before the last one counts as 0
+	if last.Series["count:movavg:2"] != float64(last.Count)/2 {
+		test.Error("LAST BUCKET COUNT AVERAGE WAS", last.Series["count:movavg:2"], "EXPECTED", float64(last.Count)/2)
+	}
+
+	// and the first bucket is out of the window
+	if last.Series["age:movavg:2"] != 10 {
+		test.Error("LAST BUCKET AGE AVERAGE WAS", last.Series["age:movavg:2"], "EXPECTED", 10)
+	}
+
+	delete_test_db()
+}
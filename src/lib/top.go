@@ -0,0 +1,95 @@
+package sybil
+
+import "sort"
+import "strings"
+
+// {{{ TOP N
+
+// With -top N, only the N best groups over the whole query (ranked by TopBy,
+// or the query's order if it isn't set) keep their own results. Every other
+// group is folded into an OTHER_GROUP result, overall and in each time bucket,
+// so the counts still add up.
+
+var OTHER_GROUP = "__other__"
+
+func (querySpec *QuerySpec) otherGroupKey() string {
+	if len(querySpec.Groups) == 0 {
+		return OTHER_GROUP
+	}
+
+	return strings.Repeat(OTHER_GROUP+GROUP_DELIMITER, len(querySpec.Groups))
+}
+
+// returns the group keys of the top N results
+func (querySpec *QuerySpec) topGroups() map[string]bool {
+	order_by := querySpec.TopBy
+	if order_by == "" {
+		order_by = querySpec.OrderBy
+	}
+	if order_by == "" {
+		order_by = OPTS.SORT_COUNT
+	}
+
+	sorter := SortResultsByCol{}
+	sorter.Results = make([]*Result, 0, len(querySpec.Results))
+	for _, r := range querySpec.Results {
+		sorter.Results = append(sorter.Results, r)
+	}
+	sorter.Keys, _ = ParseOrderBy(order_by)
+	sorter.Groups = querySpec.Groups
+	sort.Sort(sorter)
+
+	top := make(map[string]bool)
+	for i, r := range sorter.Results {
+		if i >= querySpec.TopN {
+			break
+		}
+		top[r.GroupByKey] = true
+	}
+
+	return top
+}
+
+func foldOtherResults(results ResultMap, top map[string]bool, other_key string) ResultMap {
+	other := NewResult()
+	other.GroupByKey = other_key
+
+	folded := make(ResultMap)
+	for k, r := range results {
+		if top[k] {
+			folded[k] = r
+			continue
+		}
+
+		other.Combine(r)
+	}
+
+	if other.Count > 0 {
+		folded[other_key] = other
+	}
+
+	return folded
+}
+
+func (querySpec *QuerySpec) ApplyTopN() {
+	if querySpec.TopN <= 0 || len(querySpec.Results) <= querySpec.TopN {
+		return
+	}
+
+	top := querySpec.topGroups()
+	other_key := querySpec.otherGroupKey()
+
+	querySpec.Results = foldOtherResults(querySpec.Results, top, other_key)
+	for k, results := range querySpec.TimeResults {
+		querySpec.TimeResults[k] = foldOtherResults(results, top, other_key)
+	}
+
+	if querySpec.CompareOffset > 0 {
+		querySpec.CompareResults = foldOtherResults(querySpec.CompareResults, top, other_key)
+		for k, results := range querySpec.CompareTimeResults {
+			querySpec.CompareTimeResults[k] = foldOtherResults(results, top, other_key)
+		}
+	}
+}
+
+// }}} TOP N
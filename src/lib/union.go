@@ -0,0 +1,227 @@
+package sybil
+
+import "fmt"
+import "io/ioutil"
+import "path"
+import "sort"
+import "strings"
+
+// {{{ UNION QUERIES
+
+// A query can run over several tables, like shards of the same events split
+// by day or service. Each table resolves the query's columns against its own
+// KeyTable, is queried on its own and the per table results are combined like
+// block results before the query is finalized.
+
+// ResolveTables expands a comma separated list of table names and globs, like
+// "web_*", into the names of the tables in the DIR
+func ResolveTables(spec string) []string {
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+
+	var dirs []string
+	for _, pattern := range strings.Split(spec, *FLAGS.FIELD_SEPARATOR) {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+
+		if !strings.ContainsAny(pattern, "*?[") {
+			if !seen[pattern] {
+				seen[pattern] = true
+				names = append(names, pattern)
+			}
+			continue
+		}
+
+		if dirs == nil {
+			dirs = make([]string, 0)
+			files, err := ioutil.ReadDir(*FLAGS.DIR)
+			if err != nil {
+				Debug("COULDNT READ TABLES", err)
+			}
+			for _, f := range files {
+				if f.IsDir() {
+					dirs = append(dirs, f.Name())
+				}
+			}
+			sort.Strings(dirs)
+		}
+
+		for _, dir := range dirs {
+			if ok, _ := path.Match(pattern, dir); ok && !seen[dir] {
+				seen[dir] = true
+				names = append(names, dir)
+			}
+		}
+	}
+
+	return names
+}
+
+// ForTable returns a copy of the query's params with the column ids of
+// another table
+func (querySpec *QuerySpec) ForTable(t *Table) (*QuerySpec, error) {
+	tableQuery := CopyQuerySpec(querySpec)
+	tableQuery.Table = t
+	if t == querySpec.Table {
+		return tableQuery, nil
+	}
+
+	t.LoadTableInfo()
+
+	tableQuery.Virtuals = make([]VirtualColumn, 0, len(querySpec.Virtuals))
+	for _, v := range querySpec.Virtuals {
+		vc, err := t.VirtualColumn(v.Name, v.Expr)
+		if err != nil {
+			return nil, err
+		}
+		tableQuery.Virtuals = append(tableQuery.Virtuals, vc)
+	}
+
+	// columns are looked up without adding them to the table's KeyTable. a
+	// column the table doesn't have is missing from all its records
+	tableQuery.Groups = make([]Grouping, 0, len(querySpec.Groups))
+	for _, g := range querySpec.Groups {
+		_, col := ParseGroupingFunc(g.Name)
+		col_id, ok := t.KeyTable[col]
+		g.name_id, g.absent = col_id, !ok
+		tableQuery.Groups = append(tableQuery.Groups, g)
+	}
+
+	tableQuery.Aggregations = make([]Aggregation, 0, len(querySpec.Aggregations))
+	for _, a := range querySpec.Aggregations {
+		col_id, ok := t.KeyTable[a.Name]
+		if !ok {
+			continue
+		}
+
+		a.name_id = col_id
+		tableQuery.Aggregations = append(tableQuery.Aggregations, a)
+	}
+
+	// records without the column never pass a filter on it, so the table has
+	// nothing to add
+	tableQuery.Filters = make([]Filter, 0, len(querySpec.Filters))
+	for _, f := range querySpec.Filters {
+		var field string
+		switch fil := f.(type) {
+		case IntFilter:
+			fil.FieldId, fil.table = t.KeyTable[fil.Field], t
+			field, f = fil.Field, fil
+		case StrFilter:
+			fil.FieldId, fil.table = t.KeyTable[fil.Field], t
+			field, f = fil.Field, fil
+		case SetFilter:
+			fil.FieldId, fil.table = t.KeyTable[fil.Field], t
+			field, f = fil.Field, fil
+		}
+
+		if _, ok := t.KeyTable[field]; field != "" && !ok {
+			return nil, fmt.Errorf("no %s column to filter on", field)
+		}
+
+		tableQuery.Filters = append(tableQuery.Filters, f)
+	}
+
+	return tableQuery, nil
+}
+
+// ForTable returns a copy of the load spec with the columns that exist in
+// another table
+func (l *LoadSpec) ForTable(t *Table) LoadSpec {
+	tableLoad := t.NewLoadSpec()
+	tableLoad.LoadAllColumns = l.LoadAllColumns
+
+	for name := range l.columns {
+		col_id, ok := t.KeyTable[name]
+		if !ok {
+			continue
+		}
+
+		switch t.KeyTypes[col_id] {
+		case INT_VAL:
+			tableLoad.Int(name)
+		case STR_VAL:
+			tableLoad.Str(name)
+		case SET_VAL:
+			tableLoad.Set(name)
+		}
+	}
+
+	return tableLoad
+}
+
+// LoadAndQueryTables runs the query over every table and combines their
+// results into the querySpec. The query's columns belong to its Table, or to
+// the first table if it has none.
+func LoadAndQueryTables(tables []*Table, loadSpec *LoadSpec, querySpec *QuerySpec) int {
+	if querySpec.Table == nil && len(tables) > 0 {
+		querySpec.Table = tables[0]
+	}
+
+	// basic and hdr hists are bucketed by each table's own min and max (if it
+	// has one), so they can't be combined across tables
+	if len(tables) > 1 {
+		Debug("USING T-DIGEST HISTOGRAMS TO COMBINE", len(tables), "TABLES")
+		for i := range querySpec.Aggregations {
+			querySpec.Aggregations[i].HistType = "tdigest"
+		}
+	}
+
+	count := 0
+	table_specs := make(map[string]*QuerySpec)
+
+	time_col_id := OPTS.TIME_COL_ID
+	weight_col, weight_col_id := OPTS.WEIGHT_COL, OPTS.WEIGHT_COL_ID
+
+	for _, t := range tables {
+		tableQuery, err := querySpec.ForTable(t)
+		if err != nil {
+			Warn("Skipping table", t.Name, err)
+			continue
+		}
+		tableLoad := loadSpec.ForTable(t)
+
+		// THE TIME AND WEIGHT COLUMNS HAVE DIFFERENT IDS IN EACH TABLE. A TABLE
+		// WITHOUT THE WEIGHT COLUMN ISN'T WEIGHTED AND ONE WITHOUT THE TIME
+		// COLUMN HAS NOTHING TO ADD TO A TIME QUERY
+		OPTS.TIME_COL_ID = -1
+		if FLAGS.TIME_COL != nil {
+			if col_id, ok := t.KeyTable[*FLAGS.TIME_COL]; ok {
+				OPTS.TIME_COL_ID = col_id
+			}
+		}
+		if OPTS.TIME_COL_ID < 0 && (tableQuery.TimeBucket > 0 || tableQuery.CompareOffset != 0) {
+			Warn("Skipping table", t.Name, "it has no time column")
+			continue
+		}
+
+		if weight_col {
+			OPTS.WEIGHT_COL_ID, OPTS.WEIGHT_COL = t.KeyTable[*FLAGS.WEIGHT_COL]
+		}
+
+		// the union is finalized after the tables are combined
+		tableQuery.partial = true
+		count += t.LoadAndQueryRecords(&tableLoad, tableQuery)
+		table_specs[t.Name] = tableQuery
+	}
+
+	OPTS.TIME_COL_ID = time_col_id
+	OPTS.WEIGHT_COL, OPTS.WEIGHT_COL_ID = weight_col, weight_col_id
+
+	resultSpec := CombineResults(querySpec, table_specs)
+
+	querySpec.Cumulative = resultSpec.Cumulative
+	querySpec.Results = resultSpec.Results
+	querySpec.TimeResults = resultSpec.TimeResults
+	querySpec.CompareResults = resultSpec.CompareResults
+	querySpec.CompareTimeResults = resultSpec.CompareTimeResults
+	querySpec.Truncated = resultSpec.Truncated
+
+	FinalizeResults(querySpec)
+
+	return count
+}
+
+// }}} UNION QUERIES
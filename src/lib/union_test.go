@@ -0,0 +1,165 @@
+package sybil_test
+
+import sybil "./"
+
+import "fmt"
+import "os"
+import "testing"
+
+var TEST_UNION_TABLE_NAME = "__TEST1__"
+
+func TestUnionQuery(test *testing.T) {
+	delete_test_db()
+	os.RemoveAll(fmt.Sprintf("db/%s", TEST_UNION_TABLE_NAME))
+	delete(sybil.LOADED_TABLES, TEST_UNION_TABLE_NAME)
+
+	block_count := 2
+
+	add_records(func(r *sybil.Record, index int) {
+		r.AddIntField("age", int64(index%10))
+		r.AddStrField("kind", "a")
+		r.AddIntField("time", int64(index))
+	}, block_count)
+	nt := save_and_reload_table(test, block_count)
+
+	// THE SECOND TABLE HAS ITS COLUMNS IN A DIFFERENT ORDER, SO THEIR IDS
+	// DONT MATCH THE FIRST TABLE
+	ut := sybil.GetTable(TEST_UNION_TABLE_NAME)
+	for i := 0; i < sybil.CHUNK_SIZE; i++ {
+		r := ut.NewRecord()
+		r.AddStrField("extra", "x")
+		r.AddStrField("kind", "b")
+		r.AddIntField("age", int64(10+i%10))
+		r.AddIntField("weight", 2)
+	}
+	ut.SaveRecordsToColumns()
+	delete(sybil.LOADED_TABLES, TEST_UNION_TABLE_NAME)
+	ut = sybil.GetTable(TEST_UNION_TABLE_NAME)
+
+	if names := sybil.ResolveTables("__TEST*__"); len(names) != 2 {
+		test.Error("EXPECTED THE GLOB TO MATCH 2 TABLES, GOT", names)
+	}
+
+	querySpec := new_query_spec()
+	querySpec.Table = nt
+	querySpec.Groups = append(querySpec.Groups, nt.Grouping("kind"))
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("age", "avg"))
+	querySpec.Filters = append(querySpec.Filters, nt.IntFilter("age", "lt", 15))
+
+	loadSpec := nt.NewLoadSpec()
+	loadSpec.Str("kind")
+	loadSpec.Int("age")
+
+	sybil.LoadAndQueryTables([]*sybil.Table{nt, ut}, &loadSpec, querySpec)
+
+	a, ok := querySpec.Results["a"+sybil.GROUP_DELIMITER]
+	if !ok || a.Count != int64(sybil.CHUNK_SIZE*block_count) {
+		test.Error("WRONG RESULTS FOR THE FIRST TABLE", a)
+	}
+
+	b, ok := querySpec.Results["b"+sybil.GROUP_DELIMITER]
+	if !ok || b.Count != int64(sybil.CHUNK_SIZE/2) {
+		test.Error("WRONG RESULTS FOR THE SECOND TABLE", b)
+	} else if b.Hists["age"].Mean() != 12 {
+		test.Error("SECOND TABLE AVERAGE IS", b.Hists["age"].Mean())
+	}
+
+	if querySpec.Cumulative.Count != a.Count+b.Count {
+		test.Error("TOTAL DOESNT ADD UP", querySpec.Cumulative.Count)
+	}
+
+	// BASIC HISTS CANT BE COMBINED ACROSS TABLES, SO THE UNION USES T-DIGESTS
+	if _, ok := a.Hists["age"].(*sybil.TDigestHist); !ok {
+		test.Error("UNION DIDNT USE T-DIGEST HISTS", a.Hists["age"])
+	}
+
+	// ONLY THE SECOND TABLE HAS A weight COLUMN, THE FIRST ISNT WEIGHTED
+	weight_col := "weight"
+	prev_weight_col := sybil.FLAGS.WEIGHT_COL
+	sybil.FLAGS.WEIGHT_COL = &weight_col
+	sybil.OPTS.WEIGHT_COL = true
+
+	querySpec = new_query_spec()
+	querySpec.Table = ut
+	querySpec.Groups = append(querySpec.Groups, ut.Grouping("kind"))
+	loadSpec = ut.NewLoadSpec()
+	loadSpec.Str("kind")
+	loadSpec.Int("age")
+	loadSpec.Int("weight")
+	sybil.LoadAndQueryTables([]*sybil.Table{ut, nt}, &loadSpec, querySpec)
+
+	sybil.OPTS.WEIGHT_COL = false
+	sybil.FLAGS.WEIGHT_COL = prev_weight_col
+
+	a, b = querySpec.Results["a"+sybil.GROUP_DELIMITER], querySpec.Results["b"+sybil.GROUP_DELIMITER]
+	if a == nil || b == nil || a.Count != int64(sybil.CHUNK_SIZE*block_count) || b.Count != int64(sybil.CHUNK_SIZE*2) {
+		test.Error("WRONG WEIGHTS FOR A TABLE WITHOUT THE weight COLUMN", a, b)
+	}
+
+	// THE SECOND TABLE HAS NO time COLUMN, SO IT CANT BE IN A TIME SERIES
+	time_col := "time"
+	prev_time_col := sybil.FLAGS.TIME_COL
+	sybil.FLAGS.TIME_COL = &time_col
+
+	querySpec = new_query_spec()
+	querySpec.Table = nt
+	querySpec.Groups = append(querySpec.Groups, nt.Grouping("kind"))
+	querySpec.TimeBucket = 60
+	loadSpec = nt.NewLoadSpec()
+	loadSpec.Str("kind")
+	loadSpec.Int("age")
+	loadSpec.Int("time")
+	sybil.LoadAndQueryTables([]*sybil.Table{nt, ut}, &loadSpec, querySpec)
+
+	sybil.FLAGS.TIME_COL = prev_time_col
+
+	if len(querySpec.Results) != 1 || querySpec.Results["a"+sybil.GROUP_DELIMITER] == nil {
+		test.Error("TABLE WITHOUT A time COLUMN WASNT SKIPPED", querySpec.Results)
+	}
+	for _, results := range querySpec.TimeResults {
+		if _, ok := results["b"+sybil.GROUP_DELIMITER]; ok {
+			test.Error("TABLE WITHOUT A time COLUMN IS IN THE TIME SERIES")
+		}
+	}
+
+	// THE FIRST TABLE HAS NO extra COLUMN, SO ITS RECORDS ARE MISSING IT AND
+	// IT ISNT ADDED TO THE FIRST TABLE
+	num_keys := len(nt.KeyTable)
+
+	querySpec = new_query_spec()
+	querySpec.Table = ut
+	querySpec.Groups = append(querySpec.Groups, ut.Grouping("extra"))
+	querySpec.Aggregations = append(querySpec.Aggregations, ut.Aggregation("age", "avg"))
+
+	loadSpec = ut.NewLoadSpec()
+	loadSpec.Str("extra")
+	loadSpec.Int("age")
+
+	sybil.LoadAndQueryTables([]*sybil.Table{ut, nt}, &loadSpec, querySpec)
+
+	if _, ok := nt.KeyTable["extra"]; ok || len(nt.KeyTable) != num_keys {
+		test.Error("QUERYING THE UNION ADDED COLUMNS TO THE FIRST TABLE", nt.KeyTable)
+	}
+
+	x, ok := querySpec.Results["x"+sybil.GROUP_DELIMITER]
+	if !ok || x.Count != int64(sybil.CHUNK_SIZE) {
+		test.Error("WRONG RESULTS FOR THE extra GROUP", x)
+	}
+
+	missing, ok := querySpec.Results[sybil.GROUP_DELIMITER]
+	if !ok || missing.Count != int64(sybil.CHUNK_SIZE*block_count) {
+		test.Error("WRONG RESULTS FOR RECORDS WITHOUT extra", missing)
+	}
+
+	// NO RECORD OF THE FIRST TABLE CAN PASS A FILTER ON extra
+	querySpec.Filters = append(querySpec.Filters, ut.StrFilter("extra", "eq", "x"))
+	sybil.LoadAndQueryTables([]*sybil.Table{ut, nt}, &loadSpec, querySpec)
+
+	if len(querySpec.Results) != 1 || querySpec.Results["x"+sybil.GROUP_DELIMITER] == nil {
+		test.Error("WRONG RESULTS FOR A FILTER ON extra", querySpec.Results)
+	}
+
+	os.RemoveAll(fmt.Sprintf("db/%s", TEST_UNION_TABLE_NAME))
+	delete(sybil.LOADED_TABLES, TEST_UNION_TABLE_NAME)
+	delete_test_db()
+}
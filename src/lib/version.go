@@ -9,6 +9,7 @@ func GetVersionInfo() map[string]interface{} {
 	version_info["field_separator"] = true
 	version_info["log_hist"] = true
 	version_info["query_cache"] = true
+	version_info["block_version"] = BLOCK_VERSION
 
 	if ENABLE_HDR {
 		version_info["hdr_hist"] = true
@@ -0,0 +1,614 @@
+package sybil
+
+import "fmt"
+import "math"
+import "regexp"
+import "strconv"
+import "strings"
+
+// {{{ VIRTUAL COLUMNS
+
+// Virtual columns are defined at query time as name=expr and are evaluated
+// for every record in the scan loop, before filtering, so they can be used in
+// groups, filters and aggregations like any other column. They get a key id
+// in the table but are never saved.
+//
+// Expressions are made of int and str columns (including earlier virtual
+// columns), numbers, quoted strings, + - * / %, parentheses and functions:
+//
+// floor(x), ceil(x), round(x), abs(x), min(x, y, ...), max(x, y, ...)
+// lower(s), upper(s), concat(a, b, ...)
+// regex_extract(s, "re")	the first capture group of re (or the whole match)
+// lookup("table", key, "col")	col of the join table's record with that key
+//
+// A virtual column is missing for a record if any column it reads is missing,
+// its regex doesn't match, its lookup has no record or it divides by zero.
+
+type VirtualColumn struct {
+	Name string
+	Expr string
+	Type int8
+
+	name_id int16
+	root    *exprNode
+	columns []string
+}
+
+type exprNode struct {
+	op     string
+	typ    int8
+	num    float64
+	str    string
+	col_id int16
+	regex  *regexp.Regexp
+	join   *Table
+	args   []*exprNode
+}
+
+type exprValue struct {
+	num float64
+	str string
+}
+
+var VIRTUAL_FUNCS = map[string]int8{
+	"floor":         INT_VAL,
+	"ceil":          INT_VAL,
+	"round":         INT_VAL,
+	"abs":           INT_VAL,
+	"min":           INT_VAL,
+	"max":           INT_VAL,
+	"lower":         STR_VAL,
+	"upper":         STR_VAL,
+	"concat":        STR_VAL,
+	"regex_extract": STR_VAL,
+	"lookup":        STR_VAL, // or INT_VAL, like the column it reads
+}
+
+// ParseVirtualFlag splits a -virtual flag into its name and expression
+func ParseVirtualFlag(flag string) (string, string, error) {
+	tokens := strings.SplitN(flag, "=", 2)
+	if len(tokens) != 2 || strings.TrimSpace(tokens[0]) == "" {
+		return "", "", fmt.Errorf("invalid virtual column, expected name=expr: %s", flag)
+	}
+
+	return strings.TrimSpace(tokens[0]), strings.TrimSpace(tokens[1]), nil
+}
+
+// VirtualColumn parses the expression and registers the column in the key
+// table, so groups, filters and aggregations can refer to it by name
+func (t *Table) VirtualColumn(name string, expr string) (VirtualColumn, error) {
+	vc := VirtualColumn{Name: name, Expr: expr}
+
+	if _, ok := t.KeyTable[name]; ok {
+		return vc, fmt.Errorf("virtual column %s already exists in %s", name, t.Name)
+	}
+
+	p := exprParser{table: t}
+	if err := p.tokenize(expr); err != nil {
+		return vc, err
+	}
+
+	root, err := p.parseExpr()
+	if err != nil {
+		return vc, err
+	}
+	if p.pos < len(p.tokens) {
+		return vc, fmt.Errorf("unexpected %s in %s", p.tokens[p.pos], expr)
+	}
+
+	vc.root = root
+	vc.Type = root.typ
+	vc.columns = p.columns
+
+	vc.name_id = t.get_key_id(name)
+	t.set_key_type(vc.name_id, vc.Type)
+
+	t.string_id_m.Lock()
+	if t.virtual == nil {
+		t.virtual = make(map[int16]VirtualColumn)
+	}
+	t.virtual[vc.name_id] = vc
+	t.string_id_m.Unlock()
+
+	return vc, nil
+}
+
+// re-adds the virtual columns after the key table is re-read from disk
+func (t *Table) restoreVirtuals() {
+	for name_id, vc := range t.virtual {
+		for name, id := range t.KeyTable {
+			if id == name_id && name != vc.Name {
+				Warn("virtual column", vc.Name, "has the same key id as", name)
+			}
+		}
+
+		t.KeyTable[vc.Name] = name_id
+		t.KeyTypes[name_id] = vc.Type
+	}
+}
+
+// Columns returns the names of the columns the expression reads
+func (vc *VirtualColumn) Columns() []string {
+	return vc.columns
+}
+
+func (t *Table) isVirtual(name_id int16) bool {
+	_, ok := t.virtual[name_id]
+	return ok
+}
+
+// sizes the records' fields to hold the virtual columns up front, carving them
+// out of one slab for the whole block instead of allocating per record
+func (querySpec *QuerySpec) growVirtualFields(records RecordList) {
+	length := 0
+	for _, vc := range querySpec.Virtuals {
+		if int(vc.name_id)+1 > length {
+			length = int(vc.name_id) + 1
+		}
+	}
+
+	if length == 0 {
+		return
+	}
+
+	populated := make([]int8, 0)
+	ints := make(IntArr, 0)
+	strs := make(StrArr, 0)
+	for _, r := range records {
+		if len(r.Populated) < length {
+			if len(populated) < length {
+				populated = make([]int8, length*len(records))
+			}
+			copy(populated, r.Populated)
+			r.Populated, populated = populated[:length:length], populated[length:]
+		}
+
+		if len(r.Ints) < length {
+			if len(ints) < length {
+				ints = make(IntArr, length*len(records))
+			}
+			copy(ints, r.Ints)
+			r.Ints, ints = ints[:length:length], ints[length:]
+		}
+
+		if len(r.Strs) < length {
+			if len(strs) < length {
+				strs = make(StrArr, length*len(records))
+			}
+			copy(strs, r.Strs)
+			r.Strs, strs = strs[:length:length], strs[length:]
+		}
+	}
+}
+
+// records can come from a shared slab, so we never append to their fields
+func (r *Record) growFields(name_id int16) {
+	length := int(name_id) + 1
+	if len(r.Populated) < length {
+		populated := make([]int8, length)
+		copy(populated, r.Populated)
+		r.Populated = populated
+	}
+
+	if len(r.Ints) < length {
+		ints := make(IntArr, length)
+		copy(ints, r.Ints)
+		r.Ints = ints
+	}
+
+	if len(r.Strs) < length {
+		strs := make(StrArr, length)
+		copy(strs, r.Strs)
+		r.Strs = strs
+	}
+}
+
+func (vc *VirtualColumn) materialize(r *Record) {
+	val, ok := vc.root.eval(r)
+
+	r.growFields(vc.name_id)
+	if !ok {
+		r.Populated[vc.name_id] = _NO_VAL
+		return
+	}
+
+	switch vc.Type {
+	case INT_VAL:
+		r.Ints[vc.name_id] = IntField(math.Floor(val.num))
+	case STR_VAL:
+		col := r.block.GetColumnInfo(vc.name_id)
+		r.Strs[vc.name_id] = StrField(col.get_val_id(val.str))
+	}
+
+	r.Populated[vc.name_id] = vc.Type
+}
+
+func (n *exprNode) eval(r *Record) (exprValue, bool) {
+	switch n.op {
+	case "num":
+		return exprValue{num: n.num}, true
+	case "str":
+		return exprValue{str: n.str}, true
+	case "col":
+		if int(n.col_id) >= len(r.Populated) || r.Populated[n.col_id] != n.typ {
+			return exprValue{}, false
+		}
+
+		if n.typ == INT_VAL {
+			return exprValue{num: float64(r.Ints[n.col_id])}, true
+		}
+
+		col := r.block.GetColumnInfo(n.col_id)
+		return exprValue{str: col.get_string_for_val(int32(r.Strs[n.col_id]))}, true
+	}
+
+	args := make([]exprValue, len(n.args))
+	for i, arg := range n.args {
+		val, ok := arg.eval(r)
+		if !ok {
+			return val, false
+		}
+		args[i] = val
+	}
+
+	switch n.op {
+	case "neg":
+		return exprValue{num: -args[0].num}, true
+	case "+":
+		return exprValue{num: args[0].num + args[1].num}, true
+	case "-":
+		return exprValue{num: args[0].num - args[1].num}, true
+	case "*":
+		return exprValue{num: args[0].num * args[1].num}, true
+	case "/":
+		if args[1].num == 0 {
+			return exprValue{}, false
+		}
+		return exprValue{num: args[0].num / args[1].num}, true
+	case "%":
+		if args[1].num == 0 {
+			return exprValue{}, false
+		}
+		return exprValue{num: math.Mod(args[0].num, args[1].num)}, true
+	case "floor":
+		return exprValue{num: math.Floor(args[0].num)}, true
+	case "ceil":
+		return exprValue{num: math.Ceil(args[0].num)}, true
+	case "round":
+		return exprValue{num: math.Floor(args[0].num + 0.5)}, true
+	case "abs":
+		return exprValue{num: math.Abs(args[0].num)}, true
+	case "min", "max":
+		val := args[0].num
+		for _, arg := range args[1:] {
+			if (n.op == "min") == (arg.num < val) {
+				val = arg.num
+			}
+		}
+		return exprValue{num: val}, true
+	case "lower":
+		return exprValue{str: strings.ToLower(args[0].str)}, true
+	case "upper":
+		return exprValue{str: strings.ToUpper(args[0].str)}, true
+	case "concat":
+		parts := make([]string, len(args))
+		for i, arg := range args {
+			if n.args[i].typ == INT_VAL {
+				parts[i] = strconv.FormatFloat(arg.num, 'f', -1, 64)
+			} else {
+				parts[i] = arg.str
+			}
+		}
+		return exprValue{str: strings.Join(parts, "")}, true
+	case "regex_extract":
+		match := n.regex.FindStringSubmatch(args[0].str)
+		if match == nil {
+			return exprValue{}, false
+		}
+		if len(match) > 1 {
+			return exprValue{str: match[1]}, true
+		}
+		return exprValue{str: match[0]}, true
+	case "lookup":
+		key := args[1].str
+		if n.args[1].typ == INT_VAL {
+			key = strconv.FormatFloat(args[1].num, 'f', -1, 64)
+		}
+
+		jr := n.join.GetRecordById(key)
+		if jr == nil || int(n.col_id) >= len(jr.Populated) || jr.Populated[n.col_id] != n.typ {
+			return exprValue{}, false
+		}
+
+		if n.typ == INT_VAL {
+			return exprValue{num: float64(jr.Ints[n.col_id])}, true
+		}
+
+		col := jr.block.GetColumnInfo(n.col_id)
+		return exprValue{str: col.get_string_for_val(int32(jr.Strs[n.col_id]))}, true
+	}
+
+	return exprValue{}, false
+}
+
+// {{{ PARSER
+
+type exprParser struct {
+	table   *Table
+	tokens  []string
+	pos     int
+	columns []string
+}
+
+func (p *exprParser) tokenize(expr string) error {
+	p.tokens = make([]string, 0)
+
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.IndexByte("+-*/%(),", c) >= 0:
+			p.tokens = append(p.tokens, string(c))
+			i++
+		case c == '"' || c == '\'':
+			// quoted strings keep their quote so the parser can tell them
+			// apart from columns, a backslash escapes the next character
+			token := []byte{c}
+			j := i + 1
+			for ; j < len(expr) && expr[j] != c; j++ {
+				if expr[j] == '\\' && j+1 < len(expr) && expr[j+1] == c {
+					j++
+				}
+				token = append(token, expr[j])
+			}
+			if j >= len(expr) {
+				return fmt.Errorf("unterminated string in %s", expr)
+			}
+			p.tokens = append(p.tokens, string(token))
+			i = j + 1
+		default:
+			j := i
+			for j < len(expr) && strings.IndexByte(" \t+-*/%(),\"'", expr[j]) < 0 {
+				j++
+			}
+			p.tokens = append(p.tokens, expr[i:j])
+			i = j
+		}
+	}
+
+	if len(p.tokens) == 0 {
+		return fmt.Errorf("empty virtual column expression")
+	}
+
+	return nil
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+
+	return ""
+}
+
+func (p *exprParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *exprParser) expect(token string) error {
+	if next := p.next(); next != token {
+		return fmt.Errorf("expected %s, got '%s'", token, next)
+	}
+
+	return nil
+}
+
+func (p *exprParser) binary(op string, left *exprNode, right *exprNode) (*exprNode, error) {
+	if left.typ != INT_VAL || right.typ != INT_VAL {
+		return nil, fmt.Errorf("%s needs int operands, use concat() for strings", op)
+	}
+
+	return &exprNode{op: op, typ: INT_VAL, args: []*exprNode{left, right}}, nil
+}
+
+// expr := term (('+' | '-') term)*
+func (p *exprParser) parseExpr() (*exprNode, error) {
+	left, err := p.parseTerm()
+	for err == nil && (p.peek() == "+" || p.peek() == "-") {
+		op := p.next()
+
+		var right *exprNode
+		right, err = p.parseTerm()
+		if err == nil {
+			left, err = p.binary(op, left, right)
+		}
+	}
+
+	return left, err
+}
+
+// term := unary (('*' | '/' | '%') unary)*
+func (p *exprParser) parseTerm() (*exprNode, error) {
+	left, err := p.parseUnary()
+	for err == nil && (p.peek() == "*" || p.peek() == "/" || p.peek() == "%") {
+		op := p.next()
+
+		var right *exprNode
+		right, err = p.parseUnary()
+		if err == nil {
+			left, err = p.binary(op, left, right)
+		}
+	}
+
+	return left, err
+}
+
+// unary := '-' unary | primary
+func (p *exprParser) parseUnary() (*exprNode, error) {
+	if p.peek() != "-" {
+		return p.parsePrimary()
+	}
+
+	p.next()
+	arg, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if arg.typ != INT_VAL {
+		return nil, fmt.Errorf("can't negate a string")
+	}
+
+	return &exprNode{op: "neg", typ: INT_VAL, args: []*exprNode{arg}}, nil
+}
+
+// primary := number | string | func '(' expr (',' expr)* ')' | column | '(' expr ')'
+func (p *exprParser) parsePrimary() (*exprNode, error) {
+	token := p.next()
+
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case token == "(":
+		node, err := p.parseExpr()
+		if err == nil {
+			err = p.expect(")")
+		}
+		return node, err
+	case token[0] == '"' || token[0] == '\'':
+		return &exprNode{op: "str", typ: STR_VAL, str: token[1:]}, nil
+	}
+
+	if num, err := strconv.ParseFloat(token, 64); err == nil {
+		return &exprNode{op: "num", typ: INT_VAL, num: num}, nil
+	}
+
+	if p.peek() == "(" {
+		return p.parseFunc(token)
+	}
+
+	col_id, ok := p.table.KeyTable[token]
+	if !ok {
+		return nil, fmt.Errorf("unknown column: %s", token)
+	}
+
+	col_type := p.table.KeyTypes[col_id]
+	if col_type != INT_VAL && col_type != STR_VAL {
+		return nil, fmt.Errorf("virtual columns can only read int and str columns: %s", token)
+	}
+
+	if !p.table.isVirtual(col_id) {
+		p.columns = append(p.columns, token)
+	}
+
+	return &exprNode{op: "col", typ: col_type, col_id: col_id}, nil
+}
+
+func (p *exprParser) parseFunc(name string) (*exprNode, error) {
+	typ, ok := VIRTUAL_FUNCS[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function: %s", name)
+	}
+
+	p.next()
+	node := &exprNode{op: name, typ: typ}
+	for {
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		node.args = append(node.args, arg)
+
+		if p.peek() != "," {
+			break
+		}
+		p.next()
+	}
+
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	return node, p.checkFunc(node)
+}
+
+func (p *exprParser) checkFunc(node *exprNode) error {
+	arg_count := map[string]int{"floor": 1, "ceil": 1, "round": 1, "abs": 1, "lower": 1, "upper": 1, "regex_extract": 2, "lookup": 3}
+	if count, ok := arg_count[node.op]; ok && len(node.args) != count {
+		return fmt.Errorf("%s takes %d arguments, got %d", node.op, count, len(node.args))
+	}
+
+	if node.op == "lookup" {
+		return p.checkLookup(node)
+	}
+
+	arg_type := int8(INT_VAL)
+	switch node.op {
+	case "concat":
+		return nil
+	case "lower", "upper", "regex_extract":
+		arg_type = STR_VAL
+	}
+
+	if node.args[0].typ != arg_type {
+		return fmt.Errorf("wrong argument type for %s", node.op)
+	}
+
+	if node.op == "min" || node.op == "max" {
+		for _, arg := range node.args {
+			if arg.typ != INT_VAL {
+				return fmt.Errorf("wrong argument type for %s", node.op)
+			}
+		}
+	}
+
+	if node.op == "regex_extract" {
+		if node.args[1].op != "str" {
+			return fmt.Errorf("regex_extract needs a quoted regex")
+		}
+
+		regex, err := regexp.Compile(node.args[1].str)
+		if err != nil {
+			return err
+		}
+		node.regex = regex
+	}
+
+	return nil
+}
+
+// lookup reads from a table loaded with LoadJoinTable, so the column's type is
+// known when the expression is parsed
+func (p *exprParser) checkLookup(node *exprNode) error {
+	if node.args[0].op != "str" || node.args[2].op != "str" {
+		return fmt.Errorf("lookup needs a quoted table and column")
+	}
+
+	table_m.Lock()
+	jt, ok := LOADED_TABLES[node.args[0].str]
+	table_m.Unlock()
+	if !ok || jt.join_lookup == nil {
+		return fmt.Errorf("%s is not loaded as a join table", node.args[0].str)
+	}
+
+	col_id, ok := jt.KeyTable[node.args[2].str]
+	if !ok {
+		return fmt.Errorf("unknown column in %s: %s", jt.Name, node.args[2].str)
+	}
+
+	col_type := jt.KeyTypes[col_id]
+	if col_type != INT_VAL && col_type != STR_VAL {
+		return fmt.Errorf("lookup can only read int and str columns: %s", node.args[2].str)
+	}
+
+	node.join = jt
+	node.col_id = col_id
+	node.typ = col_type
+	return nil
+}
+
+// }}} PARSER
+
+// }}} VIRTUAL COLUMNS
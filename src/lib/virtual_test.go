@@ -0,0 +1,107 @@
+package sybil_test
+
+import sybil "./"
+
+import "fmt"
+import "testing"
+
+func TestVirtualColumns(test *testing.T) {
+	delete_test_db()
+
+	if testing.Short() {
+		test.Skip("Skipping test in short mode")
+		return
+	}
+
+	block_count := 3
+
+	add_records(func(r *sybil.Record, index int) {
+		r.AddIntField("id", int64(index))
+		r.AddIntField("latency", int64(index*3%900))
+		r.AddStrField("path", fmt.Sprintf("/api%d/items/%d", index%3, index))
+	}, block_count)
+
+	nt := save_and_reload_table(test, block_count)
+
+	bucket, err := nt.VirtualColumn("bucket", "floor(latency/100)*100")
+	if err != nil {
+		test.Fatal("COULDNT PARSE VIRTUAL COLUMN", err)
+	}
+
+	path1, err := nt.VirtualColumn("path1", `regex_extract(path, "^/[^/]+")`)
+	if err != nil {
+		test.Fatal("COULDNT PARSE VIRTUAL COLUMN", err)
+	}
+
+	if bucket.Type != sybil.INT_VAL || path1.Type != sybil.STR_VAL {
+		test.Error("WRONG VIRTUAL COLUMN TYPES", bucket.Type, path1.Type)
+	}
+
+	querySpec := new_query_spec()
+	querySpec.Virtuals = []sybil.VirtualColumn{bucket, path1}
+	querySpec.Groups = append(querySpec.Groups, nt.Grouping("bucket"), nt.Grouping("path1"))
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("bucket", "avg"))
+	querySpec.Filters = append(querySpec.Filters, nt.IntFilter("bucket", "lt", 500))
+
+	nt.MatchAndAggregate(querySpec)
+
+	if len(querySpec.Results) != 15 {
+		test.Error("EXPECTED 5 BUCKETS FOR EACH OF 3 PATHS, GOT", len(querySpec.Results))
+	}
+
+	for _, r := range querySpec.Results {
+		var bucket_val int
+		var path string
+		fmt.Sscanf(r.GroupByKey, "%d"+sybil.GROUP_DELIMITER+"%s", &bucket_val, &path)
+
+		if bucket_val%100 != 0 || bucket_val >= 500 {
+			test.Error("UNEXPECTED BUCKET", r.GroupByKey)
+		}
+
+		avg := r.Hists["bucket"].Mean()
+		if int(avg) != bucket_val {
+			test.Error("BUCKET AVERAGE IS", avg, "FOR", r.GroupByKey)
+		}
+	}
+
+	for _, key := range []string{"/api0", "/api1", "/api2"} {
+		if _, ok := querySpec.Results["0"+sybil.GROUP_DELIMITER+key+sybil.GROUP_DELIMITER]; !ok {
+			test.Error("MISSING GROUP FOR", key)
+		}
+	}
+
+	delete_test_db()
+}
+
+func TestVirtualColumnErrors(test *testing.T) {
+	delete_test_db()
+
+	add_records(func(r *sybil.Record, index int) {
+		r.AddIntField("latency", int64(index))
+		r.AddStrField("path", "/")
+	}, 1)
+
+	nt := save_and_reload_table(test, 1)
+
+	for _, expr := range []string{
+		"latency +",
+		"path * 2",
+		"missing / 2",
+		"floor(latency, 2)",
+		"lower(latency)",
+		"regex_extract(path, path)",
+		`regex_extract(path, "(")`,
+		"nope(latency)",
+		`concat("unterminated)`,
+	} {
+		if _, err := nt.VirtualColumn("v", expr); err == nil {
+			test.Error("EXPECTED AN ERROR FOR", expr)
+		}
+	}
+
+	if _, err := nt.VirtualColumn("latency", "latency * 2"); err == nil {
+		test.Error("VIRTUAL COLUMNS SHOULDNT SHADOW COLUMNS")
+	}
+
+	delete_test_db()
+}